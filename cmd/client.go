@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/routing"
+)
+
+const (
+	CLIENT_USAGE = `commands:
+  routes                 list routings
+  ports                  list connected ports
+  endpoints              list endpoints and their connection states
+  fakeip                 list fake ip mappings
+  dial <endpoint>        connect to the endpoint
+  disconnect <endpoint>  disconnect the endpoint, it's not reconnected`
+)
+
+// query the running goose through the admin api
+func runClient(socket string, args []string) error {
+	if socket == "" {
+		return errors.Errorf("admin socket is not set")
+	}
+	client := routing.NewAdminClient(socket)
+
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+
+	switch args[0] {
+	case "routes":
+		routes, err := client.Routes()
+		if err != nil {
+			return err
+		}
+		t.AppendHeader(table.Row{"Network", "Port", "Metric", "RTT", "Cost", "Paths", "Penalty", "Origin", "Seqno", "Name"})
+		for _, route := range routes {
+			paths := []string{}
+			for _, path := range route.Paths {
+				paths = append(paths, path.Port)
+			}
+			for _, path := range route.Backups {
+				paths = append(paths, path.Port+" (backup)")
+			}
+			name := route.Name
+			if route.Anycast {
+				name += " (anycast)"
+			}
+			if route.Provisional {
+				name += " (provisional)"
+			}
+			t.AppendRow(table.Row{
+				route.Network,
+				route.Port,
+				route.Metric,
+				fmt.Sprintf("%d ms", route.Rtt),
+				fmt.Sprintf("%.0f", route.Cost),
+				strings.Join(paths, "\n"),
+				penalty(route.Flap),
+				route.Origin,
+				route.Seqno,
+				name,
+			})
+		}
+	case "ports":
+		ports, err := client.Ports()
+		if err != nil {
+			return err
+		}
+		t.AppendHeader(table.Row{"Port", "Peer", "In", "Out", "RTT", "Jitter", "Loss", "Routings", "Dropped", "Shaped", "Policed", "Penalty"})
+		for _, p := range ports {
+			t.AppendRow(table.Row{
+				p.Port,
+				p.PeerID,
+				p.PktIn,
+				p.PktOut,
+				fmt.Sprintf("%d ms", p.Rtt),
+				fmt.Sprintf("%.1f ms", p.Jitter),
+				fmt.Sprintf("%.1f%%", p.Loss*100),
+				p.Routings,
+				p.Dropped,
+				p.Shaped,
+				p.Policed,
+				penalty(p.Flap),
+			})
+		}
+	case "endpoints":
+		endpoints, err := client.Endpoints()
+		if err != nil {
+			return err
+		}
+		t.AppendHeader(table.Row{"Endpoint", "Status", "Failed", "Reason", "Next Retry", "Error"})
+		for _, ep := range endpoints {
+			retry := ""
+			if ep.Permanent {
+				retry = "never"
+			} else if !ep.NextRetry.IsZero() {
+				retry = ep.NextRetry.Format(time.TimeOnly)
+			}
+			t.AppendRow(table.Row{ep.Endpoint, ep.Status, ep.Failed, ep.Reason, retry, ep.Error})
+		}
+	case "fakeip":
+		mappings, err := client.FakeIP()
+		if err != nil {
+			return err
+		}
+		t.AppendHeader(table.Row{"Fake", "Real", "Domain"})
+		for _, m := range mappings {
+			t.AppendRow(table.Row{m.Fake.String(), m.Real.String(), m.Domain})
+		}
+	case "dial", "disconnect":
+		if len(args) != 2 {
+			return errors.Errorf("usage: %s <endpoint>", args[0])
+		}
+		call := client.Dial
+		if args[0] == "disconnect" {
+			call = client.Disconnect
+		}
+		if err := call(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", args[0], args[1])
+		return nil
+	default:
+		return errors.Errorf("unknown command %s\n%s", args[0], CLIENT_USAGE)
+	}
+	t.Render()
+	return nil
+}
+
+// flap penalty, and the reuse time if it's suppressed
+func penalty(flap *routing.FlapInfo) string {
+	if flap == nil {
+		return ""
+	}
+	if flap.Suppressed {
+		return fmt.Sprintf("%.0f suppressed until %s", flap.Penalty, flap.Reuse.Format(time.TimeOnly))
+	}
+	return fmt.Sprintf("%.0f", flap.Penalty)
+}
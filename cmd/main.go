@@ -1,15 +1,25 @@
 package main
 
 import (
-	// "context"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/nickjfree/goose/pkg/options"
 	"github.com/nickjfree/goose/pkg/routing"
+	"github.com/nickjfree/goose/pkg/wire/ipfs"
+)
+
+const (
+	// max time to withdraw routes and restore the host on shutdown
+	shutdownTimeout = time.Second * 10
 )
 
 var (
@@ -18,11 +28,86 @@ var (
 
 func main() {
 
+	// client commands talk to the running goose
+	if flag.NArg() > 0 {
+		if err := runClient(options.Admin, flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	opts := []routing.Option{
-		// metric
-		routing.WithMaxMetric(4),
+		// max hops of a path. the feasibility condition keeps routings loop free, so it only bounds the
+		// diameter of the mesh. half the packet ttl, the other half is left for transient detours
+		routing.WithMaxMetric(16),
 		// use base connector
 		routing.WithConnector(),
+		// equal cost multipath
+		routing.WithMultipath(options.Multipath),
+		// protocol timers
+		routing.WithTimers(routing.Timers{
+			RoutingInterval:   options.RoutingInterval,
+			RoutingExpire:     options.RoutingExpire,
+			IdleTimeout:       options.IdleTimeout,
+			RetryInterval:     options.RetryInterval,
+			RetryMaxBackoff:   options.MaxBackoff,
+			MaxRetries:        options.MaxRetries,
+			SearchInterval:    options.SearchInterval,
+			AdvertiseInterval: options.AdvertiseInterval,
+			Adaptive:          options.Adaptive,
+		}),
+	}
+
+	if options.Admin != "" {
+		opts = append(opts, routing.WithAdmin(options.Admin))
+	}
+
+	if options.Metrics != "" {
+		opts = append(opts, routing.WithMetrics(options.Metrics))
+	}
+
+	// recent peers and routings are restored on restart
+	opts = append(opts, routing.WithState(filepath.Join(ipfs.DataFolder(), "state.json")))
+
+	if options.Cost != "" {
+		weights, err := routing.ParseCostWeights(options.Cost)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts = append(opts, routing.WithCost(weights))
+	}
+
+	if options.AllowUnsigned {
+		opts = append(opts, routing.WithUnsigned())
+	}
+
+	if options.Policy != "" {
+		opts = append(opts, routing.WithPolicy(options.Policy))
+	}
+
+	if options.Firewall != "" {
+		opts = append(opts, routing.WithFirewall(options.Firewall))
+	}
+
+	if options.RateLimit != "" {
+		opts = append(opts, routing.WithRateLimit(options.RateLimit))
+	}
+
+	// anycast addresses in cidr format, eg. 10.200.0.53/32
+	anycast := []string{}
+	if options.Anycast != "" {
+		for _, address := range strings.Split(options.Anycast, ",") {
+			if !strings.Contains(address, "/") {
+				if strings.Contains(address, ":") {
+					address += "/128"
+				} else {
+					address += "/32"
+				}
+			}
+			anycast = append(anycast, address)
+		}
+		opts = append(opts, routing.WithAnycast(anycast...))
 	}
 
 	if options.Forward != "" {
@@ -41,10 +126,20 @@ func main() {
 		opts = append(opts, routing.WithName(fmt.Sprintf("%s.%s", options.Name, options.Namespace)))
 	}
 
-	r := routing.NewRouter(options.LocalAddr, opts...)
+	// ipv4 address and the optional ipv6 address
+	localAddr := options.LocalAddr
+	if options.LocalAddr6 != "" {
+		localAddr = fmt.Sprintf("%s,%s", options.LocalAddr, options.LocalAddr6)
+	}
+
+	r := routing.NewRouter(localAddr, opts...)
 
-	// create the tun device
-	tunnel := fmt.Sprintf("tun/%s/%s", "goose", options.LocalAddr)
+	// create the tun device, anycast addresses are flagged and set on it too
+	addrs := []string{localAddr}
+	for _, address := range anycast {
+		addrs = append(addrs, "@"+address)
+	}
+	tunnel := fmt.Sprintf("tun/%s/%s", "goose", strings.Join(addrs, ","))
 	r.Dial(tunnel)
 	// create a wireguard listener if enabled
 	if options.WireguardConfig != "" {
@@ -59,10 +154,32 @@ func main() {
 		}
 	}
 
+	// reload route policy, rate limits and firewall rules on SIGHUP
+	if options.Policy != "" || options.RateLimit != "" || options.Firewall != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := r.Reload(); err != nil {
+					logger.Printf("reload failed: %s", err)
+				}
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
-	r.Close()
-	logger.Printf("Press Ctrl+C again to quit")
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
+	logger.Printf("shutting down, press Ctrl+C again to quit now")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	go func() {
+		// quit now on the second signal
+		<-c
+		cancel()
+		os.Exit(1)
+	}()
+	if err := r.Shutdown(ctx); err != nil {
+		logger.Printf("shutdown: %s", err)
+	}
 }
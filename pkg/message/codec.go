@@ -0,0 +1,384 @@
+package message
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// gob encoding, used by legacy peers
+	CodecGob = 0
+	// compact binary encoding
+	CodecBinary = 1
+	// latest codec version
+	CodecVersion = CodecBinary
+
+	// routing entry flags
+	entryFlagAnycast = 1 << 0
+)
+
+// binary encoder
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+// length prefixed bytes
+func (e *encoder) bytes(b []byte) error {
+	if len(b) > 0xffff {
+		return errors.Errorf("field too large %d", len(b))
+	}
+	e.uint16(uint16(len(b)))
+	e.buf = append(e.buf, b...)
+	return nil
+}
+
+// ip address, 4 or 16 bytes
+func (e *encoder) ip(ip net.IP) error {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if len(ip) != 0 && len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return errors.Errorf("invalid ip %s", ip)
+	}
+	e.uint8(uint8(len(ip)))
+	e.buf = append(e.buf, ip...)
+	return nil
+}
+
+// network, ip followed by the prefix length
+func (e *encoder) network(n net.IPNet) error {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To16()
+	switch bits {
+	case 8 * net.IPv4len:
+		ip = n.IP.To4()
+	case 8 * net.IPv6len:
+	default:
+		return errors.Errorf("invalid network %s", n.String())
+	}
+	if ip == nil {
+		return errors.Errorf("invalid network %s", n.String())
+	}
+	e.uint8(uint8(len(ip)))
+	e.buf = append(e.buf, ip...)
+	e.uint8(uint8(ones))
+	return nil
+}
+
+// binary decoder, the first error sticks
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) need(n int) bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.buf) < n {
+		d.err = errors.Errorf("message truncated, need %d bytes, got %d", n, len(d.buf))
+		return false
+	}
+	return true
+}
+
+func (d *decoder) uint8() uint8 {
+	if !d.need(1) {
+		return 0
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if !d.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if !d.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if !d.need(n) {
+		return nil
+	}
+	v := make([]byte, n)
+	copy(v, d.buf)
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) ip() net.IP {
+	n := int(d.uint8())
+	if n != 0 && n != net.IPv4len && n != net.IPv6len {
+		d.err = errors.Errorf("invalid ip length %d", n)
+		return nil
+	}
+	if !d.need(n) {
+		return nil
+	}
+	ip := make(net.IP, n)
+	copy(ip, d.buf)
+	d.buf = d.buf[n:]
+	return ip
+}
+
+func (d *decoder) network() net.IPNet {
+	ip := d.ip()
+	ones := int(d.uint8())
+	if d.err != nil {
+		return net.IPNet{}
+	}
+	if len(ip) == 0 || ones > 8*len(ip) {
+		d.err = errors.Errorf("invalid network %s/%d", ip, ones)
+		return net.IPNet{}
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(ones, 8*len(ip)),
+	}
+}
+
+// true if there are more fields to decode
+func (d *decoder) more() bool {
+	return d.err == nil && len(d.buf) > 0
+}
+
+// sub decoder for a length prefixed block
+func (d *decoder) block() *decoder {
+	sub := &decoder{}
+	n := int(d.uint16())
+	if !d.need(n) {
+		sub.err = d.err
+		return sub
+	}
+	sub.buf = d.buf[:n]
+	d.buf = d.buf[n:]
+	return sub
+}
+
+// encode message with the binary codec
+//
+// [version:1][type:1][payload]
+func (m *Message) encodeBinary() ([]byte, error) {
+	e := &encoder{buf: make([]byte, 0, 64)}
+	e.uint8(CodecBinary)
+	e.uint8(uint8(m.Type))
+
+	switch m.Type {
+	case MessageTypePacket:
+		packet, ok := m.Payload.(Packet)
+		if !ok {
+			return nil, errors.Errorf("bad packet message %+v", m)
+		}
+		if err := packet.encode(e); err != nil {
+			return nil, err
+		}
+	case MessageTypeRouting:
+		routing, ok := m.Payload.(Routing)
+		if !ok {
+			return nil, errors.Errorf("bad routing message %+v", m)
+		}
+		if err := routing.encode(e); err != nil {
+			return nil, err
+		}
+	case MessageTypeFragment:
+		fragment, ok := m.Payload.(Fragment)
+		if !ok {
+			return nil, errors.Errorf("bad fragment message %+v", m)
+		}
+		if err := fragment.encode(e); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("unknown message type %d", m.Type)
+	}
+	return e.buf, nil
+}
+
+// decode message with the binary codec
+func (m *Message) decodeBinary(buf []byte) error {
+	d := &decoder{buf: buf}
+	if version := d.uint8(); d.err == nil && version != CodecBinary {
+		return errors.Errorf("unsupported codec version %d", version)
+	}
+	msgType := int(d.uint8())
+	if d.err != nil {
+		return d.err
+	}
+	switch msgType {
+	case MessageTypePacket:
+		packet := Packet{}
+		if err := packet.decode(d); err != nil {
+			return err
+		}
+		m.Payload = packet
+	case MessageTypeRouting:
+		routing := Routing{}
+		if err := routing.decode(d); err != nil {
+			return err
+		}
+		m.Payload = routing
+	case MessageTypeFragment:
+		fragment := Fragment{}
+		if err := fragment.decode(d); err != nil {
+			return err
+		}
+		m.Payload = fragment
+	default:
+		return errors.Errorf("unknown message type %d", msgType)
+	}
+	m.Type = msgType
+	return nil
+}
+
+// [dst][src][ttl:1][data]
+func (p *Packet) encode(e *encoder) error {
+	if err := e.ip(p.Dst); err != nil {
+		return err
+	}
+	if err := e.ip(p.Src); err != nil {
+		return err
+	}
+	if p.TTL < 0 || p.TTL > 0xff {
+		return errors.Errorf("invalid packet ttl %d", p.TTL)
+	}
+	e.uint8(uint8(p.TTL))
+	return e.bytes(p.Data)
+}
+
+func (p *Packet) decode(d *decoder) error {
+	p.Dst = d.ip()
+	p.Src = d.ip()
+	p.TTL = int(d.uint8())
+	p.Data = d.bytes()
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = errors.Errorf("%d trailing bytes after packet", len(d.buf))
+	}
+	return d.err
+}
+
+// [type:1][message][count:2][entries]
+func (r *Routing) encode(e *encoder) error {
+	if r.Type < 0 || r.Type > 0xff {
+		return errors.Errorf("invalid routing type %d", r.Type)
+	}
+	e.uint8(uint8(r.Type))
+	if err := e.bytes([]byte(r.Message)); err != nil {
+		return err
+	}
+	if len(r.Routings) > 0xffff {
+		return errors.Errorf("too many routing entries %d", len(r.Routings))
+	}
+	e.uint16(uint16(len(r.Routings)))
+	for i := range r.Routings {
+		if err := r.Routings[i].encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Routing) decode(d *decoder) error {
+	r.Type = int(d.uint8())
+	r.Message = string(d.bytes())
+	count := int(d.uint16())
+	if d.err != nil {
+		return d.err
+	}
+	r.Routings = make([]RoutingEntry, 0, count)
+	for i := 0; i < count; i++ {
+		entry := RoutingEntry{}
+		if err := entry.decode(d); err != nil {
+			return err
+		}
+		r.Routings = append(r.Routings, entry)
+	}
+	if len(d.buf) != 0 {
+		return errors.Errorf("%d trailing bytes after routing", len(d.buf))
+	}
+	return nil
+}
+
+// entries are length prefixed, so fields appended by newer versions
+// can be skipped by older decoders
+//
+// [len:2][network][metric:4][rtt:4][origin][name][public key][signature][seqno:2][flags:1]
+func (entry *RoutingEntry) encode(e *encoder) error {
+	body := &encoder{}
+	if err := body.network(entry.Network); err != nil {
+		return err
+	}
+	body.uint32(uint32(int32(entry.Metric)))
+	body.uint32(uint32(int32(entry.Rtt)))
+	if err := body.bytes([]byte(entry.Origin)); err != nil {
+		return err
+	}
+	if err := body.bytes([]byte(entry.Name)); err != nil {
+		return err
+	}
+	if err := body.bytes(entry.PublicKey); err != nil {
+		return err
+	}
+	if err := body.bytes(entry.Signature); err != nil {
+		return err
+	}
+	body.uint16(entry.Seqno)
+	body.uint8(entry.flags())
+	return e.bytes(body.buf)
+}
+
+func (entry *RoutingEntry) flags() uint8 {
+	var flags uint8
+	if entry.Anycast {
+		flags |= entryFlagAnycast
+	}
+	return flags
+}
+
+func (entry *RoutingEntry) decode(d *decoder) error {
+	body := d.block()
+	entry.Network = body.network()
+	entry.Metric = int(int32(body.uint32()))
+	entry.Rtt = int(int32(body.uint32()))
+	entry.Origin = string(body.bytes())
+	entry.Name = string(body.bytes())
+	// optional fields appended by newer versions
+	if body.more() {
+		entry.PublicKey = body.bytes()
+		entry.Signature = body.bytes()
+	}
+	if body.more() {
+		entry.Seqno = body.uint16()
+	}
+	if body.more() {
+		entry.Anycast = body.uint8()&entryFlagAnycast != 0
+	}
+	return body.err
+}
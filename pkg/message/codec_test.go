@@ -0,0 +1,171 @@
+package message
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// test packet round trip with every codec
+func TestPacketCodec(t *testing.T) {
+
+	msg := Message{
+		Type: MessageTypePacket,
+		Payload: Packet{
+			Dst:  net.IPv4(192, 168, 1, 2).To4(),
+			Src:  net.IPv4(192, 168, 1, 3).To4(),
+			TTL:  PacketTTL,
+			Data: []byte{0x45, 0x00, 0x00, 0x14},
+		},
+	}
+	for _, version := range []int{CodecGob, CodecBinary} {
+		buf, err := msg.EncodeVersion(version)
+		if err != nil {
+			t.Fatalf("encode version %d: %s", version, err)
+		}
+		decoded := Message{}
+		if err := decoded.DecodeVersion(version, buf); err != nil {
+			t.Fatalf("decode version %d: %s", version, err)
+		}
+		if !reflect.DeepEqual(msg, decoded) {
+			t.Fatalf("version %d mismatch %+v != %+v", version, msg, decoded)
+		}
+	}
+}
+
+// test routing round trip with every codec
+func TestRoutingCodec(t *testing.T) {
+
+	_, v4, _ := net.ParseCIDR("10.1.0.0/16")
+	_, v6, _ := net.ParseCIDR("fd00:1::/64")
+	msg := Message{
+		Type: MessageTypeRouting,
+		Payload: Routing{
+			Type: RoutingRegisterAck,
+			Routings: []RoutingEntry{
+				{Network: *v4, Metric: 2, Rtt: 120, Origin: "QmOrigin", Name: "a.goose", PublicKey: []byte{3, 4, 5}, Signature: []byte{1, 2}, Seqno: 7, Anycast: true},
+				{Network: *v6, Metric: -1, Rtt: 0},
+			},
+			Message: "ack",
+		},
+	}
+	for _, version := range []int{CodecGob, CodecBinary} {
+		buf, err := msg.EncodeVersion(version)
+		if err != nil {
+			t.Fatalf("encode version %d: %s", version, err)
+		}
+		decoded := Message{}
+		if err := decoded.DecodeVersion(version, buf); err != nil {
+			t.Fatalf("decode version %d: %s", version, err)
+		}
+		routing := decoded.Payload.(Routing)
+		expected := msg.Payload.(Routing)
+		if routing.Type != expected.Type || routing.Message != expected.Message || len(routing.Routings) != len(expected.Routings) {
+			t.Fatalf("version %d mismatch %+v != %+v", version, expected, routing)
+		}
+		for i := range routing.Routings {
+			if !sameEntry(routing.Routings[i], expected.Routings[i]) {
+				t.Fatalf("version %d entry mismatch %+v != %+v", version, expected.Routings[i], routing.Routings[i])
+			}
+		}
+	}
+}
+
+func sameEntry(got, want RoutingEntry) bool {
+	return got.Network.String() == want.Network.String() && got.Metric == want.Metric &&
+		got.Rtt == want.Rtt && got.Origin == want.Origin && got.Name == want.Name &&
+		bytes.Equal(got.PublicKey, want.PublicKey) && bytes.Equal(got.Signature, want.Signature) &&
+		got.Seqno == want.Seqno && got.Anycast == want.Anycast
+}
+
+// test entries of older versions decode without the fields they lack, and fields of newer versions are skipped
+func TestRoutingEntryOptionalFields(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	full := RoutingEntry{Network: *network, Metric: 2, Rtt: 120, Origin: "QmOrigin", Name: "a.goose", PublicKey: []byte{3, 4, 5}, Signature: []byte{1, 2}, Seqno: 7, Anycast: true}
+	// entry body with the fields up to the version
+	body := func(fields int) []byte {
+		e := &encoder{}
+		e.network(full.Network)
+		e.uint32(uint32(full.Metric))
+		e.uint32(uint32(full.Rtt))
+		e.bytes([]byte(full.Origin))
+		e.bytes([]byte(full.Name))
+		if fields > 0 {
+			e.bytes(full.PublicKey)
+			e.bytes(full.Signature)
+		}
+		if fields > 1 {
+			e.uint16(full.Seqno)
+		}
+		if fields > 2 {
+			e.uint8(full.flags())
+		}
+		if fields > 3 {
+			// fields of a newer version
+			e.uint32(0xdeadbeef)
+		}
+		return e.buf
+	}
+	legacy := RoutingEntry{Network: full.Network, Metric: full.Metric, Rtt: full.Rtt, Origin: full.Origin, Name: full.Name}
+	signed := legacy
+	signed.PublicKey, signed.Signature = full.PublicKey, full.Signature
+	sequenced := signed
+	sequenced.Seqno = full.Seqno
+	for fields, want := range []RoutingEntry{legacy, signed, sequenced, full, full} {
+		// the next entry is decoded after the unknown fields
+		e := &encoder{}
+		e.bytes(body(fields))
+		if err := full.encode(e); err != nil {
+			t.Fatal(err)
+		}
+		d := &decoder{buf: e.buf}
+		for _, expected := range []RoutingEntry{want, full} {
+			got := RoutingEntry{}
+			if err := got.decode(d); err != nil {
+				t.Fatalf("fields %d: %s", fields, err)
+			}
+			if !sameEntry(got, expected) {
+				t.Fatalf("fields %d: entry mismatch %+v != %+v", fields, expected, got)
+			}
+		}
+		if d.more() {
+			t.Fatalf("fields %d: %d bytes left", fields, len(d.buf))
+		}
+	}
+}
+
+// truncated or corrupted frames must be rejected
+func TestBinaryCodecMalformed(t *testing.T) {
+
+	msg := Message{
+		Type: MessageTypePacket,
+		Payload: Packet{
+			Dst:  net.IPv4(10, 0, 0, 1),
+			Src:  net.IPv4(10, 0, 0, 2),
+			TTL:  PacketTTL,
+			Data: bytes.Repeat([]byte{1}, 100),
+		},
+	}
+	buf, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(buf); i++ {
+		decoded := Message{}
+		if err := decoded.Decode(buf[:i]); err == nil {
+			t.Fatalf("truncated frame of %d bytes decoded", i)
+		}
+	}
+	// trailing garbage
+	decoded := Message{}
+	if err := decoded.Decode(append(buf, 0)); err == nil {
+		t.Fatal("frame with trailing bytes decoded")
+	}
+	// unknown version
+	bad := append([]byte{}, buf...)
+	bad[0] = 0xff
+	if err := decoded.Decode(bad); err == nil {
+		t.Fatal("frame with unknown version decoded")
+	}
+}
@@ -0,0 +1,209 @@
+package message
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// max fragments of a single message
+	maxFragments = 0xff
+	// fragment header size in the binary codec, version, type, id, index, count and data length
+	FragmentOverhead = 1 + 1 + 4 + 1 + 1 + 2
+)
+
+// fragment of an encoded message
+type Fragment struct {
+	// message id
+	ID uint32
+	// fragment index
+	Index int
+	// total fragments
+	Count int
+	// part of the encoded message
+	Data []byte
+}
+
+// [id:4][index:1][count:1][data]
+func (f *Fragment) encode(e *encoder) error {
+	if f.Count <= 0 || f.Count > maxFragments || f.Index < 0 || f.Index >= f.Count {
+		return errors.Errorf("invalid fragment %d/%d", f.Index, f.Count)
+	}
+	e.uint32(f.ID)
+	e.uint8(uint8(f.Index))
+	e.uint8(uint8(f.Count))
+	return e.bytes(f.Data)
+}
+
+func (f *Fragment) decode(d *decoder) error {
+	f.ID = d.uint32()
+	f.Index = int(d.uint8())
+	f.Count = int(d.uint8())
+	f.Data = d.bytes()
+	if d.err != nil {
+		return d.err
+	}
+	if f.Count == 0 || f.Index >= f.Count {
+		return errors.Errorf("invalid fragment %d/%d", f.Index, f.Count)
+	}
+	if len(d.buf) != 0 {
+		return errors.Errorf("%d trailing bytes after fragment", len(d.buf))
+	}
+	return nil
+}
+
+// split an encoded message into fragments, each carries at most size bytes
+func SplitFragments(buf []byte, id uint32, size int) ([]Message, error) {
+	if size <= 0 {
+		return nil, errors.Errorf("invalid fragment size %d", size)
+	}
+	count := (len(buf) + size - 1) / size
+	if count > maxFragments {
+		return nil, errors.Errorf("message too large to fragment, %d bytes", len(buf))
+	}
+	msgs := make([]Message, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(buf) {
+			end = len(buf)
+		}
+		msgs = append(msgs, Message{
+			Type: MessageTypeFragment,
+			Payload: Fragment{
+				ID:    id,
+				Index: i,
+				Count: count,
+				Data:  buf[i*size : end],
+			},
+		})
+	}
+	return msgs, nil
+}
+
+// partially received message
+type reassembly struct {
+	// received parts
+	parts [][]byte
+	// received count
+	received int
+	// buffered bytes
+	size int
+	// first fragment arrived at
+	createdAt time.Time
+}
+
+// fragment reassembler of a wire. not thread safe
+type Reassembler struct {
+	// pending messages
+	pending map[uint32]*reassembly
+	// total buffered bytes
+	size int
+	// memory limit
+	maxSize int
+	// reassembly timeout
+	timeout time.Duration
+	// last expiring time
+	expiredAt time.Time
+}
+
+func NewReassembler(maxSize int, timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		pending:   make(map[uint32]*reassembly),
+		maxSize:   maxSize,
+		timeout:   timeout,
+		expiredAt: time.Now(),
+	}
+}
+
+// add a fragment, returns the encoded message when all the fragments are received
+func (r *Reassembler) Add(f *Fragment) ([]byte, error) {
+	now := time.Now()
+	if now.Sub(r.expiredAt) > r.timeout/2 {
+		r.expire(now)
+	}
+	if f.Count <= 0 || f.Index < 0 || f.Index >= f.Count {
+		return nil, errors.Errorf("invalid fragment %d/%d", f.Index, f.Count)
+	}
+	if len(f.Data) > r.maxSize {
+		return nil, errors.Errorf("fragment too large, %d bytes", len(f.Data))
+	}
+	item, ok := r.pending[f.ID]
+	if !ok {
+		item = &reassembly{
+			parts:     make([][]byte, f.Count),
+			createdAt: now,
+		}
+		r.pending[f.ID] = item
+	}
+	if len(item.parts) != f.Count {
+		r.remove(f.ID)
+		return nil, errors.Errorf("fragment count mismatch for message %d", f.ID)
+	}
+	// duplicated fragment
+	if item.parts[f.Index] != nil {
+		return nil, nil
+	}
+	// make room for the new fragment, drop the oldest messages
+	for r.size+len(f.Data) > r.maxSize {
+		r.evictOldest(f.ID)
+	}
+	item.parts[f.Index] = f.Data
+	item.received += 1
+	item.size += len(f.Data)
+	r.size += len(f.Data)
+	if item.received < f.Count {
+		return nil, nil
+	}
+	// all fragments received
+	buf := make([]byte, 0, item.size)
+	for _, part := range item.parts {
+		buf = append(buf, part...)
+	}
+	r.remove(f.ID)
+	return buf, nil
+}
+
+func (r *Reassembler) remove(id uint32) {
+	if item, ok := r.pending[id]; ok {
+		r.size -= item.size
+		delete(r.pending, id)
+	}
+}
+
+// evict the oldest message, but not the current one unless it's the only one
+func (r *Reassembler) evictOldest(current uint32) {
+	var oldest uint32
+	var oldestAt time.Time
+	found := false
+	for id, item := range r.pending {
+		if id == current && len(r.pending) > 1 {
+			continue
+		}
+		if !found || item.createdAt.Before(oldestAt) {
+			oldest, oldestAt, found = id, item.createdAt, true
+		}
+	}
+	if found {
+		if oldest == current {
+			// the current message can't fit, restart it
+			r.size -= r.pending[current].size
+			item := r.pending[current]
+			item.parts = make([][]byte, len(item.parts))
+			item.received = 0
+			item.size = 0
+			return
+		}
+		r.remove(oldest)
+	}
+}
+
+// drop timed out messages
+func (r *Reassembler) expire(now time.Time) {
+	for id, item := range r.pending {
+		if now.Sub(item.createdAt) > r.timeout {
+			r.remove(id)
+		}
+	}
+	r.expiredAt = now
+}
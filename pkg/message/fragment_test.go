@@ -0,0 +1,110 @@
+package message
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func encodeFragments(t *testing.T, buf []byte, id uint32, size int) []Fragment {
+	msgs, err := SplitFragments(buf, id, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragments := []Fragment{}
+	for _, msg := range msgs {
+		data, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > size+FragmentOverhead {
+			t.Fatalf("fragment of %d bytes exceeds %d", len(data), size+FragmentOverhead)
+		}
+		decoded := Message{}
+		if err := decoded.Decode(data); err != nil {
+			t.Fatal(err)
+		}
+		fragments = append(fragments, decoded.Payload.(Fragment))
+	}
+	return fragments
+}
+
+// test fragments are reassembled in any order
+func TestFragmentReassembly(t *testing.T) {
+
+	msg := Message{
+		Type: MessageTypePacket,
+		Payload: Packet{
+			Dst:  net.IPv4(10, 0, 0, 1),
+			Src:  net.IPv4(10, 0, 0, 2),
+			TTL:  PacketTTL,
+			Data: bytes.Repeat([]byte{0xab}, 1400),
+		},
+	}
+	buf, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragments := encodeFragments(t, buf, 1, 500)
+	if len(fragments) != 3 {
+		t.Fatalf("expect 3 fragments, got %d", len(fragments))
+	}
+	r := NewReassembler(64*1024, time.Second)
+	// reversed, with a duplicate
+	order := []int{2, 2, 0, 1}
+	var full []byte
+	for i, index := range order {
+		out, err := r.Add(&fragments[index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(order)-1 && out != nil {
+			t.Fatalf("message completed early at fragment %d", i)
+		}
+		full = out
+	}
+	if !bytes.Equal(full, buf) {
+		t.Fatal("reassembled message mismatch")
+	}
+	if r.size != 0 || len(r.pending) != 0 {
+		t.Fatalf("reassembler not cleared, size %d pending %d", r.size, len(r.pending))
+	}
+}
+
+// test incomplete messages are dropped by timeout and memory limit
+func TestFragmentLimits(t *testing.T) {
+
+	buf := bytes.Repeat([]byte{1}, 1000)
+	r := NewReassembler(1000, time.Millisecond*10)
+
+	first := encodeFragments(t, buf, 1, 400)
+	if _, err := r.Add(&first[0]); err != nil {
+		t.Fatal(err)
+	}
+	// memory limit evicts the oldest message
+	second := encodeFragments(t, buf, 2, 400)
+	for i := range second {
+		if _, err := r.Add(&second[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := r.pending[1]; ok {
+		t.Fatal("oldest message not evicted")
+	}
+	// timeout
+	third := encodeFragments(t, buf, 3, 400)
+	if _, err := r.Add(&third[0]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if _, err := r.Add(&first[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.pending[3]; ok {
+		t.Fatal("timed out message not dropped")
+	}
+	if r.size > 1000 {
+		t.Fatalf("memory limit exceeded %d", r.size)
+	}
+}
@@ -17,8 +17,18 @@ const (
 	// routing
 	RoutingRegisterFailed = 2
 	RoutingRegisterAck    = 3
+	// fragment of an oversized message
+	MessageTypeFragment = 4
+	// routing withdrawal
+	RoutingWithdraw = 5
+	// request for a newer sequence number of the origin
+	RoutingRequest = 6
+	// metric of withdrawn routings, legacy peers drop them as unreachable
+	MetricInfinity = 0xffff
 	// ttl
 	PacketTTL = 32
+	// max variable sized bytes of entries in a split routing message
+	splitSize = 800
 )
 
 // wire message
@@ -51,6 +61,25 @@ type RoutingEntry struct {
 	Origin string
 	// name
 	Name string
+	// origin's public key, empty if it can be extracted from the origin id
+	PublicKey []byte
+	// origin's signature of the entry
+	Signature []byte
+	// origin's sequence number
+	Seqno uint16
+	// anycast network, may be announced by several origins
+	Anycast bool
+}
+
+// data signed by the origin, fields changed by each hop are excluded
+func (entry *RoutingEntry) SignedData() []byte {
+	e := &encoder{buf: []byte("goose-origin:")}
+	e.network(entry.Network)
+	e.bytes([]byte(entry.Origin))
+	e.bytes([]byte(entry.Name))
+	e.uint16(entry.Seqno)
+	e.uint8(entry.flags())
+	return e.buf
 }
 
 // routing register msg
@@ -67,28 +96,49 @@ func init() {
 	gob.RegisterName("M", Message{})
 	gob.RegisterName("P", Packet{})
 	gob.RegisterName("R", Routing{})
+	gob.RegisterName("F", Fragment{})
 }
 
-// encode to bytes
+// encode to bytes with the latest codec
 func (m *Message) Encode() ([]byte, error) {
-
-	b := bytes.Buffer{}
-	enc := gob.NewEncoder(&b)
-	if err := enc.Encode(m); err != nil {
-		return nil, errors.WithStack(err)
-	}
-	return b.Bytes(), nil
+	return m.EncodeVersion(CodecVersion)
 }
 
-// decode from bytes
+// decode from bytes with the latest codec
 func (m *Message) Decode(buf []byte) error {
-	b := bytes.NewBuffer(buf)
+	return m.DecodeVersion(CodecVersion, buf)
+}
 
-	dec := gob.NewDecoder(b)
-	if err := dec.Decode(m); err != nil {
-		return errors.WithStack(err)
+// encode to bytes with the codec negotiated with the peer
+func (m *Message) EncodeVersion(version int) ([]byte, error) {
+	switch version {
+	case CodecGob:
+		b := bytes.Buffer{}
+		enc := gob.NewEncoder(&b)
+		if err := enc.Encode(m); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return b.Bytes(), nil
+	case CodecBinary:
+		return m.encodeBinary()
 	}
-	return nil
+	return nil, errors.Errorf("unsupported codec version %d", version)
+}
+
+// decode from bytes with the codec negotiated with the peer
+func (m *Message) DecodeVersion(version int, buf []byte) error {
+	switch version {
+	case CodecGob:
+		b := bytes.NewBuffer(buf)
+		dec := gob.NewDecoder(b)
+		if err := dec.Decode(m); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	case CodecBinary:
+		return m.decodeBinary(buf)
+	}
+	return errors.Errorf("unsupported codec version %d", version)
 }
 
 // split routing message into multiple small messages
@@ -110,9 +160,25 @@ func (m *Message) Split() ([]Message, error) {
 	}
 
 	fragment := []RoutingEntry{}
+	size := 0
 	for i := range routingMessage.Routings {
 
-		fragment = append(fragment, routingMessage.Routings[i])
+		entry := &routingMessage.Routings[i]
+		entrySize := len(entry.Origin) + len(entry.Name) + len(entry.PublicKey) + len(entry.Signature)
+		// signed entries are large, keep each message in a single datagram when possible
+		if len(fragment) > 0 && size+entrySize > splitSize {
+			msgs = append(msgs, Message{
+				Type: MessageTypeRouting,
+				Payload: Routing{
+					Type:     routingMessage.Type,
+					Routings: fragment,
+				},
+			})
+			fragment = []RoutingEntry{}
+			size = 0
+		}
+		fragment = append(fragment, *entry)
+		size += entrySize
 		if len(fragment) >= 4 {
 			msg := Message{
 				Type: MessageTypeRouting,
@@ -123,6 +189,7 @@ func (m *Message) Split() ([]Message, error) {
 			}
 			msgs = append(msgs, msg)
 			fragment = []RoutingEntry{}
+			size = 0
 		}
 	}
 	if len(fragment) > 0 {
@@ -1,9 +1,15 @@
 package options
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
 )
 
 const (
@@ -15,6 +21,21 @@ eg. ipfs/QmVCVa7RfutQDjvUYTejMyVLMMF5xYAM1mEddDVwMmdLf4,ipfs/QmYXWTQ1jTZ3ZEXssCy
 	LOCAL_HELP = `
 virtual ip address to use in CIDR format.
 local ipv4 address to set on the tunnel interface.
+`
+
+	LOCAL6_HELP = `
+virtual ipv6 address to use in CIDR format.
+local ipv6 address to set on the tunnel interface, empty to disable ipv6.
+`
+
+	COST_HELP = `
+route cost weights, comma separated. missing weights use defaults.
+eg. hop=20,rtt=1,jitter=1,loss=500,hysteresis=0.1
+`
+
+	CONFIG_HELP = `
+json config file, keys are the flag names. flags on the command line take precedence.
+eg. {"n": "my-network", "routing-interval": "60s", "adaptive": true}
 `
 )
 
@@ -23,6 +44,8 @@ var (
 	Endpoints = ""
 	// local addr
 	LocalAddr = ""
+	// local ipv6 addr
+	LocalAddr6 = ""
 	// forward
 	Forward = ""
 	// namespace
@@ -42,15 +65,49 @@ var (
 	Private = false
 	// router
 	Router = false
+	// route cost weights
+	Cost = ""
+	// max equal cost paths
+	Multipath = 4
+	// accept unsigned host routings from legacy peers
+	AllowUnsigned = false
+	// route policy file
+	Policy = ""
+	// firewall rules file
+	Firewall = ""
+	// per-peer rate limits file
+	RateLimit = ""
+	// anycast addresses
+	Anycast = ""
+	// admin api unix socket
+	Admin = ""
+	// prometheus metrics address
+	Metrics = ""
+	// config file
+	Config = ""
+	// protocol timers
+	RoutingInterval   = time.Second * 30
+	RoutingExpire     = time.Second * 180
+	IdleTimeout       = time.Second * 300
+	RetryInterval     = time.Second * 15
+	MaxBackoff        = time.Minute * 10
+	MaxRetries        = 32
+	SearchInterval    = time.Second * 300
+	AdvertiseInterval = time.Second * 300
+	Adaptive          = false
 )
 
 func init() {
 
 	defaultLocalAddr := fmt.Sprintf("192.168.%d.%d/24", rand.Intn(255), rand.Intn(255))
+	// goose ULA prefix fd67:6f6f:7365::/64
+	defaultLocalAddr6 := fmt.Sprintf("fd67:6f6f:7365::%x:%x/64", rand.Intn(0xffff)+1, rand.Intn(0xffff)+1)
 
 	flag.StringVar(&Endpoints, "e", "", ENDPOINT_HELP)
 	flag.StringVar(&LocalAddr, "l", defaultLocalAddr, LOCAL_HELP)
+	flag.StringVar(&LocalAddr6, "l6", defaultLocalAddr6, LOCAL6_HELP)
 	flag.StringVar(&Forward, "f", "", "forward networks, comma separated CIDRs")
+	flag.StringVar(&Anycast, "anycast", "", "anycast addresses served by this node, comma separated")
 	flag.StringVar(&Namespace, "n", "", "namespace")
 	flag.StringVar(&FakeRange, "p", "", "fake ip range")
 	flag.StringVar(&RuleScript, "r", "", "rule script")
@@ -60,5 +117,65 @@ func init() {
 	flag.StringVar(&Bootstraps, "b", "", "bootstraps")
 	flag.BoolVar(&Private, "private", false, "private network")
 	flag.BoolVar(&Router, "router", false, "running in routers")
+	flag.StringVar(&Cost, "cost", "", COST_HELP)
+	flag.BoolVar(&AllowUnsigned, "allow-unsigned", false, "accept unsigned routings from legacy peers, they never replace signed ones")
+	flag.StringVar(&Policy, "policy", "", "route policy file, reloaded on SIGHUP")
+	flag.StringVar(&Firewall, "firewall", "", "firewall rules file of peer traffics, reloaded on SIGHUP")
+	flag.StringVar(&RateLimit, "ratelimit", "", "per-peer rate limits file, reloaded on SIGHUP")
+	flag.IntVar(&Multipath, "multipath", 4, "max equal cost paths of a network, 1 to disable multipath")
+	flag.StringVar(&Admin, "admin", filepath.Join(os.TempDir(), "goose.sock"), "admin api unix socket, empty to disable")
+	flag.StringVar(&Metrics, "metrics", "", "serve prometheus metrics on the address, eg. 127.0.0.1:9100")
+	flag.StringVar(&Config, "c", "", CONFIG_HELP)
+	flag.DurationVar(&RoutingInterval, "routing-interval", RoutingInterval, "interval of routing announcements")
+	flag.DurationVar(&RoutingExpire, "routing-expire", RoutingExpire, "routings not refreshed in this time are removed")
+	flag.DurationVar(&IdleTimeout, "idle-timeout", IdleTimeout, "connections without routing updates in this time are closed")
+	flag.DurationVar(&RetryInterval, "retry-interval", RetryInterval, "first retry delay of failed endpoints, doubled with each failure")
+	flag.DurationVar(&MaxBackoff, "max-backoff", MaxBackoff, "max retry delay of failed endpoints")
+	flag.IntVar(&MaxRetries, "max-retries", MaxRetries, "failed endpoints are forgotten after this many retries")
+	flag.DurationVar(&SearchInterval, "search-interval", SearchInterval, "interval of searching peers in the namespace")
+	flag.DurationVar(&AdvertiseInterval, "advertise-interval", AdvertiseInterval, "interval of advertising this node in the namespace")
+	flag.BoolVar(&Adaptive, "adaptive", false, "announce routings faster while the topology is changing, slower when it's stable")
+	// test binaries parse their own flags
+	if testing.Testing() {
+		return
+	}
 	flag.Parse()
+
+	if Config != "" {
+		if err := loadConfig(Config); err != nil {
+			fmt.Fprintf(os.Stderr, "config %s: %s\n", Config, err)
+			os.Exit(2)
+		}
+	}
+}
+
+// set the flags not given on the command line from the json config file
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// numbers are kept as written, so large integers are not formatted as floats
+	values := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown key %s", name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,46 @@
+package options
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// test config values are set as written, and flags given on the command line are kept
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goose.json")
+	data := `{
+		"multipath": 1000000,
+		"routing-interval": "45s",
+		"adaptive": true,
+		"n": "my-network",
+		"cost": "from-config"
+	}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("cost", "from-command-line"); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if Multipath != 1000000 || RoutingInterval != time.Second*45 || !Adaptive || Namespace != "my-network" {
+		t.Fatalf("config not loaded: multipath %d, routing interval %s, adaptive %v, namespace %s",
+			Multipath, RoutingInterval, Adaptive, Namespace)
+	}
+	if Cost != "from-command-line" {
+		t.Fatalf("command line flag overridden by %s", Cost)
+	}
+	// the flags loaded above are given now, these are not
+	for _, invalid := range []string{`{"unknown": 1}`, `{"max-retries": 1.5}`, `{"max-retries": "many"}`, `{"max-backoff": 30}`, `[]`} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); err == nil {
+			t.Fatalf("invalid config %s loaded", invalid)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/routing/fakeip"
+)
+
+const (
+	// admin api request timeout
+	adminTimeout = time.Second * 10
+)
+
+// a path of a routing
+type PathInfo struct {
+	Port   string  `json:"port"`
+	Metric int     `json:"metric"`
+	Rtt    int     `json:"rtt"`
+	Cost   float64 `json:"cost"`
+}
+
+// a routing in the route table
+type RouteInfo struct {
+	Network string `json:"network"`
+	PathInfo
+	Origin  string `json:"origin"`
+	Name    string `json:"name"`
+	Seqno   uint16 `json:"seqno"`
+	Anycast bool   `json:"anycast"`
+	// restored from the saved state and not confirmed yet
+	Provisional bool       `json:"provisional,omitempty"`
+	Paths       []PathInfo `json:"paths"`
+	Backups     []PathInfo `json:"backups"`
+	Updated     time.Time  `json:"updated"`
+	// flap dampening state, suppressed networks are listed without paths
+	Flap *FlapInfo `json:"flap,omitempty"`
+}
+
+// flap dampening state of a network or a port
+type FlapInfo struct {
+	Penalty    float64   `json:"penalty"`
+	Flaps      int       `json:"flaps"`
+	Suppressed bool      `json:"suppressed"`
+	Reuse      time.Time `json:"reuse,omitempty"`
+}
+
+// a connected port
+type PortInfo struct {
+	Port     string  `json:"port"`
+	Endpoint string  `json:"endpoint"`
+	PeerID   string  `json:"peer_id,omitempty"`
+	PktIn    int64   `json:"pkt_in"`
+	PktOut   int64   `json:"pkt_out"`
+	Rtt      int     `json:"rtt"`
+	Jitter   float64 `json:"jitter"`
+	Loss     float64 `json:"loss"`
+	Routings int     `json:"routings"`
+	// packets dropped by the output queue
+	Dropped int64 `json:"dropped"`
+	// packets delayed and dropped by rate limiting, both directions
+	Shaped  int64 `json:"shaped"`
+	Policed int64 `json:"policed"`
+	// flap dampening state of the endpoint
+	Flap *FlapInfo `json:"flap,omitempty"`
+}
+
+// an endpoint known by the connector
+type EndpointInfo struct {
+	Endpoint string `json:"endpoint"`
+	Status   string `json:"status"`
+	Failed   int    `json:"failed"`
+	// last failure, permanent failures are not retried
+	Reason    string    `json:"reason,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Permanent bool      `json:"permanent,omitempty"`
+	NextRetry time.Time `json:"next_retry,omitempty"`
+}
+
+// body of dial and disconnect requests
+type EndpointRequest struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// error response of the admin api
+type AdminError struct {
+	Error string `json:"error"`
+}
+
+// serve the admin api on the unix socket until the router is closed
+func (r *Router) serveAdmin(path string) error {
+	// remove the socket left by the last run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	// dial and disconnect are allowed, only the owner can connect
+	listener, err := listenAdmin(path)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      r.adminMux(),
+		ReadTimeout:  adminTimeout,
+		WriteTimeout: adminTimeout,
+	}
+	go func() {
+		<-r.closed
+		ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	logger.Printf("admin api listening on %s", path)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// routes of the admin api
+func (r *Router) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /routes", r.adminHandler(r.routeInfos))
+	mux.HandleFunc("GET /ports", r.adminHandler(r.portInfos))
+	mux.HandleFunc("GET /endpoints", r.adminHandler(r.endpointInfos))
+	mux.HandleFunc("GET /fakeip", r.adminHandler(r.fakeIPMappings))
+	mux.HandleFunc("POST /dial", r.adminHandler(r.adminDial))
+	mux.HandleFunc("POST /disconnect", r.adminHandler(r.adminDisconnect))
+	return mux
+}
+
+// json handler of the admin api
+func (r *Router) adminHandler(handle func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		result, err := handle(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			result = AdminError{Error: err.Error()}
+		}
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logger.Printf("admin api response failed: %s", err)
+		}
+	}
+}
+
+// routings in the route table, sorted by network
+func (r *Router) routeInfos(req *http.Request) (any, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	all, err := r.allEntries()
+	if err != nil {
+		return nil, err
+	}
+	pathInfos := func(paths []routingEntry) []PathInfo {
+		infos := []PathInfo{}
+		for i := range paths {
+			infos = append(infos, r.pathInfo(&paths[i]))
+		}
+		return infos
+	}
+	now := time.Now()
+	routes := []RouteInfo{}
+	installed := map[string]bool{}
+	for _, entry := range all {
+		installed[entry.network.String()] = true
+		routes = append(routes, RouteInfo{
+			Network:     entry.network.String(),
+			PathInfo:    r.pathInfo(entry),
+			Origin:      entry.origin,
+			Name:        entry.name,
+			Seqno:       entry.seqno,
+			Anycast:     entry.anycast,
+			Provisional: entry.provisional,
+			Paths:       pathInfos(entry.paths),
+			Backups:     pathInfos(entry.backups),
+			Updated:     entry.updatedAt,
+			Flap:        flapInfo(r.networkFlaps, entry.network.String(), now),
+		})
+	}
+	// suppressed networks are not in the route table
+	for network, state := range r.networkFlaps {
+		if !installed[network] && state.suppressed {
+			routes = append(routes, RouteInfo{
+				Network: network,
+				Flap:    flapInfo(r.networkFlaps, network, now),
+			})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Network < routes[j].Network
+	})
+	return routes, nil
+}
+
+// must be called with the lock held
+func (r *Router) pathInfo(entry *routingEntry) PathInfo {
+	return PathInfo{
+		Port:   entry.port.String(),
+		Metric: entry.metric,
+		Rtt:    entry.rtt,
+		Cost:   r.cost.cost(entry),
+	}
+}
+
+// connected ports, sorted by endpoint
+func (r *Router) portInfos(req *http.Request) (any, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entries, err := r.allEntries()
+	if err != nil {
+		return nil, err
+	}
+	// routings selected through each port
+	routings := map[*Port]int{}
+	for _, entry := range entries {
+		routings[entry.port] += 1
+	}
+	ports := []PortInfo{}
+	for p := range r.portStats {
+		ports = append(ports, PortInfo{
+			Port:     p.String(),
+			Endpoint: p.w.Endpoint(),
+			PeerID:   p.PeerID(),
+			PktIn:    p.PacketsIn(),
+			PktOut:   p.PacketsOut(),
+			Rtt:      p.Rtt(),
+			Jitter:   p.Jitter(),
+			Loss:     p.Loss(),
+			Routings: routings[p],
+			Dropped:  p.Dropped(),
+			Shaped:   p.Shaped(),
+			Policed:  p.Policed(),
+			Flap:     flapInfo(r.endpointFlaps, p.w.Endpoint(), time.Now()),
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Port < ports[j].Port
+	})
+	return ports, nil
+}
+
+// flap state of the key, nil if there is no penalty. must be called with the lock held
+func flapInfo(states map[string]*flapState, key string, now time.Time) *FlapInfo {
+	state, ok := states[key]
+	if !ok {
+		return nil
+	}
+	state.decay(now)
+	return &FlapInfo{
+		Penalty:    state.penalty,
+		Flaps:      state.flaps,
+		Suppressed: state.suppressed,
+		Reuse:      state.reuseAt(),
+	}
+}
+
+func (r *Router) endpointInfos(req *http.Request) (any, error) {
+	return r.Endpoints(), nil
+}
+
+// fake ip mappings, sorted by fake ip
+func (r *Router) fakeIPMappings(req *http.Request) (any, error) {
+	if r.fakeIP == nil {
+		return nil, errors.Errorf("fakeip is not enabled")
+	}
+	mappings := r.fakeIP.Mappings()
+	sort.Slice(mappings, func(i, j int) bool {
+		return string(mappings[i].Fake.To16()) < string(mappings[j].Fake.To16())
+	})
+	return mappings, nil
+}
+
+// dial the endpoint, the connection is made in background
+func (r *Router) adminDial(req *http.Request) (any, error) {
+	endpoint, err := decodeEndpoint(req)
+	if err != nil {
+		return nil, err
+	}
+	r.Dial(endpoint)
+	return EndpointRequest{Endpoint: endpoint}, nil
+}
+
+func (r *Router) adminDisconnect(req *http.Request) (any, error) {
+	endpoint, err := decodeEndpoint(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Disconnect(endpoint); err != nil {
+		return nil, err
+	}
+	return EndpointRequest{Endpoint: endpoint}, nil
+}
+
+func decodeEndpoint(req *http.Request) (string, error) {
+	body := EndpointRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "invalid request")
+	}
+	if body.Endpoint == "" {
+		return "", errors.Errorf("endpoint is required")
+	}
+	return body.Endpoint, nil
+}
+
+// close ports connected to the endpoint, returns the number of closed ports
+func (r *Router) closePorts(endpoint string) int {
+	r.lock.Lock()
+	ports := []*Port{}
+	for p := range r.portStats {
+		if p.w.Endpoint() == endpoint {
+			ports = append(ports, p)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, p := range ports {
+		p.Close()
+	}
+	return len(ports)
+}
+
+// admin api client over the unix socket
+type AdminClient struct {
+	client *http.Client
+}
+
+func NewAdminClient(path string) *AdminClient {
+	return &AdminClient{
+		client: &http.Client{
+			Timeout: adminTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c *AdminClient) Routes() ([]RouteInfo, error) {
+	routes := []RouteInfo{}
+	return routes, c.call(http.MethodGet, "/routes", nil, &routes)
+}
+
+func (c *AdminClient) Ports() ([]PortInfo, error) {
+	ports := []PortInfo{}
+	return ports, c.call(http.MethodGet, "/ports", nil, &ports)
+}
+
+func (c *AdminClient) Endpoints() ([]EndpointInfo, error) {
+	endpoints := []EndpointInfo{}
+	return endpoints, c.call(http.MethodGet, "/endpoints", nil, &endpoints)
+}
+
+func (c *AdminClient) FakeIP() ([]fakeip.Mapping, error) {
+	mappings := []fakeip.Mapping{}
+	return mappings, c.call(http.MethodGet, "/fakeip", nil, &mappings)
+}
+
+func (c *AdminClient) Dial(endpoint string) error {
+	return c.call(http.MethodPost, "/dial", EndpointRequest{Endpoint: endpoint}, nil)
+}
+
+func (c *AdminClient) Disconnect(endpoint string) error {
+	return c.call(http.MethodPost, "/disconnect", EndpointRequest{Endpoint: endpoint}, nil)
+}
+
+func (c *AdminClient) call(method, path string, body any, result any) error {
+	payload := &bytes.Buffer{}
+	if body != nil {
+		if err := json.NewEncoder(payload).Encode(body); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	req, err := http.NewRequest(method, "http://goose"+path, payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		adminErr := AdminError{}
+		if err := json.NewDecoder(resp.Body).Decode(&adminErr); err != nil || adminErr.Error == "" {
+			return errors.Errorf("admin api %s %s: %s", method, path, resp.Status)
+		}
+		return errors.New(adminErr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package routing
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listen on the admin socket, only the owner can connect. the umask is set while binding,
+// so the socket is never accessible by others
+func listenAdmin(path string) (net.Listener, error) {
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+	listener, err := net.Listen("unix", path)
+	return listener, errors.WithStack(err)
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// test the admin socket is only accessible by the owner, and the client talks to it
+func TestAdminSocket(t *testing.T) {
+	r, _ := newTestAdminRouter(t)
+	path := filepath.Join(t.TempDir(), "goose.sock")
+	done := make(chan error)
+	go func() {
+		done <- r.serveAdmin(path)
+	}()
+	defer func() {
+		r.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	var info os.FileInfo
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 10) {
+		var err error
+		if info, err = os.Stat(path); err == nil {
+			break
+		}
+	}
+	if info == nil {
+		t.Fatal("admin socket not created")
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("admin socket mode %s", info.Mode())
+	}
+
+	client := NewAdminClient(path)
+	routes, err := client.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("routes %+v", routes)
+	}
+	ports, err := client.Ports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 || ports[0].Endpoint != "ipfs/peer" {
+		t.Fatalf("ports %+v", ports)
+	}
+	if err := client.Dial("ipfs/other"); err != nil {
+		t.Fatal(err)
+	}
+	// errors of the api are returned by the client
+	if err := client.Disconnect("ipfs/unknown"); err == nil || err.Error() != "endpoint ipfs/unknown not found" {
+		t.Fatalf("disconnect error %v", err)
+	}
+}
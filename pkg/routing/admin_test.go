@@ -0,0 +1,93 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// router with a connector, a port and a routing through it
+func newTestAdminRouter(t *testing.T) (*Router, *BaseConnector) {
+	r := newTestRouter(t)
+	connector, err := NewBaseConnector(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Connector = connector
+	p := r.addTestPort("ipfs/peer")
+	p.pktIn = 5
+	origin := newTestOrigin(t)
+	r.testUpdate(t, p, origin.announce(t, "10.1.0.0/16", 1, 3), origin.announce(t, "10.2.0.0/16", 1, 3))
+	return r, connector.(*BaseConnector)
+}
+
+// test the admin handlers list routes and ports, dial endpoints and reject invalid requests
+func TestAdminHandlers(t *testing.T) {
+	r, connector := newTestAdminRouter(t)
+	server := httptest.NewServer(r.adminMux())
+	defer server.Close()
+
+	get := func(path string, result any) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: %s", path, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routes := []RouteInfo{}
+	get("/routes", &routes)
+	if len(routes) != 2 || routes[0].Network != "10.1.0.0/16" || routes[0].Metric != 2 || routes[0].Seqno != 3 || routes[1].Network != "10.2.0.0/16" {
+		t.Fatalf("routes %+v", routes)
+	}
+	ports := []PortInfo{}
+	get("/ports", &ports)
+	if len(ports) != 1 || ports[0].Endpoint != "ipfs/peer" || ports[0].PeerID != "peer" || ports[0].Routings != 2 || ports[0].PktIn != 5 {
+		t.Fatalf("ports %+v", ports)
+	}
+
+	post := func(path, body string) (int, map[string]string) {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		result := map[string]string{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, result
+	}
+	if status, result := post("/dial", `{"endpoint": "ipfs/other"}`); status != http.StatusOK || result["endpoint"] != "ipfs/other" {
+		t.Fatalf("dial %d %v", status, result)
+	}
+	if endpoint := <-connector.requests; endpoint != "ipfs/other" {
+		t.Fatalf("dialed %s", endpoint)
+	}
+	for _, body := range []string{`{"endpoint": `, `{}`, `[1]`} {
+		if status, result := post("/dial", body); status != http.StatusBadRequest || result["error"] == "" {
+			t.Fatalf("dial %s: %d %v", body, status, result)
+		}
+	}
+	if len(connector.requests) != 0 {
+		t.Fatal("invalid request dialed")
+	}
+	if status, result := post("/disconnect", `{"endpoint": "ipfs/unknown"}`); status != http.StatusBadRequest || !strings.Contains(result["error"], "not found") {
+		t.Fatalf("disconnect %d %v", status, result)
+	}
+	resp, err := http.Get(server.URL + "/dial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("get dial %s", resp.Status)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package routing
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// listen on the admin socket, it's protected by the acl of its folder
+func listenAdmin(path string) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	return listener, errors.WithStack(err)
+}
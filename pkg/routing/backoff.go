@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// failed endpoints due for a retry are checked in this interval
+	retryCheckInterval = time.Second
+
+	// dial failure reasons
+	failureNoAddresses  = "no addresses"
+	failureLimitedRelay = "limited relay"
+	failureProtocol     = "protocol not supported"
+	failureVersion      = "version not supported"
+	failureInvalid      = "invalid endpoint"
+	failureTimeout      = "timeout"
+	failureRefused      = "refused"
+	failureDisconnected = "disconnected"
+	failureOther        = "other"
+
+	// error of limited relay connections, see the ipfs wire
+	transientErrorString = "limited connection"
+)
+
+var (
+	// error patterns of the failure reasons, checked in order
+	failurePatterns = []struct {
+		reason   string
+		patterns []string
+	}{
+		{failureInvalid, []string{"failed to parse peer ID", "selected encoding not supported", "invalid cid", "multihash"}},
+		{failureVersion, []string{"codec version"}},
+		{failureProtocol, []string{"protocols not supported", "protocol not supported", ") not supported"}},
+		{failureNoAddresses, []string{"no addresses", "failed to find any peer in table", "routing: not found"}},
+		{failureLimitedRelay, []string{transientErrorString, "unlimited relay"}},
+		{failureTimeout, []string{"deadline exceeded", "timeout", "timed out"}},
+		{failureRefused, []string{"connection refused", "reset by peer", "no route to host"}},
+	}
+
+	// endpoints failed for these reasons are not retried
+	permanentFailures = map[string]bool{
+		failureInvalid:  true,
+		failureVersion:  true,
+		failureProtocol: true,
+	}
+)
+
+// failure reason of the dial error. nil errors are disconnections of connected endpoints
+func classifyFailure(err error) string {
+	if err == nil {
+		return failureDisconnected
+	}
+	msg := err.Error()
+	for _, class := range failurePatterns {
+		for _, pattern := range class.patterns {
+			if strings.Contains(msg, pattern) {
+				return class.reason
+			}
+		}
+	}
+	return failureOther
+}
+
+// delay before the next retry of an endpoint failed the times. it doubles with each failure up to the max,
+// then a random half is cut off, so endpoints failed together are not retried together
+func (t Timers) retryBackoff(failed int) time.Duration {
+	delay := t.RetryInterval
+	for i := 1; i < failed && delay < t.RetryMaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, t.RetryMaxBackoff)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,104 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// test the retry delay doubles up to the max backoff, and the jitter spreads it over its upper half
+func TestRetryBackoff(t *testing.T) {
+	timers := DefaultTimers
+	for _, c := range []struct {
+		failed int
+		delay  time.Duration
+	}{
+		{1, timers.RetryInterval},
+		{2, timers.RetryInterval * 2},
+		{3, timers.RetryInterval * 4},
+		{6, timers.RetryInterval * 32},
+		{7, timers.RetryMaxBackoff},
+		{100, timers.RetryMaxBackoff},
+	} {
+		delays := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			delay := timers.retryBackoff(c.failed)
+			if delay < c.delay/2 || delay > c.delay {
+				t.Fatalf("failed %d times, delay %s not in [%s, %s]", c.failed, delay, c.delay/2, c.delay)
+			}
+			delays[delay] = true
+		}
+		// endpoints failed together are not retried together
+		if len(delays) < 50 {
+			t.Fatalf("failed %d times, only %d distinct delays", c.failed, len(delays))
+		}
+	}
+}
+
+// test dial errors are classified by their messages, and only invalid endpoints are permanent failures
+func TestClassifyFailure(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		reason    string
+		permanent bool
+	}{
+		{nil, failureDisconnected, false},
+		{errors.New("failed to parse peer ID: invalid cid"), failureInvalid, true},
+		{errors.New("codec version 1 is not supported"), failureVersion, true},
+		{errors.New("failed to negotiate protocol: protocols not supported: [/goose/0.1.0]"), failureProtocol, true},
+		{errors.New("failed to dial: no addresses"), failureNoAddresses, false},
+		{errors.New("open stream: limited connection"), failureLimitedRelay, false},
+		{errors.New("context deadline exceeded"), failureTimeout, false},
+		{errors.New("dial tcp 10.0.0.1:4001: connect: connection refused"), failureRefused, false},
+		{errors.New("something else"), failureOther, false},
+	} {
+		reason := classifyFailure(c.err)
+		if reason != c.reason || permanentFailures[reason] != c.permanent {
+			t.Fatalf("error %v classified %s, want %s", c.err, reason, c.reason)
+		}
+	}
+}
+
+// test failed endpoints are scheduled for a retry, except permanent failures, and removed after the max retries
+func TestSetFailed(t *testing.T) {
+	r := newTestRouter(t)
+	r.timers.MaxRetries = 3
+	connector, err := NewBaseConnector(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connector.(*BaseConnector)
+	fail := func(endpoint string, err error) epState {
+		if err := c.setConnecting(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.setFailed(endpoint, err); err != nil {
+			t.Fatal(err)
+		}
+		return c.epStats[endpoint]
+	}
+
+	now := time.Now()
+	state := fail("ipfs/timeout", errors.New("context deadline exceeded"))
+	if state.reason != failureTimeout || state.nextRetry.Before(now.Add(r.timers.RetryInterval/2)) {
+		t.Fatalf("first failure %+v", state)
+	}
+	state = fail("ipfs/timeout", errors.New("context deadline exceeded"))
+	if state.failed != 2 || state.nextRetry.Before(now.Add(r.timers.RetryInterval)) {
+		t.Fatalf("second failure %+v", state)
+	}
+	fail("ipfs/timeout", errors.New("context deadline exceeded"))
+	if _, ok := c.epStats["ipfs/timeout"]; ok {
+		t.Fatal("endpoint kept after the max retries")
+	}
+
+	state = fail("ipfs/invalid", errors.New("failed to parse peer ID"))
+	if !state.nextRetry.IsZero() {
+		t.Fatalf("permanent failure scheduled for a retry %+v", state)
+	}
+	endpoints := c.Endpoints()
+	if len(endpoints) != 1 || !endpoints[0].Permanent || endpoints[0].Reason != failureInvalid {
+		t.Fatalf("endpoints %+v", endpoints)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
 	"github.com/nickjfree/goose/pkg/wire"
 	"github.com/pkg/errors"
 )
@@ -24,8 +27,8 @@ const (
 	dialConcurrency = 8
 	// port send buffer size
 	portBufferSize = 2048
-	// max retries
-	connMaxRetries = 32
+	// port triggered routing update buffer size
+	portUpdateBuffer = 16
 
 	// wire status
 	statusUnknown    = 0
@@ -36,13 +39,32 @@ const (
 	// rtt stats
 	rttAlphaMean     = 0.15
 	rttAlphaVariance = 0.15
+	rttAlphaLoss     = 0.15
 )
 
 // Connector interface
 type Connector interface {
+	// connect to the endpoint
 	Dial(string)
+	// close the endpoint's connection, it's not reconnected
+	Disconnect(string) error
+	// known endpoints and their states
+	Endpoints() []EndpointInfo
 }
 
+var (
+	// wire status names
+	statusNames = map[int]string{
+		statusUnknown:    "unknown",
+		statusConnected:  "connected",
+		statusConnecting: "connecting",
+		statusFailed:     "failed",
+	}
+
+	// last port id
+	lastPortID atomic.Uint64
+)
+
 // endpoint state
 type epState struct {
 	// wire
@@ -51,6 +73,11 @@ type epState struct {
 	status int
 	// failed times
 	failed int
+	// reason and error of the last failure
+	reason    string
+	lastError string
+	// time of the next retry
+	nextRetry time.Time
 }
 
 // wire connector
@@ -65,14 +92,19 @@ type BaseConnector struct {
 	router *Router
 }
 
-// rtt stats of port
+// rtt stats of port, written by the port's traffic and read by the admin api and metrics
 type rttStats struct {
+	lock sync.Mutex
 	// start
 	start time.Time
+	// waiting for an ack
+	pending bool
 	// mean rtt in ms
 	mean float32
 	// variance
 	variance float32
+	// ratio of lost acks
+	loss float32
 }
 
 // port is a connect session with a node
@@ -84,9 +116,11 @@ type Port struct {
 	// router
 	router *Router
 	// output queue
-	output chan message.Packet
+	queue *scheduler
 	// routing
 	announce chan message.Routing
+	// triggered routing updates
+	updates chan message.Routing
 	// close func
 	closeFunc func() error
 	// close
@@ -97,6 +131,27 @@ type Port struct {
 	pktIn int64
 	// packet out
 	pktOut int64
+	// bytes in
+	bytesIn int64
+	// bytes out
+	bytesOut int64
+	// packets delayed by rate shaping, by direction
+	shaped [2]int64
+	// packets dropped by rate policing, or delayed too long by rate shaping, by direction
+	policed [2]int64
+	// rate limiters shared by the ports of the peer, nil if not limited
+	limiter atomic.Pointer[portLimiter]
+	// shaped packets received from the peer, created with its goroutine on first use
+	shapeQueue chan shapedPacket
+	shapeOnce  sync.Once
+	// priority traffic received from the peer
+	priority *utils.TokenBucket
+	// hash of the endpoint, to select paths for flows
+	hash uint64
+	// unique id, ports of the same endpoint are told apart by it
+	id uint64
+	// closed when the output is stopped and the wire is closed
+	done chan struct{}
 }
 
 func NewBaseConnector(r *Router) (Connector, error) {
@@ -105,7 +160,6 @@ func NewBaseConnector(r *Router) (Connector, error) {
 		requests: make(chan string, dialConcurrency),
 		router:   r,
 	}
-	go c.start()
 	return c, nil
 }
 
@@ -114,9 +168,47 @@ func (c *BaseConnector) Dial(endpoint string) {
 	c.requests <- endpoint
 }
 
+// disconnect the endpoint and forget it, so it's not retried
+func (c *BaseConnector) Disconnect(endpoint string) error {
+	c.lock.Lock()
+	_, ok := c.epStats[endpoint]
+	delete(c.epStats, endpoint)
+	c.lock.Unlock()
+
+	closed := c.router.closePorts(endpoint)
+	if !ok && closed == 0 {
+		return errors.Errorf("endpoint %s not found", endpoint)
+	}
+	logger.Printf("endpoint %s disconnected, %d ports closed", endpoint, closed)
+	return nil
+}
+
+// known endpoints, sorted by endpoint
+func (c *BaseConnector) Endpoints() []EndpointInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	endpoints := []EndpointInfo{}
+	for endpoint, state := range c.epStats {
+		endpoints = append(endpoints, EndpointInfo{
+			Endpoint:  endpoint,
+			Status:    statusNames[state.status],
+			Failed:    state.failed,
+			Reason:    state.reason,
+			Error:     state.lastError,
+			Permanent: permanentFailures[state.reason],
+			NextRetry: state.nextRetry,
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Endpoint < endpoints[j].Endpoint
+	})
+	return endpoints
+}
+
 func (c *BaseConnector) remove(endpoint string, reconnect bool) {
 	if reconnect {
-		c.setFailed(endpoint)
+		c.setFailed(endpoint, nil)
 	} else {
 		c.setUnknow(endpoint)
 	}
@@ -132,6 +224,7 @@ func (c *BaseConnector) setConnected(endpoint string, w wire.Wire) error {
 		state.status = statusConnected
 		state.wire = w
 		state.failed = 0
+		state.reason, state.lastError = "", ""
 		c.epStats[endpoint] = state
 		return nil
 	}
@@ -147,17 +240,29 @@ func (c *BaseConnector) setConnected(endpoint string, w wire.Wire) error {
 	return errors.Errorf("invalid endpoint status %s %+v", endpoint, state)
 }
 
-// mark endpint as failed
-func (c *BaseConnector) setFailed(endpoint string) error {
+// mark endpint as failed, err is the dial error or nil if the connection is closed.
+// the endpoint is retried with backoff unless the failure is permanent
+func (c *BaseConnector) setFailed(endpoint string, err error) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	state, ok := c.epStats[endpoint]
-	if ok && state.status == statusConnecting || state.status == statusConnected {
+	if ok && (state.status == statusConnecting || state.status == statusConnected) {
 		state.status = statusFailed
 		state.failed += 1
+		state.reason = classifyFailure(err)
+		state.lastError = ""
+		if err != nil {
+			state.lastError = err.Error()
+		}
+		state.nextRetry = time.Now().Add(c.router.timers.retryBackoff(state.failed))
+		if permanentFailures[state.reason] {
+			// kept for troubleshooting, never retried
+			state.nextRetry = time.Time{}
+			logger.Printf("endpoint %s failed permanently: %s", endpoint, state.reason)
+		}
 		// remove endpoint failed too many times
-		if state.failed >= connMaxRetries {
+		if state.failed >= c.router.timers.MaxRetries {
 			logger.Printf("endpoint %s failed too many times, remove it", endpoint)
 			delete(c.epStats, endpoint)
 		} else {
@@ -216,15 +321,21 @@ func (c *BaseConnector) newPort(w wire.Wire, reconnect bool) *Port {
 	p := &Port{
 		w:         w,
 		router:    c.router,
-		output:    make(chan message.Packet, portBufferSize),
+		queue:     newScheduler(portBufferSize),
 		announce:  make(chan message.Routing),
+		updates:   make(chan message.Routing, portUpdateBuffer),
 		closeFunc: closeFunc,
 		ctx:       ctx,
 		rttStats: rttStats{
 			start: time.Now(),
 		},
+		priority: utils.NewTokenBucket(peerPriorityRate, peerPriorityBurst),
+		hash:     utils.StringHash(w.Endpoint()),
+		id:       lastPortID.Add(1),
+		done:     make(chan struct{}),
 	}
 	go func() {
+		defer close(p.done)
 		logger.Printf("handle port(%s) output: %s", p, p.handleOutput())
 	}()
 	return p
@@ -246,30 +357,37 @@ func (c *BaseConnector) start() error {
 					}
 					if err := c.connect(endpoint); err != nil {
 						logger.Printf("connection failed %s", err)
-						c.setFailed(endpoint)
+						dials.WithLabelValues(dialFailed).Inc()
+						c.setFailed(endpoint, err)
+						continue
 					}
+					dials.WithLabelValues(dialSucceeded).Inc()
 				case <-c.router.Done():
 					return
 				}
 			}
 		}()
 	}
-	// handle failed connection
-	ticker := time.NewTicker(time.Second * 15)
+	// retry failed connections when their backoff is over
+	ticker := time.NewTicker(retryCheckInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
+		case now := <-ticker.C:
 			requests := []string{}
 			// find connection to retry
 			c.lock.Lock()
 			for endpoint, state := range c.epStats {
-				if state.status == statusFailed && state.failed < connMaxRetries {
+				if state.status == statusFailed && !state.nextRetry.IsZero() && now.After(state.nextRetry) {
 					requests = append(requests, endpoint)
+					// not picked again while it's waiting for a dialer
+					state.nextRetry = now.Add(c.router.timers.RetryMaxBackoff)
+					c.epStats[endpoint] = state
 				}
 			}
 			c.lock.Unlock()
 			for i := range requests {
+				dials.WithLabelValues(dialRetried).Inc()
 				c.requests <- requests[i]
 			}
 		case <-c.router.Done():
@@ -337,7 +455,8 @@ func (p *Port) ReadPacket(packet *message.Packet) error {
 		case message.MessageTypePacket:
 			if pkt, ok := msg.Payload.(message.Packet); ok {
 				*packet = pkt
-				p.pktIn = p.pktIn + 1
+				atomic.AddInt64(&p.pktIn, 1)
+				atomic.AddInt64(&p.bytesIn, int64(len(pkt.Data)))
 				return nil
 			} else {
 				return errors.Errorf("invalid packet %+v", msg)
@@ -353,21 +472,40 @@ func (p *Port) ReadPacket(packet *message.Packet) error {
 	}
 }
 
-// send packet to target wire
-func (p *Port) WritePacket(packet *message.Packet) error {
-	select {
-	case p.output <- *packet:
-	default:
-		// throttle
-		timer := time.NewTimer(time.Second * 30)
-		defer timer.Stop()
-		select {
-		case p.output <- *packet:
-		case <-timer.C:
-			return errors.Errorf("port(%s) dead", p.w.Endpoint())
+// send packet to target wire, from is the input port of the packet. input ports share the output fairly.
+// it never blocks, a busy port drops packets by its queue management. packets to a closed port are dropped
+func (p *Port) WritePacket(packet *message.Packet, from *Port) {
+	if p.IsClosed() {
+		return
+	}
+	// rate limits of the input peer, shaped packets wait in the input's shape queue
+	if from != nil {
+		delay, ok := from.limitInput(packet)
+		if !ok {
+			return
+		}
+		if delay > 0 {
+			from.delayInput(p, packet, delay)
+			return
 		}
 	}
-	return nil
+	p.writeOutput(packet, from)
+}
+
+// queue the packet within the rate limits of the output peer
+func (p *Port) writeOutput(packet *message.Packet, from *Port) {
+	if !p.policeOutput(packet) {
+		return
+	}
+	p.queue.enqueue(*packet, from, trafficClass(packet.Data, from))
+}
+
+// queue a packet generated by the router, it goes before the forwarded packets
+func (p *Port) writeControl(packet *message.Packet) {
+	if p.IsClosed() {
+		return
+	}
+	p.queue.enqueue(*packet, nil, classControl)
 }
 
 // send routing info to peers
@@ -382,6 +520,16 @@ func (p *Port) AnnouceRouting(routings *message.Routing) error {
 	return nil
 }
 
+// queue a triggered routing update, dropped if the port is busy. periodic updates will catch up
+func (p *Port) TriggerRouting(routing *message.Routing) bool {
+	select {
+	case p.updates <- *routing:
+		return true
+	default:
+		return false
+	}
+}
+
 // close port
 func (p *Port) Close() error {
 	var err error
@@ -410,32 +558,93 @@ func (p *Port) PeerID() string {
 	return ""
 }
 
+// key of the port's peer, ports of the same peer share it. ports of other wires are keyed by the endpoint
+func (p *Port) peerKey() string {
+	if peer := p.PeerID(); peer != "" {
+		return peer
+	}
+	return p.w.Endpoint()
+}
+
+// true if the port is closed, its routings may not be cleared yet
+func (p *Port) IsClosed() bool {
+	return p.ctx.Err() != nil
+}
+
 func (p *Port) IsTunnel() bool {
 	return strings.HasPrefix(p.String(), "tun")
 }
 
+// tunnel and wireguard ports, their networks are originated by this router
+func (p *Port) IsLocal() bool {
+	return p.IsTunnel() || strings.HasPrefix(p.String(), "wireguard")
+}
+
 func (p *Port) BeginRttTiming() {
+	p.rttStats.lock.Lock()
+	defer p.rttStats.lock.Unlock()
+	// the last ack is lost
+	if p.rttStats.pending {
+		p.rttStats.loss = p.rttStats.loss*(1-rttAlphaLoss) + rttAlphaLoss
+	}
 	p.rttStats.start = time.Now()
+	p.rttStats.pending = true
 }
 
 func (p *Port) EndRttTiming() {
+	p.rttStats.lock.Lock()
+	defer p.rttStats.lock.Unlock()
+	// acks of triggered updates are not timed
+	if !p.rttStats.pending {
+		return
+	}
+	p.rttStats.pending = false
 	rtt := float32(time.Now().Sub(p.rttStats.start).Milliseconds())
 	rttVariance := (rtt - p.rttStats.mean) * (rtt - p.rttStats.mean)
 	p.rttStats.mean = p.rttStats.mean*(1-rttAlphaMean) + rtt*rttAlphaMean
-	p.rttStats.variance = rttVariance*(1-rttAlphaVariance) + rttVariance*rttAlphaVariance
+	p.rttStats.variance = p.rttStats.variance*(1-rttAlphaVariance) + rttVariance*rttAlphaVariance
+	p.rttStats.loss = p.rttStats.loss * (1 - rttAlphaLoss)
 }
 
-// return true, if port has smaller rtt. law of large number
-func (p *Port) Faster(base int) bool {
-	delta := float32(base) - p.rttStats.mean
-	if delta > 0 && delta*delta > 9*p.rttStats.variance {
-		return true
-	}
-	return false
+// mean rtt and its variance in ms
+func (p *Port) rtt() (float32, float32) {
+	p.rttStats.lock.Lock()
+	defer p.rttStats.lock.Unlock()
+	return p.rttStats.mean, p.rttStats.variance
+}
+
+// rtt deviation in ms
+func (p *Port) Jitter() float64 {
+	_, variance := p.rtt()
+	return deviation(variance)
+}
+
+// ratio of lost acks
+func (p *Port) Loss() float64 {
+	p.rttStats.lock.Lock()
+	defer p.rttStats.lock.Unlock()
+	return float64(p.rttStats.loss)
 }
 
 func (p *Port) Rtt() int {
-	return int(p.rttStats.mean)
+	mean, _ := p.rtt()
+	return int(mean)
+}
+
+// packets received from the port
+func (p *Port) PacketsIn() int64 {
+	return atomic.LoadInt64(&p.pktIn)
+}
+
+// packets sent to the port
+func (p *Port) PacketsOut() int64 {
+	return atomic.LoadInt64(&p.pktOut)
+}
+
+// packets dropped by the output queue of the port
+func (p *Port) Dropped() int64 {
+	overflow, expired := p.queue.drops()
+	return overflow + expired
 }
 
 // close port
@@ -443,26 +652,55 @@ func (p *Port) handleOutput() error {
 	// close wire when done
 	defer p.w.Close()
 	for {
+		if p.ctx.Err() != nil {
+			return errors.Errorf("port(%s) closed", p.w.Endpoint())
+		}
+		// routing messages never wait behind packets
 		select {
-		case packet := <-p.output:
+		case routings := <-p.announce:
+			if err := p.sendRouting(routings); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+		if packet, ok := p.queue.dequeue(); ok {
+			if err := p.shapeOutput(&packet); err != nil {
+				return err
+			}
 			msg := message.Message{
 				Type:    message.MessageTypePacket,
 				Payload: packet,
 			}
 			if err := p.w.Encode(&msg); err != nil {
-				return err
+				tooBig := &wire.PacketTooBigError{}
+				if !errors.As(err, &tooBig) {
+					return err
+				}
+				// the wire can't carry the packet, tell the source to send smaller ones
+				p.router.sendPacketTooBig(&packet, tooBig.MTU)
+				continue
 			}
-			p.pktOut = p.pktOut + 1
+			atomic.AddInt64(&p.pktOut, 1)
+			atomic.AddInt64(&p.bytesOut, int64(len(packet.Data)))
+			continue
+		}
+		select {
 		case routings := <-p.announce:
-			msg := message.Message{
-				Type:    message.MessageTypeRouting,
-				Payload: routings,
-			}
-			if err := p.w.Encode(&msg); err != nil {
+			if err := p.sendRouting(routings); err != nil {
 				return err
 			}
+		case <-p.queue.ready:
 		case <-p.ctx.Done():
 			return errors.Errorf("port(%s) closed", p.w.Endpoint())
 		}
 	}
 }
+
+func (p *Port) sendRouting(routings message.Routing) error {
+	msg := message.Message{
+		Type:    message.MessageTypeRouting,
+		Payload: routings,
+	}
+	return p.w.Encode(&msg)
+}
@@ -0,0 +1,89 @@
+package routing
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// default cost weights, a hop costs the same as 20ms of rtt
+	DefaultCostWeights = CostWeights{
+		Hop:        20,
+		Rtt:        1,
+		Jitter:     1,
+		Loss:       500,
+		Hysteresis: 0.1,
+	}
+)
+
+// weights of the route cost, costs are in ms
+type CostWeights struct {
+	// cost per hop
+	Hop float64
+	// cost per ms of the path rtt
+	Rtt float64
+	// cost per ms of the next hop rtt deviation
+	Jitter float64
+	// cost of the next hop losing all acks
+	Loss float64
+	// a route must be cheaper by this ratio to replace the selected one
+	Hysteresis float64
+}
+
+// parse weights like "hop=20,rtt=1,jitter=1,loss=500,hysteresis=0.1", missing weights are defaults
+func ParseCostWeights(s string) (CostWeights, error) {
+	w := DefaultCostWeights
+	if s == "" {
+		return w, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return w, errors.Errorf("invalid cost weight %s", kv)
+		}
+		v, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || v < 0 {
+			return w, errors.Errorf("invalid cost weight %s", kv)
+		}
+		switch parts[0] {
+		case "hop":
+			w.Hop = v
+		case "rtt":
+			w.Rtt = v
+		case "jitter":
+			w.Jitter = v
+		case "loss":
+			w.Loss = v
+		case "hysteresis":
+			if v >= 1 {
+				return w, errors.Errorf("hysteresis must be less than 1, got %f", v)
+			}
+			w.Hysteresis = v
+		default:
+			return w, errors.Errorf("unknown cost weight %s", parts[0])
+		}
+	}
+	return w, nil
+}
+
+// cost of the routing entry, variance and loss are measured on the next hop
+func (w *CostWeights) cost(entry *routingEntry) float64 {
+	cost := w.Hop*float64(entry.metric) + w.Rtt*float64(entry.rtt)
+	if entry.port != nil {
+		cost += w.Jitter*entry.port.Jitter() + w.Loss*entry.port.Loss()
+	}
+	return cost
+}
+
+// true if the new entry is cheap enough to replace the selected one
+func (w *CostWeights) better(selected, entry *routingEntry) bool {
+	return w.cost(entry) < w.cost(selected)*(1-w.Hysteresis)
+}
+
+// rtt deviation in ms
+func deviation(variance float32) float64 {
+	return math.Sqrt(float64(variance))
+}
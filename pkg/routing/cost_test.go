@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+// test cost weights parsing, missing weights are defaults
+func TestParseCostWeights(t *testing.T) {
+	for _, c := range []struct {
+		s       string
+		weights CostWeights
+		ok      bool
+	}{
+		{"", DefaultCostWeights, true},
+		{"hop=10", CostWeights{Hop: 10, Rtt: 1, Jitter: 1, Loss: 500, Hysteresis: 0.1}, true},
+		{"hop=1, rtt=2,jitter=3,loss=4,hysteresis=0.5", CostWeights{Hop: 1, Rtt: 2, Jitter: 3, Loss: 4, Hysteresis: 0.5}, true},
+		{"hop", CostWeights{}, false},
+		{"hop=-1", CostWeights{}, false},
+		{"hop=fast", CostWeights{}, false},
+		{"hysteresis=1", CostWeights{}, false},
+		{"bandwidth=1", CostWeights{}, false},
+	} {
+		weights, err := ParseCostWeights(c.s)
+		if (err == nil) != c.ok || (c.ok && weights != c.weights) {
+			t.Fatalf("parse %q got %+v %v, want %+v ok %v", c.s, weights, err, c.weights, c.ok)
+		}
+	}
+}
+
+// test the cost weighs hops and path rtt, and the jitter and loss of the next hop
+func TestCost(t *testing.T) {
+	w := DefaultCostWeights
+	p := newTestPort("ipfs/peer")
+	entry := &routingEntry{metric: 3, rtt: 40, port: p}
+	if cost := w.cost(entry); cost != 100 {
+		t.Fatalf("cost %f, want 100", cost)
+	}
+	// 5ms deviation and a quarter of acks lost
+	p.rttStats.variance = 25
+	p.rttStats.loss = 0.25
+	if cost := w.cost(entry); cost != 230 {
+		t.Fatalf("cost with jitter and loss %f, want 230", cost)
+	}
+}
+
+// test a route replaces the selected one only if it's cheaper by the hysteresis, and the selected port's updates are always taken
+func TestCostHysteresis(t *testing.T) {
+	w := DefaultCostWeights
+	selected := &routingEntry{metric: 0, rtt: 100}
+	for _, c := range []struct {
+		rtt    int
+		better bool
+	}{
+		{100, false},
+		{95, false},
+		{90, false},
+		{89, true},
+		{10, true},
+	} {
+		if better := w.better(selected, &routingEntry{rtt: c.rtt}); better != c.better {
+			t.Fatalf("rtt %d better than 100: %v, want %v", c.rtt, better, c.better)
+		}
+	}
+
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	a := r.addTestPort("ipfs/a")
+	b := r.addTestPort("ipfs/b")
+	cidr := "10.1.0.0/16"
+	announce := func(rtt int) message.RoutingEntry {
+		entry := origin.announce(t, cidr, 2, 1)
+		entry.Rtt = rtt
+		return entry
+	}
+	steps := []struct {
+		name string
+		port *Port
+		rtt  int
+		want *Port
+	}{
+		// cost 160
+		{"first route", a, 100, a},
+		// cost 150, within the hysteresis
+		{"slightly cheaper", b, 90, a},
+		// cost 140, cheaper by more than 10%
+		{"cheaper", b, 80, b},
+		// cost 360, the selected port's update is taken
+		{"selected gets worse", b, 300, b},
+		// cost 160, cheaper than the worse selected route
+		{"other is cheaper again", a, 100, a},
+	}
+	for _, step := range steps {
+		r.testUpdate(t, step.port, announce(step.rtt))
+		entry := r.testEntry(t, cidr)
+		if entry == nil || entry.port != step.want {
+			t.Fatalf("%s: selected %+v", step.name, entry)
+		}
+	}
+}
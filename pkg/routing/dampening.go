@@ -0,0 +1,131 @@
+package routing
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	// penalty of a flap, a withdrawn network or a closed port
+	flapPenalty = 1000
+	// suppressed when the penalty reaches this
+	flapSuppress = 2000
+	// reused when the penalty decays below this
+	flapReuse = 750
+	// penalty half life
+	flapHalfLife = time.Minute * 5
+	// max time a stable network or port stays suppressed
+	flapMaxSuppress = time.Minute * 20
+)
+
+var (
+	// penalty cap, decays to the reuse threshold in flapMaxSuppress
+	flapMaxPenalty = flapReuse * math.Exp2(flapMaxSuppress.Seconds()/flapHalfLife.Seconds())
+)
+
+// flap penalty of a network or an endpoint, it decays exponentially
+type flapState struct {
+	// penalty at updatedAt
+	penalty float64
+	// suppressed until the penalty decays below the reuse threshold
+	suppressed bool
+	// flaps
+	flaps int
+	// last decayed
+	updatedAt time.Time
+}
+
+func (f *flapState) decay(now time.Time) {
+	f.penalty *= math.Exp2(-now.Sub(f.updatedAt).Seconds() / flapHalfLife.Seconds())
+	f.updatedAt = now
+	if f.suppressed && f.penalty < flapReuse {
+		f.suppressed = false
+	}
+}
+
+func (f *flapState) flap(now time.Time) {
+	f.decay(now)
+	f.penalty = math.Min(f.penalty+flapPenalty, flapMaxPenalty)
+	f.flaps += 1
+	if f.penalty >= flapSuppress {
+		f.suppressed = true
+	}
+}
+
+// time the suppressed state is reused, zero if it's not suppressed
+func (f *flapState) reuseAt() time.Time {
+	if !f.suppressed {
+		return time.Time{}
+	}
+	return f.updatedAt.Add(time.Duration(math.Log2(f.penalty/flapReuse) * float64(flapHalfLife)))
+}
+
+// penalize the network, it's withdrawn. must be called with the lock held
+func (r *Router) flapNetwork(network net.IPNet, now time.Time) {
+	r.flap(r.networkFlaps, network.String(), now)
+}
+
+// penalize the endpoint of the port, it's closed. must be called with the lock held
+func (r *Router) flapPort(p *Port, now time.Time) {
+	if p.IsLocal() {
+		return
+	}
+	r.flap(r.endpointFlaps, p.w.Endpoint(), now)
+}
+
+func (r *Router) flap(states map[string]*flapState, key string, now time.Time) {
+	state, ok := states[key]
+	if !ok {
+		state = &flapState{updatedAt: now}
+		states[key] = state
+	}
+	wasSuppressed := state.suppressed
+	state.flap(now)
+	if state.suppressed && !wasSuppressed {
+		logger.Printf("%s is flapping, suppressed until %s", key, state.reuseAt().Format(time.TimeOnly))
+	}
+}
+
+// true if the routing from the port should not be used. paths through a flapping port are not used,
+// and a flapping network is not installed again until it's stable. must be called with the lock held
+func (r *Router) isDampened(p *Port, network net.IPNet, installed bool, now time.Time) bool {
+	if p.IsLocal() {
+		return false
+	}
+	if r.isSuppressed(r.endpointFlaps, p.w.Endpoint(), now) {
+		return true
+	}
+	return !installed && r.isSuppressed(r.networkFlaps, network.String(), now)
+}
+
+func (r *Router) isSuppressed(states map[string]*flapState, key string, now time.Time) bool {
+	state, ok := states[key]
+	if !ok {
+		return false
+	}
+	state.decay(now)
+	return state.suppressed
+}
+
+// penalty of the network for the route listing, empty if there is none. must be called with the lock held
+func (r *Router) penalty(network net.IPNet) string {
+	state, ok := r.networkFlaps[network.String()]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%.0f", state.penalty)
+}
+
+// forget decayed penalties. must be called with the lock held
+func (r *Router) expireFlaps(now time.Time) {
+	for _, states := range []map[string]*flapState{r.networkFlaps, r.endpointFlaps} {
+		for key, state := range states {
+			state.decay(now)
+			if !state.suppressed && state.penalty < flapReuse/2 {
+				delete(states, key)
+			}
+		}
+	}
+}
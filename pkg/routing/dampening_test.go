@@ -0,0 +1,100 @@
+package routing
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// test the penalty halves every half life, suppression starts at the suppress threshold and ends below the reuse threshold
+func TestFlapDecay(t *testing.T) {
+	now := time.Now()
+	f := &flapState{updatedAt: now}
+	f.flap(now)
+	if f.suppressed || !f.reuseAt().IsZero() {
+		t.Fatalf("suppressed after a flap %+v", f)
+	}
+	f.decay(now.Add(flapHalfLife))
+	if math.Abs(f.penalty-flapPenalty/2) > 1 {
+		t.Fatalf("penalty %.0f after a half life, want %d", f.penalty, flapPenalty/2)
+	}
+	// 500 decays to 250 and flaps twice more to 2250
+	now = now.Add(flapHalfLife * 2)
+	f.flap(now)
+	f.flap(now)
+	if !f.suppressed || f.flaps != 3 {
+		t.Fatalf("not suppressed at penalty %.0f", f.penalty)
+	}
+	// reused when it decays to the reuse threshold, 2250 to 750
+	reuseAt := f.reuseAt()
+	if want := now.Add(time.Duration(math.Log2(3) * float64(flapHalfLife))); reuseAt.Sub(want).Abs() > time.Second {
+		t.Fatalf("reused at %s, want %s", reuseAt, want)
+	}
+	f.decay(reuseAt.Add(-time.Second))
+	if !f.suppressed {
+		t.Fatal("reused before the reuse time")
+	}
+	f.decay(reuseAt.Add(time.Second))
+	if f.suppressed {
+		t.Fatal("still suppressed after the reuse time")
+	}
+}
+
+// test the penalty is capped, a flapping network is reused in the max suppress time once it's stable
+func TestFlapMaxSuppress(t *testing.T) {
+	now := time.Now()
+	f := &flapState{updatedAt: now}
+	for i := 0; i < 100; i++ {
+		f.flap(now)
+	}
+	if f.penalty != flapMaxPenalty {
+		t.Fatalf("penalty %.0f, want the cap %.0f", f.penalty, flapMaxPenalty)
+	}
+	if reuseAt := f.reuseAt(); reuseAt.Sub(now.Add(flapMaxSuppress)).Abs() > time.Second {
+		t.Fatalf("reused in %s, want %s", reuseAt.Sub(now), flapMaxSuppress)
+	}
+}
+
+// test flapping networks are not installed again and flapping ports are not used until stable,
+// local ports are never dampened and decayed penalties are forgotten
+func TestDampening(t *testing.T) {
+	r := newTestRouter(t)
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	p := r.addTestPort("ipfs/peer")
+	local := r.addTestPort("tun/goose")
+	now := time.Now()
+
+	r.flapNetwork(*network, now)
+	r.flapNetwork(*network, now)
+	if !r.isDampened(p, *network, false, now) {
+		t.Fatal("flapping network installed")
+	}
+	if r.isDampened(p, *network, true, now) {
+		t.Fatal("installed flapping network dampened")
+	}
+	if r.isDampened(local, *network, false, now) {
+		t.Fatal("local port dampened")
+	}
+	// 2000 decays to 750 in log2(8/3) half lives
+	reused := now.Add(time.Duration(math.Log2(2000.0/flapReuse) * float64(flapHalfLife)))
+	if !r.isDampened(p, *network, false, reused.Add(-time.Second)) || r.isDampened(p, *network, false, reused.Add(time.Second)) {
+		t.Fatal("network not reused when the penalty decays below the reuse threshold")
+	}
+
+	r.flapPort(p, now)
+	r.flapPort(p, now)
+	r.flapPort(local, now)
+	if !r.isDampened(p, *network, true, now) {
+		t.Fatal("flapping port used")
+	}
+	if _, ok := r.endpointFlaps[local.w.Endpoint()]; ok {
+		t.Fatal("local port penalized")
+	}
+
+	// decayed below half the reuse threshold
+	r.expireFlaps(now.Add(flapHalfLife * 3))
+	if len(r.networkFlaps) != 0 || len(r.endpointFlaps) != 0 {
+		t.Fatalf("%d network and %d endpoint penalties left", len(r.networkFlaps), len(r.endpointFlaps))
+	}
+}
@@ -19,7 +19,7 @@ const (
 	prefixGooseNode = "/goose/0.2.0/node"
 	// advertise network prefix
 	prefixGooseNetwork = "/goose/0.2.0/network"
-	// intervals
+	// default intervals
 	searchInterval = time.Second * 300
 
 	advertiseInterval = time.Second * 300
@@ -36,13 +36,33 @@ type PeerFinder struct {
 	ns []string
 	// peer channel
 	peers chan string
+	// intervals
+	searchInterval    time.Duration
+	advertiseInterval time.Duration
+}
+
+// peer finder option
+type Option func(pf *PeerFinder)
+
+// search peers in the interval
+func WithSearchInterval(interval time.Duration) Option {
+	return func(pf *PeerFinder) {
+		pf.searchInterval = interval
+	}
+}
+
+// advertise this node in the interval
+func WithAdvertiseInterval(interval time.Duration) Option {
+	return func(pf *PeerFinder) {
+		pf.advertiseInterval = interval
+	}
 }
 
 func nodeKey(ns string) string {
 	return fmt.Sprintf("%s/%s", prefixGooseNode, ns)
 }
 
-func NewPeerFinder(namesapce string) PeerFinder {
+func NewPeerFinder(namesapce string, opts ...Option) PeerFinder {
 
 	namespaces := strings.Split(namesapce, ",")
 	ns := []string{}
@@ -53,6 +73,12 @@ func NewPeerFinder(namesapce string) PeerFinder {
 		P2PHost: ipfs.GetP2PHost(),
 		ns:      ns,
 		peers:   make(chan string),
+
+		searchInterval:    searchInterval,
+		advertiseInterval: advertiseInterval,
+	}
+	for _, opt := range opts {
+		opt(&pf)
 	}
 	go pf.start()
 	return pf
@@ -92,16 +118,16 @@ func (pf *PeerFinder) findPeers() error {
 
 func (pf *PeerFinder) start() error {
 	// search ticker
-	searchTicker := time.NewTicker(searchInterval)
+	searchTicker := time.NewTicker(pf.searchInterval)
 	defer searchTicker.Stop()
 	// advertise ticker
-	advertiseTicker := time.NewTicker(advertiseInterval)
+	advertiseTicker := time.NewTicker(pf.advertiseInterval)
 	defer advertiseTicker.Stop()
 
 	ctx := context.Background()
 
 	for _, ns := range pf.ns {
-		if _, err := pf.Advertise(ctx, ns, discovery.TTL(advertiseInterval)); err != nil {
+		if _, err := pf.Advertise(ctx, ns, discovery.TTL(pf.advertiseInterval)); err != nil {
 			logger.Println("failed to advertise", err)
 		}
 	}
@@ -119,7 +145,7 @@ func (pf *PeerFinder) start() error {
 			}
 		case <-advertiseTicker.C:
 			for _, ns := range pf.ns {
-				if _, err := pf.Advertise(ctx, ns, discovery.TTL(advertiseInterval)); err != nil {
+				if _, err := pf.Advertise(ctx, ns, discovery.TTL(pf.advertiseInterval)); err != nil {
 					logger.Println("failed to advertise", err)
 				}
 			}
@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/wire/ipfs"
+)
+
+const (
+	// advertise prefix prefix
+	prefixGoosePrefix = "/goose/0.2.0/prefix"
+	// ttl of advertised prefixes
+	prefixTTL = time.Second * 600
+)
+
+var (
+	// prefixes are advertised under the longest of these lengths they cover,
+	// so a lookup of an address checks one key of each length
+	prefixLevels4 = []int{32, 24, 16, 8, 0}
+	prefixLevels6 = []int{128, 64, 48, 32, 0}
+)
+
+// advertises originated prefixes and finds the owners of addresses
+type PrefixFinder struct {
+	// p2p host
+	*ipfs.P2PHost
+	// namespaces
+	ns []string
+}
+
+func NewPrefixFinder(namespace string) *PrefixFinder {
+	return &PrefixFinder{
+		P2PHost: ipfs.GetP2PHost(),
+		ns:      strings.Split(namespace, ","),
+	}
+}
+
+func prefixKey(ns string, network net.IPNet) string {
+	return fmt.Sprintf("%s/%s/%s", prefixGoosePrefix, ns, network.String())
+}
+
+// the key network of the prefix, masked to the longest level it covers
+func prefixLevel(network net.IPNet) net.IPNet {
+	ones, bits := network.Mask.Size()
+	levels := prefixLevels4
+	if bits == 8*net.IPv6len {
+		levels = prefixLevels6
+	}
+	for _, level := range levels {
+		if level <= ones {
+			mask := net.CIDRMask(level, bits)
+			return net.IPNet{IP: network.IP.Mask(mask), Mask: mask}
+		}
+	}
+	return network
+}
+
+// advertise the prefixes in all the namespaces
+func (f *PrefixFinder) Advertise(ctx context.Context, prefixes []net.IPNet) error {
+	keys := map[string]bool{}
+	for _, ns := range f.ns {
+		for _, prefix := range prefixes {
+			keys[prefixKey(ns, prefixLevel(prefix))] = true
+		}
+	}
+	for key := range keys {
+		if _, err := f.P2PHost.Advertise(ctx, key, discovery.TTL(prefixTTL)); err != nil {
+			return errors.Wrapf(err, "advertise %s", key)
+		}
+	}
+	logger.Printf("advertised %d prefixes under %d keys", len(prefixes), len(keys))
+	return nil
+}
+
+// the key networks which may contain the address, one of each level
+func lookupLevels(ip net.IP) []net.IPNet {
+	bits := 8 * net.IPv6len
+	levels := prefixLevels6
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits, levels = v4, 8*net.IPv4len, prefixLevels4
+	}
+	networks := make([]net.IPNet, 0, len(levels))
+	for _, level := range levels {
+		mask := net.CIDRMask(level, bits)
+		networks = append(networks, net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	return networks
+}
+
+// find peers advertising prefixes which may contain the address, returns their endpoints
+func (f *PrefixFinder) FindOwners(ctx context.Context, ip net.IP) ([]string, error) {
+	owners := []string{}
+	seen := map[string]bool{}
+	for _, ns := range f.ns {
+		for _, network := range lookupLevels(ip) {
+			key := prefixKey(ns, network)
+			peers, err := f.FindPeers(ctx, key)
+			if err != nil {
+				return owners, errors.WithStack(err)
+			}
+			for p := range peers {
+				if p.ID == f.ID() || seen[p.ID.String()] {
+					continue
+				}
+				seen[p.ID.String()] = true
+				f.AllowPeer(p.ID.String())
+				owners = append(owners, fmt.Sprintf("ipfs/%s", p.ID))
+				logger.Printf("found peer %s for %s in %s", p.ID, ip, key)
+			}
+		}
+	}
+	return owners, nil
+}
@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+)
+
+// test prefixes are advertised under the longest level they cover
+func TestPrefixLevel(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"10.1.2.3/32":      "10.1.2.3/32",
+		"10.1.2.0/24":      "10.1.2.0/24",
+		"10.1.2.0/25":      "10.1.2.0/24",
+		"10.1.16.0/20":     "10.1.0.0/16",
+		"10.0.0.0/8":       "10.0.0.0/8",
+		"10.0.0.0/7":       "0.0.0.0/0",
+		"0.0.0.0/0":        "0.0.0.0/0",
+		"fd00::1/128":      "fd00::1/128",
+		"fd00:1:2:3::/64":  "fd00:1:2:3::/64",
+		"fd00:1:2:3::/56":  "fd00:1:2::/48",
+		"fd00:1:2::/40":    "fd00:1::/32",
+		"fd00::/8":         "::/0",
+		"fd00:1:2:3::/127": "fd00:1:2:3::/64",
+	} {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level := prefixLevel(*network); level.String() != want {
+			t.Fatalf("%s advertised under %s, want %s", prefix, level.String(), want)
+		}
+	}
+}
+
+// test a lookup checks the key of each level, so it finds the prefixes containing the address
+func TestLookupLevels(t *testing.T) {
+	for addr, want := range map[string][]string{
+		"10.1.2.3":       {"10.1.2.3/32", "10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8", "0.0.0.0/0"},
+		"fd00:1::5":      {"fd00:1::5/128", "fd00:1::/64", "fd00:1::/48", "fd00:1::/32", "::/0"},
+		"::ffff:1.2.3.4": {"1.2.3.4/32", "1.2.3.0/24", "1.2.0.0/16", "1.0.0.0/8", "0.0.0.0/0"},
+	} {
+		levels := lookupLevels(net.ParseIP(addr))
+		if len(levels) != len(want) {
+			t.Fatalf("%s looked up under %v", addr, levels)
+		}
+		for i := range levels {
+			if levels[i].String() != want[i] {
+				t.Fatalf("%s looked up under %v, want %v", addr, levels, want)
+			}
+		}
+	}
+	// an advertised prefix is one of the lookup keys of its addresses
+	_, network, _ := net.ParseCIDR("10.1.16.0/20")
+	key := prefixLevel(*network)
+	found := false
+	for _, level := range lookupLevels(net.ParseIP("10.1.20.1")) {
+		found = found || level.String() == key.String()
+	}
+	if !found {
+		t.Fatalf("%s not found by its addresses", key.String())
+	}
+}
@@ -31,6 +31,8 @@ type FakeIPManager struct {
 	f2r map[string]*net.IP
 	// real to fake ip mapping
 	r2f map[string]*net.IP
+	// fake ip to domain mapping
+	f2d map[string]string
 	// ip trackings
 	trackings []ipTracking
 	// fakeip rule
@@ -54,6 +56,7 @@ func NewFakeIPManager(network, script, db string) *FakeIPManager {
 		pool:       pool,
 		f2r:        make(map[string]*net.IP),
 		r2f:        make(map[string]*net.IP),
+		f2d:        make(map[string]string),
 		trackings:  []ipTracking{},
 		nameServer: make(map[string][]dnsRecord),
 	}
@@ -96,6 +99,7 @@ func (manager *FakeIPManager) run() {
 func (manager *FakeIPManager) free_locked(tracking *ipTracking) {
 	delete(manager.r2f, string(tracking.Real.To4()))
 	delete(manager.f2r, string(tracking.Fake.To4()))
+	delete(manager.f2d, string(tracking.Fake.To4()))
 }
 
 // alloc fake ip
@@ -118,10 +122,44 @@ func (manager *FakeIPManager) alloc(domain string, real net.IP) (net.IP, error)
 		// update mapping
 		manager.f2r[string(fake.To4())] = &real
 		manager.r2f[string(real.To4())] = &fake
+		manager.f2d[string(fake.To4())] = domain
 		return fake, nil
 	}
 }
 
+// fake ip mapping
+type Mapping struct {
+	Fake   net.IP `json:"fake"`
+	Real   net.IP `json:"real"`
+	Domain string `json:"domain"`
+}
+
+// current fake ip mappings
+func (manager *FakeIPManager) Mappings() []Mapping {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	mappings := []Mapping{}
+	for fake, real := range manager.f2r {
+		mappings = append(mappings, Mapping{
+			Fake:   net.IP(fake),
+			Real:   *real,
+			Domain: manager.f2d[fake],
+		})
+	}
+	return mappings
+}
+
+// allocated fake ips and the pool size
+func (manager *FakeIPManager) PoolUsage() (int, int) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	ones, bits := manager.network.Mask.Size()
+	// the network address is not allocated
+	return len(manager.f2r), 1<<(bits-ones) - 1
+}
+
 // get real ip by fake ip
 func (manager *FakeIPManager) toReal(fake net.IP) *net.IP {
 	manager.mu.Lock()
@@ -0,0 +1,184 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+const (
+	// duplicated route requests are suppressed in this interval
+	requestInterval = time.Second * 5
+)
+
+// feasibility distance of an origin's prefix
+type source struct {
+	// seqno
+	seqno uint16
+	// smallest metric announced with the seqno
+	metric int
+	// last updated
+	updatedAt time.Time
+}
+
+// route request to send
+type routeRequest struct {
+	// requested entry, the seqno is the requested one
+	entry message.RoutingEntry
+	// port to send the request to, nil for all ports
+	to *Port
+	// port the request came from
+	from *Port
+}
+
+func sourceKey(origin string, network net.IPNet) string {
+	return origin + " " + network.String()
+}
+
+// true if seqno a is newer than b, modulo 2^16
+func seqnoNewer(a, b uint16) bool {
+	return a != b && int16(a-b) > 0
+}
+
+// babel feasibility condition. the advertised metric must be smaller than the feasibility distance
+// unless the seqno is newer. must be called with the lock held
+func (r *Router) isFeasible(entry *message.RoutingEntry) bool {
+	src, ok := r.sources[sourceKey(entry.Origin, entry.Network)]
+	if !ok {
+		return true
+	}
+	return seqnoNewer(entry.Seqno, src.seqno) || (entry.Seqno == src.seqno && entry.Metric < src.metric)
+}
+
+// update the feasibility distance with the selected entry. must be called with the lock held
+func (r *Router) updateSource(entry *routingEntry) {
+	key := sourceKey(entry.origin, entry.network)
+	src, ok := r.sources[key]
+	if !ok || seqnoNewer(entry.seqno, src.seqno) || (entry.seqno == src.seqno && entry.metric < src.metric) {
+		src = source{
+			seqno:  entry.seqno,
+			metric: entry.metric,
+		}
+	}
+	src.updatedAt = time.Now()
+	r.sources[key] = src
+}
+
+// drop expired feasibility distances. must be called with the lock held
+func (r *Router) expireSources(now time.Time) {
+	for key, src := range r.sources {
+		if now.Sub(src.updatedAt) > r.timers.RoutingExpire {
+			delete(r.sources, key)
+		}
+	}
+	for key, requestedAt := range r.requested {
+		if now.Sub(requestedAt) > requestInterval {
+			delete(r.requested, key)
+		}
+	}
+}
+
+// ask the origin for a newer seqno, no feasible routing remains. must be called with the lock held
+func (r *Router) requestSeqno(entry *message.RoutingEntry) {
+	// local and legacy routings have no seqno to request
+	if entry.Origin == "" || entry.Origin == r.id {
+		return
+	}
+	request := *entry
+	request.Seqno = entry.Seqno + 1
+	if src, ok := r.sources[sourceKey(entry.Origin, entry.Network)]; ok {
+		request.Seqno = src.seqno + 1
+	}
+	r.queueRequest(routeRequest{entry: request})
+}
+
+// queue a route request, duplicated requests are dropped. must be called with the lock held
+func (r *Router) queueRequest(request routeRequest) {
+	key := fmt.Sprintf("%s %d", sourceKey(request.entry.Origin, request.entry.Network), request.entry.Seqno)
+	if requestedAt, ok := r.requested[key]; ok && time.Since(requestedAt) < requestInterval {
+		return
+	}
+	r.requested[key] = time.Now()
+	// legacy peers drop it as unreachable
+	request.entry.Metric = message.MetricInfinity
+	r.requests = append(r.requests, request)
+	r.trigger()
+}
+
+// handle route requests from the port
+func (r *Router) handleRequest(p *Port, routing message.Routing) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, request := range routing.Routings {
+		entry, err := r.findEntry(request.Network)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		// we are the origin, bump the seqno if requested
+		if request.Origin == r.id {
+			if entry.origin != r.id {
+				continue
+			}
+			if seqnoNewer(request.Seqno, r.seqno) {
+				r.seqno = request.Seqno
+				if err := r.refreshOrigins(); err != nil {
+					return err
+				}
+			}
+			r.changed[entry.network.String()] = entry.network
+			r.trigger()
+			continue
+		}
+		// the request can be satisfied by the selected routing
+		if entry.origin == request.Origin && !seqnoNewer(request.Seqno, entry.seqno) {
+			r.changed[entry.network.String()] = entry.network
+			r.trigger()
+			continue
+		}
+		// forward it towards the origin
+		if entry.port != p && !entry.port.IsLocal() {
+			r.queueRequest(routeRequest{
+				entry: request,
+				to:    entry.port,
+				from:  p,
+			})
+		}
+	}
+	return nil
+}
+
+// sign the entry as originated by this router. must be called with the lock held
+func (r *Router) originate(entry *message.RoutingEntry) error {
+	entry.Origin = r.id
+	entry.Seqno = r.seqno
+	return r.signer.sign(entry)
+}
+
+// re-sign the local routings with the current seqno. must be called with the lock held
+func (r *Router) refreshOrigins() error {
+	all, err := r.allEntries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range all {
+		if entry.origin != r.id || !entry.port.IsLocal() {
+			continue
+		}
+		announcement := entry.announcement()
+		if err := r.originate(&announcement); err != nil {
+			return err
+		}
+		entry.seqno = announcement.Seqno
+		entry.signature = announcement.Signature
+		entry.publicKey = announcement.PublicKey
+		r.updateSource(entry)
+		r.changed[entry.network.String()] = entry.network
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package routing
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+// test seqno comparison wraps around
+func TestSeqnoNewer(t *testing.T) {
+	for _, c := range []struct {
+		a, b  uint16
+		newer bool
+	}{
+		{1, 0, true},
+		{0, 1, false},
+		{5, 5, false},
+		{0, 0xffff, true},
+		{0xffff, 0, false},
+		{0x7fff, 0, true},
+		{0x8000, 0, false},
+	} {
+		if newer := seqnoNewer(c.a, c.b); newer != c.newer {
+			t.Fatalf("seqno %d newer than %d: %v, want %v", c.a, c.b, newer, c.newer)
+		}
+	}
+}
+
+// test the feasibility condition against the feasibility distance, and how the distance is updated
+func TestFeasibility(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	feasible := func(metric int, seqno uint16) bool {
+		entry := message.RoutingEntry{Network: *network, Metric: metric, Origin: origin.id, Seqno: seqno}
+		return r.isFeasible(&entry)
+	}
+	update := func(metric int, seqno uint16) {
+		r.updateSource(&routingEntry{network: *network, metric: metric, origin: origin.id, seqno: seqno})
+	}
+	if !feasible(10, 0) {
+		t.Fatal("routing without a feasibility distance is infeasible")
+	}
+	// the distance is metric 3 at seqno 5
+	update(3, 5)
+	for _, c := range []struct {
+		metric   int
+		seqno    uint16
+		feasible bool
+	}{
+		{2, 5, true},
+		{3, 5, false},
+		{4, 5, false},
+		{1, 4, false},
+		{10, 6, true},
+	} {
+		if ok := feasible(c.metric, c.seqno); ok != c.feasible {
+			t.Fatalf("metric %d seqno %d feasible %v, want %v", c.metric, c.seqno, ok, c.feasible)
+		}
+	}
+	steps := []struct {
+		name          string
+		metric        int
+		seqno         uint16
+		distance      int
+		distanceSeqno uint16
+	}{
+		{"smaller metric lowers the distance", 2, 5, 2, 5},
+		{"larger metric keeps it", 4, 5, 2, 5},
+		{"older seqno keeps it", 1, 4, 2, 5},
+		{"newer seqno resets it", 6, 6, 6, 6},
+	}
+	for _, step := range steps {
+		update(step.metric, step.seqno)
+		src := r.sources[sourceKey(origin.id, *network)]
+		if src.metric != step.distance || src.seqno != step.distanceSeqno {
+			t.Fatalf("%s: distance is metric %d seqno %d", step.name, src.metric, src.seqno)
+		}
+	}
+}
+
+// test a router starved of feasible routings requests a newer seqno, and recovers with it
+func TestStarvationRecovery(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	a := r.addTestPort("ipfs/a")
+	b := r.addTestPort("ipfs/b")
+	cidr := "10.1.0.0/16"
+
+	r.testUpdate(t, a, origin.announce(t, cidr, 1, 5))
+	if entry := r.testEntry(t, cidr); entry == nil || entry.port != a {
+		t.Fatalf("routing via a not installed: %+v", entry)
+	}
+	announcement := origin.announce(t, cidr, 1, 5)
+	if err := r.UpdateRouting(a, message.Routing{Type: message.RoutingWithdraw, Routings: []message.RoutingEntry{announcement}}); err != nil {
+		t.Fatal(err)
+	}
+	if r.testEntry(t, cidr) != nil {
+		t.Fatal("withdrawn routing still installed")
+	}
+	// the withdrawal asks for a newer seqno at once
+	if len(r.requests) != 1 || r.requests[0].entry.Seqno != 6 || r.requests[0].to != nil {
+		t.Fatalf("requests after the withdrawal %+v", r.requests)
+	}
+	// b's routing is longer than the feasibility distance, it could be a loop through us
+	r.testUpdate(t, b, origin.announce(t, cidr, 2, 5))
+	if r.testEntry(t, cidr) != nil {
+		t.Fatal("infeasible routing installed")
+	}
+	// the same request is not sent again
+	if len(r.requests) != 1 {
+		t.Fatalf("duplicated requests %+v", r.requests)
+	}
+	// the origin answers with a newer seqno, any metric is feasible
+	r.testUpdate(t, b, origin.announce(t, cidr, 2, 6))
+	entry := r.testEntry(t, cidr)
+	if entry == nil || entry.port != b || entry.seqno != 6 {
+		t.Fatalf("routing with the newer seqno not installed: %+v", entry)
+	}
+}
+
+// test route requests bump our seqno, are answered by the selected routing, or are forwarded towards the origin
+func TestHandleRequest(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	tunnel := r.addTestPort("tun/goose0")
+	a := r.addTestPort("ipfs/a")
+	b := r.addTestPort("ipfs/b")
+
+	_, local, _ := net.ParseCIDR("10.0.0.1/32")
+	r.testUpdate(t, tunnel, message.RoutingEntry{Network: *local})
+	r.testUpdate(t, a, origin.announce(t, "10.1.0.0/16", 1, 5))
+	if entry := r.testEntry(t, "10.0.0.1/32"); entry == nil || entry.origin != r.id || entry.seqno != 0 {
+		t.Fatalf("local routing not originated: %+v", entry)
+	}
+
+	request := func(p *Port, entry message.RoutingEntry) {
+		r.lock.Lock()
+		r.changed = map[string]net.IPNet{}
+		r.requests = nil
+		r.lock.Unlock()
+		if err := r.handleRequest(p, message.Routing{Type: message.RoutingRequest, Routings: []message.RoutingEntry{entry}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// we are the origin, the seqno is bumped and the routing is announced again
+	request(a, message.RoutingEntry{Network: *local, Origin: r.id, Seqno: 1})
+	if entry := r.testEntry(t, "10.0.0.1/32"); r.seqno != 1 || entry.seqno != 1 || len(r.changed) != 1 {
+		t.Fatalf("seqno %d, local routing seqno %d, %d changed", r.seqno, entry.seqno, len(r.changed))
+	}
+	remote := origin.announce(t, "10.1.0.0/16", 0, 5)
+	// the selected routing is new enough, it's announced again
+	request(b, remote)
+	if len(r.changed) != 1 || len(r.requests) != 0 {
+		t.Fatalf("satisfied request: %d changed, requests %+v", len(r.changed), r.requests)
+	}
+	// a newer seqno is forwarded to the next hop
+	remote.Seqno = 6
+	request(b, remote)
+	if len(r.changed) != 0 || len(r.requests) != 1 || r.requests[0].to != a || r.requests[0].from != b {
+		t.Fatalf("forwarded request: %d changed, requests %+v", len(r.changed), r.requests)
+	}
+	// but not back to the next hop that asked
+	remote.Seqno = 7
+	request(a, remote)
+	if len(r.requests) != 0 {
+		t.Fatalf("request sent back to its sender %+v", r.requests)
+	}
+}
@@ -0,0 +1,166 @@
+// Package fib is the forwarding table of the data plane. A table is immutable once built, so lookups
+// never take a lock. The control plane builds a new table when routes change and publishes it atomically.
+package fib
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	// cached destinations of a table, a power of 2
+	cacheSize = 4096
+)
+
+// a route of the table
+type Route[T any] struct {
+	Prefix netip.Prefix
+	Value  T
+}
+
+// routes of a prefix length, keyed by the masked address. ipv4 addresses are keyed by their
+// integer value, it hashes faster than the address
+type level[T any] struct {
+	bits    int
+	routes4 map[uint32]T
+	routes6 map[[16]byte]T
+}
+
+// a cached lookup, negative results are cached too
+type cached[T any] struct {
+	addr  netip.Addr
+	value T
+	ok    bool
+}
+
+// immutable longest prefix match table, routes are kept in a map per prefix length.
+// recent lookups are cached by destination
+type Table[T any] struct {
+	// levels by family, longest prefix first
+	v4 []level[T]
+	v6 []level[T]
+	// routes
+	size int
+	// direct mapped lookup cache
+	cache [cacheSize]atomic.Pointer[cached[T]]
+}
+
+// build a table of the routes, a later route of the same prefix replaces the earlier one
+func New[T any](routes []Route[T]) *Table[T] {
+	t := &Table[T]{}
+	levels := map[int]*level[T]{}
+	for _, route := range routes {
+		if !route.Prefix.IsValid() {
+			continue
+		}
+		prefix := route.Prefix.Masked()
+		// ipv4 levels are negative, so the families don't share a level
+		key := prefix.Bits()
+		if prefix.Addr().Is4() {
+			key = -key - 1
+		}
+		l, ok := levels[key]
+		if !ok {
+			l = &level[T]{bits: prefix.Bits(), routes4: map[uint32]T{}, routes6: map[[16]byte]T{}}
+			levels[key] = l
+		}
+		if prefix.Addr().Is4() {
+			k := addr4(prefix.Addr())
+			if _, ok := l.routes4[k]; !ok {
+				t.size += 1
+			}
+			l.routes4[k] = route.Value
+		} else {
+			k := prefix.Addr().As16()
+			if _, ok := l.routes6[k]; !ok {
+				t.size += 1
+			}
+			l.routes6[k] = route.Value
+		}
+	}
+	for key, l := range levels {
+		if key < 0 {
+			t.v4 = append(t.v4, *l)
+		} else {
+			t.v6 = append(t.v6, *l)
+		}
+	}
+	for _, family := range [][]level[T]{t.v4, t.v6} {
+		sort.Slice(family, func(i, j int) bool {
+			return family[i].bits > family[j].bits
+		})
+	}
+	return t
+}
+
+// value of the longest prefix containing the address, a nil table is empty
+func (t *Table[T]) Lookup(addr netip.Addr) (T, bool) {
+	var zero T
+	if t == nil || !addr.IsValid() {
+		return zero, false
+	}
+	addr = addr.Unmap()
+	slot := &t.cache[hashAddr(addr)&(cacheSize-1)]
+	if c := slot.Load(); c != nil && c.addr == addr {
+		return c.value, c.ok
+	}
+	value, ok := t.lookup(addr)
+	slot.Store(&cached[T]{addr: addr, value: value, ok: ok})
+	return value, ok
+}
+
+// lookup without the cache
+func (t *Table[T]) lookup(addr netip.Addr) (T, bool) {
+	if addr.Is4() {
+		a := addr4(addr)
+		for _, l := range t.v4 {
+			if value, ok := l.routes4[a&mask4(l.bits)]; ok {
+				return value, true
+			}
+		}
+	} else {
+		for _, l := range t.v6 {
+			prefix, err := addr.Prefix(l.bits)
+			if err != nil {
+				continue
+			}
+			if value, ok := l.routes6[prefix.Addr().As16()]; ok {
+				return value, true
+			}
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// number of routes
+func (t *Table[T]) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+// ipv4 address as an integer
+func addr4(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// ipv4 netmask of the prefix length
+func mask4(bits int) uint32 {
+	if bits == 0 {
+		return 0
+	}
+	return ^uint32(0) << (32 - bits)
+}
+
+// hash of the address for the cache slot
+func hashAddr(addr netip.Addr) uint64 {
+	b := addr.As16()
+	h := binary.BigEndian.Uint64(b[:8])*0x9e3779b97f4a7c15 ^ binary.BigEndian.Uint64(b[8:])
+	h *= 0xbf58476d1ce4e5b9
+	return h ^ h>>31
+}
@@ -0,0 +1,236 @@
+package fib
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yl2chen/cidranger"
+)
+
+const (
+	// routes of the benchmarks
+	benchRoutes = 10000
+	// destinations looked up by the benchmarks, the active flows of a busy node
+	benchDestinations = 512
+)
+
+// test the longest prefix wins in both families, and cached lookups agree
+func TestLookup(t *testing.T) {
+	table := New([]Route[string]{
+		{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Value: "default"},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Value: "a"},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Value: "b"},
+		{Prefix: netip.MustParsePrefix("10.1.2.3/32"), Value: "c"},
+		{Prefix: netip.MustParsePrefix("fd00::/8"), Value: "d"},
+		{Prefix: netip.MustParsePrefix("fd00:1::1/128"), Value: "e"},
+	})
+	if table.Len() != 6 {
+		t.Fatalf("table has %d routes", table.Len())
+	}
+	cases := map[string]string{
+		"10.1.2.3":        "c",
+		"10.1.2.4":        "b",
+		"10.2.0.1":        "a",
+		"192.168.1.1":     "default",
+		"::ffff:10.1.2.3": "c",
+		"fd00:1::1":       "e",
+		"fd00:1::2":       "d",
+		"2001:db8::1":     "",
+	}
+	// twice, the second time from the cache
+	for i := 0; i < 2; i++ {
+		for addr, want := range cases {
+			value, ok := table.Lookup(netip.MustParseAddr(addr))
+			if ok != (want != "") || value != want {
+				t.Fatalf("lookup %s got %q, want %q", addr, value, want)
+			}
+		}
+	}
+	var empty *Table[string]
+	if _, ok := empty.Lookup(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Fatal("nil table has routes")
+	}
+}
+
+// random ipv4 routes of /16 to /32 in 10.0.0.0/8, and the default route
+func benchRouteSet() ([]Route[int], []netip.Addr) {
+	rnd := rand.New(rand.NewSource(1))
+	routes := []Route[int]{{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Value: 0}}
+	for i := 1; i < benchRoutes; i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+		routes = append(routes, Route[int]{Prefix: netip.PrefixFrom(addr, 16+rnd.Intn(17)).Masked(), Value: i})
+	}
+	destinations := make([]netip.Addr, benchDestinations)
+	for i := range destinations {
+		destinations[i] = netip.AddrFrom4([4]byte{10, byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+	}
+	return routes, destinations
+}
+
+// the route table the router used before, a trie behind a mutex
+type lockedRanger struct {
+	lock   sync.Mutex
+	ranger cidranger.Ranger
+}
+
+type rangerEntry struct {
+	network net.IPNet
+	value   int
+}
+
+func (e *rangerEntry) Network() net.IPNet {
+	return e.network
+}
+
+func newLockedRanger(routes []Route[int]) *lockedRanger {
+	r := &lockedRanger{ranger: cidranger.NewPCTrieRanger()}
+	for _, route := range routes {
+		r.ranger.Insert(&rangerEntry{network: ipNet(route.Prefix), value: route.Value})
+	}
+	return r
+}
+
+func ipNet(prefix netip.Prefix) net.IPNet {
+	return net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+func (r *lockedRanger) lookup(ip net.IP) (int, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	containing, err := r.ranger.ContainingNetworks(ip)
+	if err != nil {
+		return 0, false
+	}
+	var best *rangerEntry
+	bestLen := -1
+	for _, e := range containing {
+		entry := e.(*rangerEntry)
+		if n, _ := entry.network.Mask.Size(); n > bestLen {
+			best, bestLen = entry, n
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return best.value, true
+}
+
+// keep changing routes until stopped, like routing updates
+func churn(stop <-chan struct{}, wg *sync.WaitGroup, update func(i int)) {
+	defer wg.Done()
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+			update(i)
+		}
+	}
+}
+
+func benchmarkRanger(b *testing.B, withUpdates bool) {
+	routes, destinations := benchRouteSet()
+	ranger := newLockedRanger(routes)
+	ips := make([]net.IP, len(destinations))
+	for i, addr := range destinations {
+		ips[i] = addr.AsSlice()
+	}
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	if withUpdates {
+		wg.Add(1)
+		// an update holds the lock while it changes a batch of routes
+		go churn(stop, wg, func(i int) {
+			ranger.lock.Lock()
+			defer ranger.lock.Unlock()
+			for j := 0; j < 100; j++ {
+				route := routes[1+(i*100+j)%(len(routes)-1)]
+				ranger.ranger.Insert(&rangerEntry{network: ipNet(route.Prefix), value: route.Value})
+			}
+		})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ranger.lookup(ips[i%len(ips)])
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+func benchmarkTable(b *testing.B, withUpdates bool) {
+	routes, destinations := benchRouteSet()
+	table := atomic.Pointer[Table[int]]{}
+	table.Store(New(routes))
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	if withUpdates {
+		wg.Add(1)
+		// an update builds and publishes a new table
+		go churn(stop, wg, func(i int) {
+			table.Store(New(routes))
+		})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			table.Load().Lookup(destinations[i%len(destinations)])
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+// parallel lookups in a locked trie of 10k routes
+func BenchmarkRangerLookup(b *testing.B) {
+	benchmarkRanger(b, false)
+}
+
+// parallel lookups in a locked trie of 10k routes, while routes are updated
+func BenchmarkRangerLookupWithUpdates(b *testing.B) {
+	benchmarkRanger(b, true)
+}
+
+// parallel lookups in a table of 10k routes
+func BenchmarkTableLookup(b *testing.B) {
+	benchmarkTable(b, false)
+}
+
+// parallel lookups in a table of 10k routes, while new tables are published
+func BenchmarkTableLookupWithUpdates(b *testing.B) {
+	benchmarkTable(b, true)
+}
+
+// lookups in a table of 10k routes without the cache
+func BenchmarkTableLookupUncached(b *testing.B) {
+	routes, destinations := benchRouteSet()
+	table := New(routes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.lookup(destinations[i%len(destinations)])
+	}
+}
+
+// building a table of 10k routes, the cost of a publish
+func BenchmarkTableBuild(b *testing.B) {
+	routes, _ := benchRouteSet()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		New(routes)
+	}
+}
@@ -0,0 +1,153 @@
+package routing
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/routing/fib"
+)
+
+const (
+	// forwarding changes are published after this delay, so a burst of routing messages builds one table.
+	// until then, packets are forwarded by the route table
+	publishDelay = time.Millisecond * 50
+)
+
+// the forwarding state changed, a new table is published soon. must be called with the lock held
+func (r *Router) forwardingChanged() {
+	r.forwardingDirty.Store(true)
+	select {
+	case r.publishing <- struct{}{}:
+	default:
+	}
+}
+
+// publish forwarding changes until the router is closed
+func (r *Router) handlePublish() {
+	timer := time.NewTimer(publishDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.publishing:
+			timer.Reset(publishDelay)
+			select {
+			case <-timer.C:
+			case <-r.closed:
+				return
+			}
+			r.lock.Lock()
+			if r.forwardingDirty.Load() {
+				r.publish()
+			}
+			r.lock.Unlock()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// publish a new forwarding table built from the route table. packets are forwarded by the published table
+// without the lock. must be called with the lock held
+func (r *Router) publish() {
+	r.forwardingDirty.Store(false)
+	all, err := r.allEntries()
+	if err != nil {
+		logger.Printf("publish forwarding table failed: %s", err)
+		return
+	}
+	routes := make([]fib.Route[*routingEntry], 0, len(all))
+	for _, entry := range all {
+		prefix, ok := netipPrefix(entry.network)
+		if !ok {
+			continue
+		}
+		routes = append(routes, fib.Route[*routingEntry]{Prefix: prefix, Value: entry.forwarding()})
+	}
+	r.forwardingTable.Store(fib.New(routes))
+}
+
+// copy of the entry's forwarding state. entries are changed in place by the control plane,
+// the data plane only reads the copies
+func (entry *routingEntry) forwarding() *routingEntry {
+	forwarding := &routingEntry{
+		network: entry.network,
+		port:    entry.port,
+		rtt:     entry.rtt,
+	}
+	if len(entry.paths) > 0 {
+		forwarding.paths = make([]routingEntry, len(entry.paths))
+		for i, path := range entry.paths {
+			forwarding.paths[i] = routingEntry{port: path.port, rtt: path.rtt}
+		}
+	}
+	if len(entry.backups) > 0 {
+		forwarding.backups = make([]routingEntry, len(entry.backups))
+		for i, path := range entry.backups {
+			forwarding.backups[i] = routingEntry{port: path.port, rtt: path.rtt}
+		}
+	}
+	return forwarding
+}
+
+// find dest port, flows are spread over equal cost paths by the flow hash.
+// it reads the published forwarding table, so it never waits for routing updates. while a change
+// is not yet published the table is stale, the route table is read under the lock instead
+func (r *Router) FindDestPort(dst net.IP, flow uint64) (*Port, error) {
+	addr, ok := netip.AddrFromSlice(dst)
+	if !ok {
+		return nil, errors.Errorf("invalid destination %s", dst)
+	}
+	if r.forwardingDirty.Load() {
+		return r.findDestPortLocked(dst, flow)
+	}
+	entry, ok := r.forwardingTable.Load().Lookup(addr)
+	if !ok {
+		return nil, nil
+	}
+	return entry.selectPort(flow), nil
+}
+
+// find dest port in the route table
+func (r *Router) findDestPortLocked(dst net.IP, flow uint64) (*Port, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, err := r.longestEntry(dst)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.selectPort(flow), nil
+}
+
+// the entry of the longest network containing the address, nil if there is none. must be called with the lock held
+func (r *Router) longestEntry(ip net.IP) (*routingEntry, error) {
+	containing, err := r.routeTable.ContainingNetworks(ip)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var longest *routingEntry
+	longestOnes := -1
+	for _, e := range containing {
+		entry, ok := e.(*routingEntry)
+		if !ok {
+			continue
+		}
+		if ones, _ := entry.network.Mask.Size(); ones > longestOnes {
+			longest, longestOnes = entry, ones
+		}
+	}
+	return longest, nil
+}
+
+func netipPrefix(network net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, _ := network.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones), true
+}
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"net"
+	"testing"
+)
+
+// publish the forwarding table now
+func (r *Router) testPublish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.publish()
+}
+
+// test routes installed since the last published table are forwarded before the next one is published
+func TestFindDestPort(t *testing.T) {
+	r := newTestRouter(t)
+	o := newTestOrigin(t)
+	a, b := r.addTestPort("ipfs/a"), r.addTestPort("ipfs/b")
+	r.testPublish()
+
+	find := func(dst string) *Port {
+		t.Helper()
+		p, err := r.FindDestPort(net.ParseIP(dst), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// a new network is not in the published table yet
+	r.testUpdate(t, a, o.announce(t, "10.1.0.0/16", 1, 1))
+	if p := find("10.1.2.3"); p != a {
+		t.Fatalf("new route goes to %v before publishing, want %s", p, a)
+	}
+	r.testPublish()
+	if p := find("10.1.2.3"); p != a {
+		t.Fatalf("published route goes to %v, want %s", p, a)
+	}
+	// a more specific network is taken before publishing, even if the stale table has a covering route
+	r.testUpdate(t, b, o.announce(t, "10.1.2.0/24", 1, 1))
+	if p := find("10.1.2.3"); p != b {
+		t.Fatalf("more specific route goes to %v before publishing, want %s", p, b)
+	}
+	if p := find("10.1.3.1"); p != a {
+		t.Fatalf("covering route goes to %v before publishing, want %s", p, a)
+	}
+	r.testPublish()
+	if p := find("10.1.2.3"); p != b {
+		t.Fatalf("published more specific route goes to %v, want %s", p, b)
+	}
+	// unrouted destinations have no port
+	if p := find("10.2.0.1"); p != nil {
+		t.Fatalf("unrouted destination goes to %s", p)
+	}
+}
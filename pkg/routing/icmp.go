@@ -0,0 +1,194 @@
+package routing
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+const (
+	// icmp errors sent per second
+	icmpRate = 100
+	// icmp error burst
+	icmpBurst = 50
+	// max size of icmp errors, rfc 1812 and rfc 4443
+	icmpMaxSize  = 576
+	icmp6MaxSize = 1280
+	// ttl of icmp errors
+	icmpTTL = 64
+
+	// protocols
+	protoICMP   = 1
+	protoICMPv6 = 58
+)
+
+// send an icmp time exceeded error to the source of the packet
+func (r *Router) sendTimeExceeded(packet *message.Packet) {
+	r.sendICMPError(packet,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypeTimeExceeded, layers.ICMPv6CodeHopLimitExceeded), 0)
+}
+
+// send an icmp destination unreachable error to the source of the packet.
+// destinations in the tunnel networks are unreachable hosts, others are unreachable networks
+func (r *Router) sendUnreachable(packet *message.Packet) {
+	code4 := uint8(layers.ICMPv4CodeNet)
+	for _, network := range r.tunnelNets {
+		if network.Contains(packet.Dst) {
+			code4 = layers.ICMPv4CodeHost
+			break
+		}
+	}
+	r.sendICMPError(packet,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, code4),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeNoRouteToDst), 0)
+}
+
+// send an icmp fragmentation needed or packet too big error to the source of the packet, with the mtu of the next hop
+func (r *Router) sendPacketTooBig(packet *message.Packet, mtu int) {
+	r.sendICMPError(packet,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0), mtu)
+}
+
+// mtu is the next hop mtu of packet too big errors, 0 for the others
+func (r *Router) sendICMPError(packet *message.Packet, typeCode4 layers.ICMPv4TypeCode, typeCode6 layers.ICMPv6TypeCode, mtu int) {
+	if !needsICMPError(packet.Data) || !r.icmpLimiter.Allow() {
+		return
+	}
+	data, err := r.icmpError(packet.Data, typeCode4, typeCode6, mtu)
+	if err != nil {
+		logger.Printf("build icmp error failed: %s", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+	src, dst, _ := utils.PacketAddresses(data)
+	reply := message.Packet{
+		Src:  src,
+		Dst:  dst,
+		TTL:  message.PacketTTL,
+		Data: data,
+	}
+	target, err := r.FindDestPort(reply.Dst, utils.FlowHash(reply.Data))
+	if err != nil || target == nil {
+		return
+	}
+	// icmp errors go before the forwarded packets
+	target.writeControl(&reply)
+}
+
+// build the icmp error of the packet, sent from the tunnel address. nil if there is no tunnel address of the ip version
+func (r *Router) icmpError(original []byte, typeCode4 layers.ICMPv4TypeCode, typeCode6 layers.ICMPv6TypeCode, mtu int) ([]byte, error) {
+	src, _, _ := utils.PacketAddresses(original)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if utils.IPVersion(original) == 4 {
+		local := r.tunnelAddress(4)
+		if local == nil {
+			return nil, nil
+		}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      icmpTTL,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    local,
+			DstIP:    src,
+		}
+		// ip header, icmp header, then as much of the original packet as fits.
+		// the next hop mtu of fragmentation needed errors is in the low 16 bits of the header's rest
+		payload := truncate(original, icmpMaxSize-20-8)
+		if err := gopacket.SerializeLayers(buffer, options, ip, &layers.ICMPv4{TypeCode: typeCode4, Seq: uint16(mtu)}, gopacket.Payload(payload)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return buffer.Bytes(), nil
+	}
+	local := r.tunnelAddress(6)
+	if local == nil {
+		return nil, nil
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   icmpTTL,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      local,
+		DstIP:      src,
+	}
+	icmp := &layers.ICMPv6{TypeCode: typeCode6}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// 4 bytes follow the icmpv6 header, the mtu of packet too big errors, unused by the others
+	payload := binary.BigEndian.AppendUint32(nil, uint32(mtu))
+	payload = append(payload, truncate(original, icmp6MaxSize-40-8)...)
+	if err := gopacket.SerializeLayers(buffer, options, ip, icmp, gopacket.Payload(payload)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// tunnel address of the ip version
+func (r *Router) tunnelAddress(version int) net.IP {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, address := range r.addresses {
+		if (address.IP.To4() != nil) == (version == 4) {
+			return address.IP
+		}
+	}
+	return nil
+}
+
+// icmp errors are not sent for icmp errors, fragments other than the first one,
+// and packets from or to multicast, broadcast or unspecified addresses
+func needsICMPError(packet []byte) bool {
+	src, dst, ok := utils.PacketAddresses(packet)
+	if !ok {
+		return false
+	}
+	if src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+		return false
+	}
+	var proto byte
+	var payload []byte
+	switch utils.IPVersion(packet) {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) < ihl {
+			return false
+		}
+		proto, payload = packet[9], packet[ihl:]
+		// echo request and reply, timestamp and info messages are not errors
+		if proto == protoICMP && len(payload) > 0 {
+			switch payload[0] {
+			case 0, 8, 13, 14, 15, 16:
+			default:
+				return false
+			}
+		}
+	case 6:
+		proto, payload = packet[6], packet[40:]
+		// informational messages are 128 and above
+		if proto == protoICMPv6 && len(payload) > 0 && payload[0] < 128 {
+			return false
+		}
+	}
+	return true
+}
+
+func truncate(data []byte, size int) []byte {
+	if len(data) > size {
+		return data[:size]
+	}
+	return data
+}
@@ -0,0 +1,191 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ones' complement checksum of the data
+func checksum(data ...[]byte) uint16 {
+	buf := bytes.Join(data, nil)
+	sum := uint32(0)
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i:]))
+	}
+	if len(buf)%2 == 1 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// udp packet of the size
+func udpPacket(t *testing.T, src, dst string, size int) []byte {
+	var ip gopacket.SerializableLayer
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	headers := 8
+	if parsed := net.ParseIP(src); parsed.To4() != nil {
+		ipv4 := &layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolUDP, SrcIP: parsed.To4(), DstIP: net.ParseIP(dst).To4()}
+		udp.SetNetworkLayerForChecksum(ipv4)
+		ip, headers = ipv4, headers+20
+	} else {
+		ipv6 := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolUDP, SrcIP: parsed, DstIP: net.ParseIP(dst)}
+		udp.SetNetworkLayerForChecksum(ipv6)
+		ip, headers = ipv6, headers+40
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload(make([]byte, size-headers))); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// test icmpv4 errors have the type, the mtu, valid checksums and the original packet truncated to 576 bytes
+func TestICMPv4Error(t *testing.T) {
+	r := newTestRouter(t)
+	r.addresses = []net.IPNet{{IP: net.ParseIP("192.168.1.1").To4(), Mask: net.CIDRMask(24, 32)}}
+	for _, c := range []struct {
+		name     string
+		typeCode layers.ICMPv4TypeCode
+		mtu      int
+		size     int
+	}{
+		{"time exceeded", layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded), 0, 1500},
+		{"unreachable", layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeNet), 0, 100},
+		{"packet too big", layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded), 1280, 1500},
+	} {
+		original := udpPacket(t, "10.0.0.1", "10.9.9.9", c.size)
+		data, err := r.icmpError(original, c.typeCode, 0, c.mtu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		icmp, _ := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if ip == nil || icmp == nil {
+			t.Fatalf("%s: invalid error %v", c.name, packet)
+		}
+		if !ip.SrcIP.Equal(r.addresses[0].IP) || !ip.DstIP.Equal(net.ParseIP("10.0.0.1")) || ip.TTL != icmpTTL {
+			t.Fatalf("%s: ip header %+v", c.name, ip)
+		}
+		if icmp.TypeCode != c.typeCode || int(icmp.Seq) != c.mtu {
+			t.Fatalf("%s: icmp %v mtu %d", c.name, icmp.TypeCode, icmp.Seq)
+		}
+		if checksum(data[:20]) != 0 || checksum(data[20:]) != 0 {
+			t.Fatalf("%s: invalid checksum", c.name)
+		}
+		if len(data) > icmpMaxSize || !bytes.Equal(icmp.Payload, original[:min(len(original), icmpMaxSize-28)]) {
+			t.Fatalf("%s: %d bytes, quoted %d bytes", c.name, len(data), len(icmp.Payload))
+		}
+	}
+}
+
+// test icmpv6 errors have the type, the mtu, a valid pseudo header checksum and the original packet truncated to 1280 bytes
+func TestICMPv6Error(t *testing.T) {
+	r := newTestRouter(t)
+	r.addresses = []net.IPNet{
+		{IP: net.ParseIP("192.168.1.1").To4(), Mask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	for _, c := range []struct {
+		name     string
+		typeCode layers.ICMPv6TypeCode
+		mtu      int
+		size     int
+	}{
+		{"time exceeded", layers.CreateICMPv6TypeCode(layers.ICMPv6TypeTimeExceeded, layers.ICMPv6CodeHopLimitExceeded), 0, 1500},
+		{"unreachable", layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeNoRouteToDst), 0, 100},
+		{"packet too big", layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0), 1400, 1500},
+	} {
+		original := udpPacket(t, "fd01::1", "fd09::9", c.size)
+		data, err := r.icmpError(original, 0, c.typeCode, c.mtu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+		ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		icmp, _ := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		if ip == nil || icmp == nil {
+			t.Fatalf("%s: invalid error %v", c.name, packet)
+		}
+		if !ip.SrcIP.Equal(net.ParseIP("fd00::1")) || !ip.DstIP.Equal(net.ParseIP("fd01::1")) || ip.HopLimit != icmpTTL {
+			t.Fatalf("%s: ip header %+v", c.name, ip)
+		}
+		if icmp.TypeCode != c.typeCode {
+			t.Fatalf("%s: icmp %v", c.name, icmp.TypeCode)
+		}
+		message := data[40:]
+		if mtu := binary.BigEndian.Uint32(message[4:8]); int(mtu) != c.mtu {
+			t.Fatalf("%s: mtu %d", c.name, mtu)
+		}
+		pseudo := binary.BigEndian.AppendUint32(bytes.Join([][]byte{ip.SrcIP, ip.DstIP}, nil), uint32(len(message)))
+		pseudo = append(pseudo, 0, 0, 0, protoICMPv6)
+		if checksum(pseudo, message) != 0 {
+			t.Fatalf("%s: invalid checksum", c.name)
+		}
+		if len(data) > icmp6MaxSize || !bytes.Equal(message[8:], original[:min(len(original), icmp6MaxSize-48)]) {
+			t.Fatalf("%s: %d bytes, quoted %d bytes", c.name, len(data), len(message)-8)
+		}
+	}
+	// no error without a tunnel address of the ip version
+	r.addresses = r.addresses[:1]
+	if data, err := r.icmpError(udpPacket(t, "fd01::1", "fd09::9", 100), 0, 0, 0); err != nil || data != nil {
+		t.Fatalf("error without an ipv6 address %v %v", data, err)
+	}
+}
+
+// test icmp errors are not sent for icmp errors, fragments and multicast or broadcast packets
+func TestNeedsICMPError(t *testing.T) {
+	icmp4 := func(icmpType uint8) []byte {
+		packet := udpPacket(t, "10.0.0.1", "10.9.9.9", 100)
+		packet[9], packet[20] = protoICMP, icmpType
+		return packet
+	}
+	icmp6 := func(icmpType uint8) []byte {
+		packet := udpPacket(t, "fd01::1", "fd09::9", 100)
+		packet[6], packet[40] = protoICMPv6, icmpType
+		return packet
+	}
+	fragment := udpPacket(t, "10.0.0.1", "10.9.9.9", 100)
+	binary.BigEndian.PutUint16(fragment[6:8], 185)
+	first := udpPacket(t, "10.0.0.1", "10.9.9.9", 100)
+	// more fragments
+	binary.BigEndian.PutUint16(first[6:8], 0x2000)
+
+	for _, c := range []struct {
+		name   string
+		packet []byte
+		needs  bool
+	}{
+		{"udp", udpPacket(t, "10.0.0.1", "10.9.9.9", 100), true},
+		{"udp6", udpPacket(t, "fd01::1", "fd09::9", 100), true},
+		{"echo request", icmp4(8), true},
+		{"echo reply", icmp4(0), true},
+		{"icmp error", icmp4(3), false},
+		{"time exceeded", icmp4(11), false},
+		{"echo request6", icmp6(128), true},
+		{"icmp6 error", icmp6(1), false},
+		{"packet too big6", icmp6(2), false},
+		{"first fragment", first, true},
+		{"fragment", fragment, false},
+		{"multicast source", udpPacket(t, "224.0.0.1", "10.9.9.9", 100), false},
+		{"multicast destination", udpPacket(t, "10.0.0.1", "239.1.1.1", 100), false},
+		{"broadcast", udpPacket(t, "10.0.0.1", "255.255.255.255", 100), false},
+		{"unspecified source", udpPacket(t, "0.0.0.0", "10.9.9.9", 100), false},
+		{"multicast source6", udpPacket(t, "ff02::1", "fd09::9", 100), false},
+		{"multicast destination6", udpPacket(t, "fd01::1", "ff02::16", 100), false},
+		{"truncated", []byte{0x45, 0}, false},
+	} {
+		if needs := needsICMPError(c.packet); needs != c.needs {
+			t.Fatalf("%s: needs icmp error %v, want %v", c.name, needs, c.needs)
+		}
+	}
+}
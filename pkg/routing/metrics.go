@@ -0,0 +1,205 @@
+package routing
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// metric namespace
+	metricsNamespace = "goose"
+	// metrics request timeout
+	metricsTimeout = time.Second * 10
+
+	// route change events
+	routeAdded     = "add"
+	routeUpdated   = "update"
+	routePromoted  = "promote"
+	routeWithdrawn = "withdraw"
+
+	// dial results
+	dialSucceeded = "success"
+	dialFailed    = "failure"
+	dialRetried   = "retry"
+)
+
+var (
+	// route changes by event
+	routeChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "route_changes_total",
+		Help:      "Route table changes by event.",
+	}, []string{"event"})
+
+	// connector dials by result
+	dials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dials_total",
+		Help:      "Connector dials by result.",
+	}, []string{"result"})
+
+	// per-port metrics, collected when scraped. a peer may have several ports of the same endpoint
+	portLabels      = []string{"port", "peer", "id"}
+	portPacketsDesc = prometheus.NewDesc(metricsNamespace+"_port_packets_total",
+		"Packets of the port by direction.", append(portLabels, "direction"), nil)
+	portBytesDesc = prometheus.NewDesc(metricsNamespace+"_port_bytes_total",
+		"Packet bytes of the port by direction.", append(portLabels, "direction"), nil)
+	portDroppedDesc = prometheus.NewDesc(metricsNamespace+"_port_dropped_total",
+		"Packets dropped by the output queue of the port by reason.", append(portLabels, "reason"), nil)
+	portShapedDesc = prometheus.NewDesc(metricsNamespace+"_port_shaped_total",
+		"Packets delayed by rate shaping of the port by direction.", append(portLabels, "direction"), nil)
+	portPolicedDesc = prometheus.NewDesc(metricsNamespace+"_port_policed_total",
+		"Packets dropped by rate limiting of the port by direction.", append(portLabels, "direction"), nil)
+	portRttDesc = prometheus.NewDesc(metricsNamespace+"_port_rtt_seconds",
+		"Smoothed rtt of the port.", portLabels, nil)
+	portRttVarianceDesc = prometheus.NewDesc(metricsNamespace+"_port_rtt_variance_seconds2",
+		"Smoothed rtt variance of the port.", portLabels, nil)
+	portLossDesc = prometheus.NewDesc(metricsNamespace+"_port_loss_ratio",
+		"Smoothed ratio of lost routing acks of the port.", portLabels, nil)
+	portQueueDesc = prometheus.NewDesc(metricsNamespace+"_port_queue_packets",
+		"Packets in the output queue of the port by traffic class.", append(portLabels, "class"), nil)
+
+	// router metrics, collected when scraped
+	routesDesc = prometheus.NewDesc(metricsNamespace+"_routes",
+		"Routings in the route table by family.", []string{"family"}, nil)
+	pathsDesc = prometheus.NewDesc(metricsNamespace+"_route_paths",
+		"Alternative paths in the route table by kind.", []string{"kind"}, nil)
+	endpointsDesc = prometheus.NewDesc(metricsNamespace+"_endpoints",
+		"Endpoints known by the connector by status.", []string{"status"}, nil)
+	fakeIPUsedDesc = prometheus.NewDesc(metricsNamespace+"_fakeip_used",
+		"Allocated fake ips.", nil, nil)
+	fakeIPSizeDesc = prometheus.NewDesc(metricsNamespace+"_fakeip_size",
+		"Size of the fake ip pool.", nil, nil)
+)
+
+// collects router state when scraped
+type routerCollector struct {
+	*Router
+}
+
+func (c routerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		portPacketsDesc, portBytesDesc, portDroppedDesc, portShapedDesc, portPolicedDesc,
+		portRttDesc, portRttVarianceDesc, portLossDesc, portQueueDesc,
+		routesDesc, pathsDesc, endpointsDesc, fakeIPUsedDesc, fakeIPSizeDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c routerCollector) Collect(ch chan<- prometheus.Metric) {
+	r := c.Router
+	// the connector is not locked with the router
+	endpoints := r.Endpoints()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for p := range r.portStats {
+		labels := []string{p.w.Endpoint(), p.PeerID(), strconv.FormatUint(p.id, 10)}
+		counter := func(desc *prometheus.Desc, value int64, extra ...string) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), append(labels, extra...)...)
+		}
+		gauge := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+		}
+		counter(portPacketsDesc, atomic.LoadInt64(&p.pktIn), "in")
+		counter(portPacketsDesc, atomic.LoadInt64(&p.pktOut), "out")
+		counter(portBytesDesc, atomic.LoadInt64(&p.bytesIn), "in")
+		counter(portBytesDesc, atomic.LoadInt64(&p.bytesOut), "out")
+		overflow, expired := p.queue.drops()
+		counter(portDroppedDesc, overflow, "overflow")
+		counter(portDroppedDesc, expired, "codel")
+		for dir, name := range directionNames {
+			counter(portShapedDesc, atomic.LoadInt64(&p.shaped[dir]), name)
+			counter(portPolicedDesc, atomic.LoadInt64(&p.policed[dir]), name)
+		}
+		// rtt stats are in ms
+		mean, variance := p.rtt()
+		gauge(portRttDesc, float64(mean)/1e3)
+		gauge(portRttVarianceDesc, float64(variance)/1e6)
+		gauge(portLossDesc, p.Loss())
+		for class, queued := range p.queue.classLens() {
+			ch <- prometheus.MustNewConstMetric(portQueueDesc, prometheus.GaugeValue, float64(queued), append(labels, classNames[class])...)
+		}
+	}
+
+	all, err := r.allEntries()
+	if err != nil {
+		logger.Printf("collect routings failed: %s", err)
+		return
+	}
+	routes := map[string]int{"ipv4": 0, "ipv6": 0}
+	paths, backups := 0, 0
+	for _, entry := range all {
+		if entry.network.IP.To4() != nil {
+			routes["ipv4"] += 1
+		} else {
+			routes["ipv6"] += 1
+		}
+		paths += len(entry.paths)
+		backups += len(entry.backups)
+	}
+	for family, count := range routes {
+		ch <- prometheus.MustNewConstMetric(routesDesc, prometheus.GaugeValue, float64(count), family)
+	}
+	ch <- prometheus.MustNewConstMetric(pathsDesc, prometheus.GaugeValue, float64(paths), "multipath")
+	ch <- prometheus.MustNewConstMetric(pathsDesc, prometheus.GaugeValue, float64(backups), "backup")
+
+	status := map[string]int{}
+	for _, name := range statusNames {
+		status[name] = 0
+	}
+	for _, ep := range endpoints {
+		status[ep.Status] += 1
+	}
+	for name, count := range status {
+		ch <- prometheus.MustNewConstMetric(endpointsDesc, prometheus.GaugeValue, float64(count), name)
+	}
+
+	if r.fakeIP != nil {
+		used, size := r.fakeIP.PoolUsage()
+		ch <- prometheus.MustNewConstMetric(fakeIPUsedDesc, prometheus.GaugeValue, float64(used))
+		ch <- prometheus.MustNewConstMetric(fakeIPSizeDesc, prometheus.GaugeValue, float64(size))
+	}
+}
+
+// serve prometheus metrics on the address until the router is closed
+func (r *Router) serveMetrics(addr string) error {
+	registry := prometheus.NewRegistry()
+	for _, collector := range []prometheus.Collector{
+		routerCollector{r},
+		routeChanges,
+		dials,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		if err := registry.Register(collector); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  metricsTimeout,
+		WriteTimeout: metricsTimeout,
+	}
+	go func() {
+		<-r.closed
+		server.Close()
+	}()
+	logger.Printf("metrics listening on %s", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return errors.WithStack(err)
+	}
+	return nil
+}
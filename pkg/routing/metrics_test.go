@@ -0,0 +1,80 @@
+package routing
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// test every port is collected, two ports of the same peer don't fail the scrape
+func TestRouterCollector(t *testing.T) {
+	r := newTestRouter(t)
+	connector, err := NewBaseConnector(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Connector = connector
+	a := r.addTestPort("ipfs/peer")
+	b := r.addTestPort("ipfs/peer")
+	a.pktIn, a.pktOut = 1, 2
+	b.pktIn, b.pktOut = 3, 4
+	origin := newTestOrigin(t)
+	r.testUpdate(t, a, origin.announce(t, "10.1.0.0/16", 1, 1), origin.announce(t, "fd00:1::/64", 1, 1))
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(routerCollector{r}); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	labels := func(m *dto.Metric) map[string]string {
+		result := map[string]string{}
+		for _, label := range m.GetLabel() {
+			result[label.GetName()] = label.GetValue()
+		}
+		return result
+	}
+
+	packets := byName["goose_port_packets_total"]
+	if packets == nil || len(packets.GetMetric()) != 4 {
+		t.Fatalf("port packets %v", packets)
+	}
+	want := map[string]float64{}
+	for _, p := range []*Port{a, b} {
+		id := strconv.FormatUint(p.id, 10)
+		want[id+"/in"] = float64(p.pktIn)
+		want[id+"/out"] = float64(p.pktOut)
+	}
+	for _, m := range packets.GetMetric() {
+		l := labels(m)
+		if l["port"] != "ipfs/peer" || l["peer"] != "peer" {
+			t.Fatalf("port labels %v", l)
+		}
+		key := l["id"] + "/" + l["direction"]
+		if value, ok := want[key]; !ok || value != m.GetCounter().GetValue() {
+			t.Fatalf("port %s packets %v, want %v", key, m.GetCounter().GetValue(), value)
+		}
+		delete(want, key)
+	}
+	for _, name := range []string{"goose_port_rtt_seconds", "goose_port_loss_ratio"} {
+		if family := byName[name]; family == nil || len(family.GetMetric()) != 2 {
+			t.Fatalf("%s %v", name, family)
+		}
+	}
+	for _, m := range byName["goose_routes"].GetMetric() {
+		if m.GetGauge().GetValue() != 1 {
+			t.Fatalf("routes %v", m)
+		}
+	}
+	if family := byName["goose_endpoints"]; family == nil || len(family.GetMetric()) != len(statusNames) {
+		t.Fatalf("endpoints %v", family)
+	}
+}
@@ -0,0 +1,209 @@
+package routing
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// paths costing up to this ratio more than the selected one are near equal
+	multipathTolerance = 0.25
+	// added to path rtt before weighting, so near zero rtt paths don't take all flows
+	multipathRttBase = 10
+	// max backup paths of a network
+	maxBackups = 4
+)
+
+// keep alternative paths of the entry, the selected path is excluded.
+// near equal cost paths share the traffic, the others are backups. must be called with the lock held
+func (r *Router) updatePaths(entry *routingEntry, candidates ...routingEntry) {
+	merged := entry.alternates()
+	for _, candidate := range candidates {
+		candidate.paths = nil
+		candidate.backups = nil
+		replaced := false
+		for i := range merged {
+			if merged[i].port == candidate.port {
+				merged[i] = candidate
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, candidate)
+		}
+	}
+	now := time.Now()
+	alternates := []routingEntry{}
+	for _, path := range merged {
+		if path.port == entry.port || path.port.IsClosed() || now.Sub(path.updatedAt) > r.timers.RoutingExpire {
+			continue
+		}
+		alternates = append(alternates, path)
+	}
+	sort.Slice(alternates, func(i, j int) bool {
+		return r.cost.cost(&alternates[i]) < r.cost.cost(&alternates[j])
+	})
+	limit := r.cost.cost(entry) * (1 + multipathTolerance)
+	paths := []routingEntry{}
+	backups := []routingEntry{}
+	for _, path := range alternates {
+		if len(paths) < r.maxPaths-1 && r.cost.cost(&path) <= limit {
+			paths = append(paths, path)
+		} else if len(backups) < maxBackups {
+			backups = append(backups, path)
+		}
+	}
+	if !samePorts(entry.paths, paths) || !samePorts(entry.backups, backups) {
+		r.forwardingChanged()
+	}
+	entry.paths = paths
+	entry.backups = backups
+}
+
+// true if the paths go through the same ports in the same order
+func samePorts(a, b []routingEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].port != b[i].port {
+			return false
+		}
+	}
+	return true
+}
+
+// remove the path through the port. if it's the selected path, the cheapest feasible alternative is promoted.
+// the entry is withdrawn when no path remains. must be called with the lock held
+func (r *Router) removePath(entry *routingEntry, p *Port) error {
+	// provisional routings have no other paths, and were never announced
+	if entry.provisional {
+		if entry.port == p {
+			return r.removeProvisional(entry)
+		}
+		return nil
+	}
+	alternates := []routingEntry{}
+	for _, path := range entry.alternates() {
+		if path.port != p {
+			alternates = append(alternates, path)
+		}
+	}
+	r.forwardingChanged()
+	if entry.port != p {
+		entry.paths, entry.backups = nil, nil
+		r.updatePaths(entry, alternates...)
+		return nil
+	}
+	// alternatives may be infeasible if the feasibility distance has changed
+	feasible := []routingEntry{}
+	for _, path := range alternates {
+		announcement := path.announcement()
+		announcement.Metric -= 1
+		if r.isFeasible(&announcement) {
+			feasible = append(feasible, path)
+		}
+	}
+	if len(feasible) > 0 {
+		best := 0
+		for i := range feasible {
+			if r.cost.cost(&feasible[i]) < r.cost.cost(&feasible[best]) {
+				best = i
+			}
+		}
+		promoted := feasible[best]
+		promoted.paths, promoted.backups = nil, nil
+		*entry = promoted
+		r.updatePaths(entry, append(feasible[:best:best], feasible[best+1:]...)...)
+		r.updateSource(entry)
+		r.changed[entry.network.String()] = entry.network
+		routeChanges.WithLabelValues(routePromoted).Inc()
+		r.trigger()
+		return nil
+	}
+	// no path remains
+	if _, err := r.routeTable.Remove(entry.Network()); err != nil {
+		return errors.WithStack(err)
+	}
+	if entry.origin != r.id {
+		r.flapNetwork(entry.network, time.Now())
+	}
+	r.withdraw(entry)
+	// the remaining routings may be infeasible
+	announcement := entry.announcement()
+	r.requestSeqno(&announcement)
+	return nil
+}
+
+// near equal cost paths and backups of the entry
+func (entry *routingEntry) alternates() []routingEntry {
+	alternates := make([]routingEntry, 0, len(entry.paths)+len(entry.backups))
+	alternates = append(alternates, entry.paths...)
+	return append(alternates, entry.backups...)
+}
+
+// true if the entry has a path through the port
+func (entry *routingEntry) hasPath(p *Port) bool {
+	if entry.port == p {
+		return true
+	}
+	for _, path := range entry.alternates() {
+		if path.port == p {
+			return true
+		}
+	}
+	return false
+}
+
+// select the path for the flow with weighted rendezvous hashing. weights follow the path rtt,
+// flows only move when their path is added or removed. closed ports are skipped before
+// their routings are cleared, backups are used if all near equal paths are closed
+func (entry *routingEntry) selectPort(flow uint64) *Port {
+	if len(entry.paths) == 0 && !entry.port.IsClosed() {
+		return entry.port
+	}
+	var best *Port
+	var bestScore float64
+	if !entry.port.IsClosed() {
+		best, bestScore = entry.port, pathScore(flow, entry.port, entry.rtt)
+	}
+	for i := range entry.paths {
+		if entry.paths[i].port.IsClosed() {
+			continue
+		}
+		if score := pathScore(flow, entry.paths[i].port, entry.paths[i].rtt); best == nil || score > bestScore {
+			best, bestScore = entry.paths[i].port, score
+		}
+	}
+	if best != nil {
+		return best
+	}
+	for i := range entry.backups {
+		if !entry.backups[i].port.IsClosed() {
+			return entry.backups[i].port
+		}
+	}
+	return entry.port
+}
+
+func pathScore(flow uint64, p *Port, rtt int) float64 {
+	h := mix64(flow ^ p.hash)
+	// uniform in (0, 1)
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	weight := 1 / float64(rtt+multipathRttBase)
+	return -weight / math.Log(u)
+}
+
+// splitmix64 finalizer
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
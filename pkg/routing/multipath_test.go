@@ -0,0 +1,187 @@
+package routing
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+// flows of the selection tests
+const testFlows = 30000
+
+// ports selected for the test flows
+func selectPorts(entry *routingEntry) []*Port {
+	ports := make([]*Port, testFlows)
+	for flow := range ports {
+		ports[flow] = entry.selectPort(mix64(uint64(flow)))
+	}
+	return ports
+}
+
+// share of the flows selecting the port
+func share(ports []*Port, p *Port) float64 {
+	n := 0
+	for _, selected := range ports {
+		if selected == p {
+			n += 1
+		}
+	}
+	return float64(n) / float64(len(ports))
+}
+
+// test flows are spread over the paths by their rtt weights, and only flows of a removed path move
+func TestSelectPort(t *testing.T) {
+	a, b, c := newTestPort("ipfs/a"), newTestPort("ipfs/b"), newTestPort("ipfs/c")
+	// weights are 1/(rtt+10), a gets half of the flows
+	entry := &routingEntry{
+		port: a,
+		rtt:  10,
+		paths: []routingEntry{
+			{port: b, rtt: 30},
+			{port: c, rtt: 30},
+		},
+	}
+	before := selectPorts(entry)
+	for _, want := range []struct {
+		port  *Port
+		share float64
+	}{{a, 0.5}, {b, 0.25}, {c, 0.25}} {
+		if got := share(before, want.port); math.Abs(got-want.share) > 0.02 {
+			t.Fatalf("port %s has %.3f of the flows, want %.2f", want.port, got, want.share)
+		}
+	}
+	// the same flow always takes the same path
+	for flow, p := range selectPorts(entry) {
+		if p != before[flow] {
+			t.Fatalf("flow %d moved without a path change", flow)
+		}
+	}
+	// c is removed, only its flows move
+	entry.paths = entry.paths[:1]
+	after := selectPorts(entry)
+	for flow := range after {
+		if before[flow] != c && after[flow] != before[flow] {
+			t.Fatalf("flow %d moved from %s to %s", flow, before[flow], after[flow])
+		}
+	}
+	// closed paths are skipped
+	c.Close()
+	b.Close()
+	for flow, p := range selectPorts(entry) {
+		if p != a {
+			t.Fatalf("flow %d selected closed port %s", flow, p)
+		}
+	}
+}
+
+// test backups are used when the selected port and all near equal paths are closed
+func TestSelectPortBackup(t *testing.T) {
+	a, b, c := newTestPort("ipfs/a"), newTestPort("ipfs/b"), newTestPort("ipfs/c")
+	entry := &routingEntry{
+		port:    a,
+		paths:   []routingEntry{{port: b}},
+		backups: []routingEntry{{port: c}},
+	}
+	a.Close()
+	b.Close()
+	if p := entry.selectPort(1); p != c {
+		t.Fatalf("selected %s, want the backup", p)
+	}
+}
+
+// test near equal cost paths share the traffic up to the max paths, the others are backups sorted by cost
+func TestUpdatePaths(t *testing.T) {
+	r := newTestRouter(t)
+	r.maxPaths = 3
+	now := time.Now()
+	ports := map[string]*Port{}
+	for _, name := range []string{"selected", "near", "nearer", "nearest", "far", "closed", "expired"} {
+		ports[name] = newTestPort("ipfs/" + name)
+	}
+	ports["closed"].Close()
+	// costs are 20 per hop plus the rtt, the selected path costs 100 and near equal paths up to 125
+	path := func(name string, rtt int) routingEntry {
+		return routingEntry{port: ports[name], metric: 1, rtt: rtt, updatedAt: now}
+	}
+	entry := path("selected", 80)
+	expired := path("expired", 80)
+	expired.updatedAt = now.Add(-r.timers.RoutingExpire * 2)
+	r.updatePaths(&entry, path("far", 200), path("near", 105), path("nearer", 90), path("nearest", 80), path("closed", 80), expired)
+
+	names := func(paths []routingEntry) []string {
+		result := []string{}
+		for _, p := range paths {
+			result = append(result, p.port.w.Endpoint())
+		}
+		return result
+	}
+	paths, backups := names(entry.paths), names(entry.backups)
+	if len(paths) != 2 || paths[0] != "ipfs/nearest" || paths[1] != "ipfs/nearer" {
+		t.Fatalf("paths %v", paths)
+	}
+	if len(backups) != 2 || backups[0] != "ipfs/near" || backups[1] != "ipfs/far" {
+		t.Fatalf("backups %v", backups)
+	}
+	// a path update replaces the old one of the port
+	r.updatePaths(&entry, path("far", 85))
+	if paths := names(entry.paths); len(paths) != 2 || paths[0] != "ipfs/nearest" || paths[1] != "ipfs/far" {
+		t.Fatalf("paths after the update %v", paths)
+	}
+}
+
+// test the cheapest feasible backup is promoted when the selected path is withdrawn, and the network
+// is withdrawn when no feasible path remains
+func TestBackupPromotion(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	cidr := "10.1.0.0/16"
+	announce := func(metric, rtt int) message.RoutingEntry {
+		entry := origin.announce(t, cidr, metric, 1)
+		entry.Rtt = rtt
+		return entry
+	}
+	withdraw := func(p *Port) {
+		if err := r.withdrawRouting(p, message.Routing{Routings: []message.RoutingEntry{announce(1, 0)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := r.addTestPort("ipfs/a"), r.addTestPort("ipfs/b"), r.addTestPort("ipfs/c")
+	r.testUpdate(t, a, announce(1, 50))
+	r.testUpdate(t, b, announce(1, 200))
+	r.testUpdate(t, c, announce(1, 100))
+
+	entry := r.testEntry(t, cidr)
+	if entry == nil || entry.port != a || len(entry.backups) != 2 {
+		t.Fatalf("selected %+v", entry)
+	}
+	for _, step := range []struct {
+		name    string
+		port    *Port
+		want    *Port
+		backups int
+	}{
+		{"selected withdrawn", a, c, 1},
+		{"backup withdrawn", b, c, 0},
+		{"last feasible withdrawn", c, nil, 0},
+	} {
+		withdraw(step.port)
+		entry := r.testEntry(t, cidr)
+		if step.want == nil {
+			if entry != nil {
+				t.Fatalf("%s: selected %+v", step.name, entry)
+			}
+			continue
+		}
+		if entry == nil || entry.port != step.want || len(entry.backups) != step.backups {
+			t.Fatalf("%s: selected %+v", step.name, entry)
+		}
+	}
+	if len(r.withdrawn) != 1 {
+		t.Fatalf("%d withdrawals queued", len(r.withdrawn))
+	}
+	if len(r.requested) != 1 {
+		t.Fatalf("%d seqno requests", len(r.requested))
+	}
+}
@@ -0,0 +1,159 @@
+package routing
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/routing/discovery"
+)
+
+const (
+	// originated prefixes are advertised in this interval
+	prefixAdvertiseInterval = time.Second * 300
+	// first advertisement after the local ports are up
+	prefixAdvertiseDelay = time.Second * 30
+	// an unrouted destination is looked up once in this interval
+	lookupInterval = time.Second * 60
+	// lookup timeout
+	lookupTimeout = time.Second * 60
+	// concurrent lookups
+	maxLookups = 4
+	// max remembered lookups
+	maxLookupEntries = 4096
+)
+
+// find peers in the namespace and dial them
+func (r *Router) enableDiscovery(namespace string) {
+	pf := discovery.NewPeerFinder(namespace,
+		discovery.WithSearchInterval(r.timers.SearchInterval),
+		discovery.WithAdvertiseInterval(r.timers.AdvertiseInterval))
+	// relace id with the peerID
+	r.id = pf.ID().String()
+	go func() {
+		for peer := range pf.Peers() {
+			r.Dial(peer)
+		}
+	}()
+	// unrouted destinations are looked up by the prefixes peers advertise
+	r.enablePrefixDiscovery(namespace)
+}
+
+// advertise the originated prefixes and find owners of unrouted destinations in the namespace
+func (r *Router) enablePrefixDiscovery(namespace string) {
+	r.prefixFinder = discovery.NewPrefixFinder(namespace)
+	go r.advertisePrefixes()
+}
+
+// advertise originated prefixes until the router is closed
+func (r *Router) advertisePrefixes() {
+	timer := time.NewTimer(prefixAdvertiseDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			prefixes, err := r.originatedPrefixes()
+			if err != nil {
+				logger.Printf("get originated prefixes failed: %s", err)
+			} else if len(prefixes) > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), prefixAdvertiseInterval)
+				if err := r.prefixFinder.Advertise(ctx, prefixes); err != nil {
+					logger.Printf("advertise prefixes failed: %s", err)
+				}
+				cancel()
+			}
+			r.lock.Lock()
+			r.expireLookups(time.Now())
+			r.lock.Unlock()
+			timer.Reset(prefixAdvertiseInterval)
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// networks originated by this router
+func (r *Router) originatedPrefixes() ([]net.IPNet, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	all, err := r.allEntries()
+	if err != nil {
+		return nil, err
+	}
+	prefixes := []net.IPNet{}
+	for _, entry := range all {
+		if entry.origin == r.id {
+			prefixes = append(prefixes, entry.network)
+		}
+	}
+	return prefixes, nil
+}
+
+// true if the destination may be routed. multicast, broadcast, link local and unspecified destinations never are
+func routableDestination(dst net.IP) bool {
+	return !dst.IsMulticast() && !dst.IsLinkLocalUnicast() && !dst.IsLinkLocalMulticast() &&
+		!dst.IsUnspecified() && !dst.Equal(net.IPv4bcast)
+}
+
+// find the owner of the unrouted destination and dial it. lookups are rate limited by destination
+func (r *Router) lookupDestination(dst net.IP) {
+	if r.prefixFinder == nil || !routableDestination(dst) {
+		return
+	}
+	now := time.Now()
+	key := dst.String()
+
+	r.lock.Lock()
+	if lookedUp, ok := r.lookups[key]; ok && now.Sub(lookedUp) < lookupInterval {
+		r.lock.Unlock()
+		return
+	}
+	if len(r.lookups) >= maxLookupEntries {
+		r.expireLookups(now)
+	}
+	if len(r.lookups) >= maxLookupEntries {
+		r.lock.Unlock()
+		return
+	}
+	select {
+	case r.lookupSlots <- struct{}{}:
+	default:
+		// too many lookups in progress, try again with the next packet
+		r.lock.Unlock()
+		return
+	}
+	r.lookups[key] = now
+	r.lock.Unlock()
+
+	go func() {
+		defer func() { <-r.lookupSlots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		owners, err := r.prefixFinder.FindOwners(ctx, dst)
+		if err != nil {
+			logger.Printf("lookup %s failed: %s", dst, err)
+		}
+		connected := map[string]bool{}
+		for _, ep := range r.Endpoints() {
+			connected[ep.Endpoint] = ep.Status == statusNames[statusConnected] || ep.Status == statusNames[statusConnecting]
+		}
+		for _, owner := range owners {
+			if !connected[owner] {
+				logger.Printf("dial %s for unrouted destination %s", owner, dst)
+				r.Dial(owner)
+			}
+		}
+	}()
+}
+
+// forget old lookups. must be called with the lock held
+func (r *Router) expireLookups(now time.Time) {
+	for key, lookedUp := range r.lookups {
+		if now.Sub(lookedUp) >= lookupInterval {
+			delete(r.lookups, key)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package routing
+
+import (
+	"net"
+	"testing"
+)
+
+// test multicast, broadcast, link local and unspecified destinations are never looked up
+func TestRoutableDestination(t *testing.T) {
+	for addr, routable := range map[string]bool{
+		"10.1.2.3":        true,
+		"8.8.8.8":         true,
+		"fd00::1":         true,
+		"2001:db8::1":     true,
+		"224.0.0.251":     false,
+		"239.255.255.250": false,
+		"255.255.255.255": false,
+		"169.254.1.1":     false,
+		"0.0.0.0":         false,
+		"ff02::2":         false,
+		"ff02::16":        false,
+		"ff05::1:3":       false,
+		"fe80::1":         false,
+		"::":              false,
+	} {
+		if got := routableDestination(net.ParseIP(addr)); got != routable {
+			t.Fatalf("%s routable %v, want %v", addr, got, routable)
+		}
+	}
+}
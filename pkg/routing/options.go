@@ -4,22 +4,110 @@ import (
 	"github.com/pkg/errors"
 	"net"
 
-	"github.com/nickjfree/goose/pkg/routing/discovery"
+	"github.com/nickjfree/goose/pkg/message"
 	"github.com/nickjfree/goose/pkg/routing/fakeip"
 	"github.com/nickjfree/goose/pkg/utils"
+	"github.com/nickjfree/goose/pkg/wire/filters"
 )
 
 // router option
 type Option func(r *Router) error
 
-// max metric allowd for this rouer
+// max metric allowd for this rouer. it must be below the packet ttl, or packets on the longest paths are dropped
 func WithMaxMetric(metric int) Option {
 	return func(r *Router) error {
+		if metric < 1 || metric >= message.PacketTTL {
+			return errors.Errorf("max metric %d is not in 1-%d", metric, message.PacketTTL-1)
+		}
 		r.maxMetric = metric
 		return nil
 	}
 }
 
+// accept unsigned routings from legacy peers. they never replace signed routings
+func WithUnsigned() Option {
+	return func(r *Router) error {
+		r.allowUnsigned = true
+		return nil
+	}
+}
+
+// route cost weights
+func WithCost(weights CostWeights) Option {
+	return func(r *Router) error {
+		if weights.Hysteresis < 0 || weights.Hysteresis >= 1 {
+			return errors.Errorf("invalid cost hysteresis %f", weights.Hysteresis)
+		}
+		r.cost = weights
+		return nil
+	}
+}
+
+// max equal cost paths of a network, 1 disables multipath
+func WithMultipath(paths int) Option {
+	return func(r *Router) error {
+		if paths < 1 {
+			return errors.Errorf("invalid multipath %d", paths)
+		}
+		r.maxPaths = paths
+		return nil
+	}
+}
+
+// route policy file, reloaded by Router.Reload
+func WithPolicy(path string) Option {
+	return func(r *Router) error {
+		policy, err := LoadPolicy(path)
+		if err != nil {
+			return err
+		}
+		r.policy = policy
+		r.policyFile = path
+		return nil
+	}
+}
+
+// per-peer rate limits file, reloaded by Router.Reload
+func WithRateLimit(path string) Option {
+	return func(r *Router) error {
+		limits, err := LoadRateLimits(path)
+		if err != nil {
+			return err
+		}
+		r.rateLimits = limits
+		r.rateLimitFile = path
+		return nil
+	}
+}
+
+// serve the admin api on the unix socket
+func WithAdmin(path string) Option {
+	return func(r *Router) error {
+		r.adminSocket = path
+		return nil
+	}
+}
+
+// serve prometheus metrics on the address, eg. 127.0.0.1:9100
+func WithMetrics(addr string) Option {
+	return func(r *Router) error {
+		r.metricsAddr = addr
+		return nil
+	}
+}
+
+// firewall rules file of peer ports, reloaded by Router.Reload
+func WithFirewall(path string) Option {
+	return func(r *Router) error {
+		firewall, err := filters.NewFirewall(path)
+		if err != nil {
+			return err
+		}
+		r.firewall = firewall
+		return nil
+	}
+}
+
 func WithConnector() Option {
 	return func(r *Router) error {
 		// create connector
@@ -36,11 +124,15 @@ func WithConnector() Option {
 func WithForward(forwardCIDRs ...string) Option {
 	return func(r *Router) error {
 		// append local forward nets
+		forward6 := false
 		for _, cidr := range forwardCIDRs {
 			_, network, err := net.ParseCIDR(cidr)
 			if err != nil {
 				return errors.WithStack(err)
 			}
+			if network.IP.To4() == nil {
+				forward6 = true
+			}
 			r.localNets = append(r.localNets, *network)
 		}
 		// set up nat
@@ -48,23 +140,56 @@ func WithForward(forwardCIDRs ...string) Option {
 			if err := utils.SetupNAT("goose"); err != nil {
 				return err
 			}
+			r.nat = true
+		}
+		if forward6 {
+			if err := utils.SetupNAT6("goose"); err != nil {
+				return err
+			}
+			r.nat6 = true
 		}
 		r.forwardCIDRs = forwardCIDRs
 		return nil
 	}
 }
 
+// anycast addresses served by this router, eg. 10.200.0.53 or fd00::53
+func WithAnycast(addresses ...string) Option {
+	return func(r *Router) error {
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				// cidr format of a single host
+				host, network, err := net.ParseCIDR(address)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if !utils.IsHostNetwork(*network) {
+					return errors.Errorf("anycast address %s is not a single host", address)
+				}
+				ip = host
+			}
+			r.anycast = append(r.anycast, utils.HostNetwork(ip))
+		}
+		return nil
+	}
+}
+
 // discovery
 func WithDiscovery(namespace string) Option {
 	return func(r *Router) error {
-		pf := discovery.NewPeerFinder(namespace)
-		// relace id with the peerID
-		r.id = pf.ID().String()
-		go func() {
-			for peer := range pf.Peers() {
-				r.Dial(peer)
-			}
-		}()
+		r.namespace = namespace
+		return nil
+	}
+}
+
+// protocol timers
+func WithTimers(timers Timers) Option {
+	return func(r *Router) error {
+		if err := timers.validate(); err != nil {
+			return err
+		}
+		r.timers = timers
 		return nil
 	}
 }
@@ -84,3 +209,11 @@ func WithName(name string) Option {
 		return nil
 	}
 }
+
+// persist recent endpoints and routings to the file, they are restored on startup
+func WithState(path string) Option {
+	return func(r *Router) error {
+		r.statePath = path
+		return nil
+	}
+}
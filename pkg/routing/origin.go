@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+const (
+	// max cached verified signatures
+	maxVerifiedOrigins = 4096
+)
+
+// signs origin announcements with the node's libp2p private key
+type originSigner struct {
+	// private key
+	priv crypto.PrivKey
+	// marshaled public key, empty if it can be extracted from the peer id
+	pub []byte
+}
+
+func newOriginSigner(priv crypto.PrivKey) (*originSigner, error) {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &originSigner{priv: priv}
+	// small keys are inlined in the peer id, no need to send them
+	if _, err := id.ExtractPublicKey(); err != nil {
+		pub, err := crypto.MarshalPublicKey(priv.GetPublic())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.pub = pub
+	}
+	return s, nil
+}
+
+// sign the entry, origin must be the signer's peer id
+func (s *originSigner) sign(entry *message.RoutingEntry) error {
+	sig, err := s.priv.Sign(entry.SignedData())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	entry.PublicKey = s.pub
+	entry.Signature = sig
+	return nil
+}
+
+// verifies origin signatures, results are cached
+type originVerifier struct {
+	// verified origin and signature pairs
+	verified map[string]struct{}
+	// lock
+	lock sync.Mutex
+}
+
+func newOriginVerifier() *originVerifier {
+	return &originVerifier{
+		verified: make(map[string]struct{}),
+	}
+}
+
+// verify the entry is signed by its origin
+func (v *originVerifier) verify(entry *message.RoutingEntry) error {
+	if len(entry.Signature) == 0 {
+		return errors.Errorf("missing signature")
+	}
+	key := entry.Origin + string(entry.Signature) + string(entry.SignedData())
+
+	v.lock.Lock()
+	_, ok := v.verified[key]
+	v.lock.Unlock()
+	if ok {
+		return nil
+	}
+
+	id, err := peer.Decode(entry.Origin)
+	if err != nil {
+		return errors.Wrap(err, "invalid origin")
+	}
+	var pub crypto.PubKey
+	if len(entry.PublicKey) > 0 {
+		if pub, err = crypto.UnmarshalPublicKey(entry.PublicKey); err != nil {
+			return errors.Wrap(err, "invalid public key")
+		}
+		if !id.MatchesPublicKey(pub) {
+			return errors.Errorf("public key doesn't match origin")
+		}
+	} else if pub, err = id.ExtractPublicKey(); err != nil {
+		return errors.Wrap(err, "missing public key")
+	}
+	ok, err = pub.Verify(entry.SignedData(), entry.Signature)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !ok {
+		return errors.Errorf("bad signature")
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.verified) >= maxVerifiedOrigins {
+		v.verified = make(map[string]struct{})
+	}
+	v.verified[key] = struct{}{}
+	return nil
+}
@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+// test routings without a valid signature of their origin are rejected and not installed
+func TestRejectUnsigned(t *testing.T) {
+	origin := newTestOrigin(t)
+	_, other, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := crypto.MarshalPublicKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tampered, _ := net.ParseCIDR("10.9.0.0/16")
+	cases := []struct {
+		name   string
+		cidr   string
+		modify func(entry *message.RoutingEntry)
+	}{
+		{"unsigned host", "10.1.1.1/32", func(entry *message.RoutingEntry) {
+			entry.Origin, entry.Signature = "", nil
+		}},
+		{"unsigned network", "10.1.0.0/24", func(entry *message.RoutingEntry) {
+			entry.Origin, entry.Signature = "", nil
+		}},
+		{"unsigned default", "0.0.0.0/0", func(entry *message.RoutingEntry) {
+			entry.Origin, entry.Signature = "", nil
+		}},
+		{"missing signature", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.Signature = nil
+		}},
+		{"forged signature", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.Signature[0] ^= 0xff
+		}},
+		{"public key of another origin", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.PublicKey = otherKey
+		}},
+		{"tampered network", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.Network = *tampered
+		}},
+		{"tampered name", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.Name = "mallory"
+		}},
+		{"tampered seqno", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.Seqno += 1
+		}},
+		{"tampered anycast", "10.1.0.0/16", func(entry *message.RoutingEntry) {
+			entry.Anycast = true
+		}},
+	}
+	for _, c := range cases {
+		r := newTestRouter(t)
+		p := r.addTestPort("ipfs/peer")
+		entry := origin.announce(t, c.cidr, 1, 1)
+		c.modify(&entry)
+		r.testUpdate(t, p, entry)
+		all, err := r.allEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 0 {
+			t.Fatalf("%s: installed %s", c.name, all[0])
+		}
+	}
+	// legacy peers if allowed, local ports are always trusted
+	r := newTestRouter(t)
+	r.allowUnsigned = true
+	p := r.addTestPort("ipfs/peer")
+	r.testUpdate(t, p, message.RoutingEntry{Network: *tampered, Metric: 1})
+	if r.testEntry(t, "10.9.0.0/16") == nil {
+		t.Fatal("unsigned routing rejected when allowed")
+	}
+	r = newTestRouter(t)
+	local := r.addTestPort("tun/goose")
+	r.testUpdate(t, local, message.RoutingEntry{Network: *tampered, Metric: 0})
+	if entry := r.testEntry(t, "10.9.0.0/16"); entry == nil || entry.origin != r.id {
+		t.Fatalf("local routing %+v", entry)
+	}
+}
+
+// test an unsigned routing or a signed host routing of another origin never replaces an installed one
+func TestRejectConflict(t *testing.T) {
+	r := newTestRouter(t)
+	r.allowUnsigned = true
+	owner, other := newTestOrigin(t), newTestOrigin(t)
+	a, b := r.addTestPort("ipfs/a"), r.addTestPort("ipfs/b")
+	r.testUpdate(t, a, owner.announce(t, "10.1.1.1/32", 3, 1), owner.announce(t, "10.2.0.0/16", 3, 1))
+
+	unsigned := owner.announce(t, "10.2.0.0/16", 1, 2)
+	unsigned.Origin, unsigned.Signature = "", nil
+	r.testUpdate(t, b, other.announce(t, "10.1.1.1/32", 1, 1), unsigned)
+	for _, cidr := range []string{"10.1.1.1/32", "10.2.0.0/16"} {
+		if entry := r.testEntry(t, cidr); entry == nil || entry.port != a || entry.origin != owner.id {
+			t.Fatalf("%s replaced %+v", cidr, entry)
+		}
+	}
+	// the conflict is reported to the peer
+	ack := <-b.announce
+	if ack.Type != message.RoutingRegisterAck || len(ack.Routings) != 1 || ack.Routings[0].Origin != other.id {
+		t.Fatalf("ack %+v", ack)
+	}
+}
@@ -0,0 +1,239 @@
+package routing
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+// route filter of one direction
+type RouteFilter struct {
+	// permitted prefixes, routings must be covered by one of them. empty permits all
+	Permit []string `json:"permit,omitempty"`
+	// denied prefixes, checked before the permitted ones
+	Deny []string `json:"deny,omitempty"`
+	// max prefix length of ipv4 routings, 0 for no limit
+	MaxLength int `json:"max_length,omitempty"`
+	// max prefix length of ipv6 routings, 0 for no limit
+	MaxLength6 int `json:"max_length6,omitempty"`
+	// deny default routings, 0.0.0.0/0 and ::/0
+	DenyDefault bool `json:"deny_default,omitempty"`
+
+	// parsed prefixes
+	permit []net.IPNet
+	deny   []net.IPNet
+}
+
+// import and export filters of a peer
+type PeerPolicy struct {
+	// routings accepted from the peer
+	Import *RouteFilter `json:"import,omitempty"`
+	// routings advertised to the peer
+	Export *RouteFilter `json:"export,omitempty"`
+}
+
+// route policy. the peer's policy is used first, then the wire type's, then the default
+//
+//	{
+//	  "default": {"import": {"deny_default": true, "max_length": 24}},
+//	  "wires": {"wireguard": {"export": {"permit": ["10.0.0.0/8"]}}},
+//	  "peers": {"12D3KooW...": {"import": {"permit": ["0.0.0.0/0", "10.1.0.0/16"]}}}
+//	}
+type Policy struct {
+	// default policy
+	Default PeerPolicy `json:"default"`
+	// policies by wire type, eg. ipfs, wireguard
+	Wires map[string]PeerPolicy `json:"wires,omitempty"`
+	// policies by peer id
+	Peers map[string]PeerPolicy `json:"peers,omitempty"`
+}
+
+// load policy from a json file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrapf(err, "invalid policy %s", path)
+	}
+	peers := []PeerPolicy{policy.Default}
+	for _, p := range policy.Wires {
+		peers = append(peers, p)
+	}
+	for _, p := range policy.Peers {
+		peers = append(peers, p)
+	}
+	for _, p := range peers {
+		for _, filter := range []*RouteFilter{p.Import, p.Export} {
+			if filter == nil {
+				continue
+			}
+			if err := filter.parse(); err != nil {
+				return nil, errors.Wrapf(err, "invalid policy %s", path)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (f *RouteFilter) parse() error {
+	parse := func(cidrs []string) ([]net.IPNet, error) {
+		networks := []net.IPNet{}
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			networks = append(networks, *network)
+		}
+		return networks, nil
+	}
+	var err error
+	if f.permit, err = parse(f.Permit); err != nil {
+		return err
+	}
+	if f.deny, err = parse(f.Deny); err != nil {
+		return err
+	}
+	return nil
+}
+
+// true if the filter allows the network, a nil filter allows all
+func (f *RouteFilter) allow(network net.IPNet) bool {
+	if f == nil {
+		return true
+	}
+	if f.DenyDefault && utils.IsDefaultNetwork(network) {
+		return false
+	}
+	ones, bits := network.Mask.Size()
+	maxLength := f.MaxLength
+	if bits == 8*net.IPv6len {
+		maxLength = f.MaxLength6
+	}
+	if maxLength > 0 && ones > maxLength {
+		return false
+	}
+	for _, prefix := range f.deny {
+		if covers(prefix, network) {
+			return false
+		}
+	}
+	if len(f.permit) == 0 {
+		return true
+	}
+	for _, prefix := range f.permit {
+		if covers(prefix, network) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if the network is inside the prefix
+func covers(prefix, network net.IPNet) bool {
+	prefixOnes, prefixBits := prefix.Mask.Size()
+	ones, bits := network.Mask.Size()
+	return prefixBits == bits && ones >= prefixOnes && prefix.Contains(network.IP)
+}
+
+// policies of the port, most specific first
+func (policy *Policy) lookup(p *Port) []PeerPolicy {
+	policies := []PeerPolicy{}
+	if peer, ok := policy.Peers[p.PeerID()]; ok {
+		policies = append(policies, peer)
+	}
+	protocol := strings.Split(p.w.Endpoint(), "/")[0]
+	if wire, ok := policy.Wires[protocol]; ok {
+		policies = append(policies, wire)
+	}
+	return append(policies, policy.Default)
+}
+
+// import filter of the port, nil if there is no policy. the tunnel port is not filtered
+func (policy *Policy) importFilter(p *Port) *RouteFilter {
+	if policy == nil || p.IsTunnel() {
+		return nil
+	}
+	for _, peer := range policy.lookup(p) {
+		if peer.Import != nil {
+			return peer.Import
+		}
+	}
+	return nil
+}
+
+// export filter of the port, nil if there is no policy. the tunnel port is not filtered
+func (policy *Policy) exportFilter(p *Port) *RouteFilter {
+	if policy == nil || p.IsTunnel() {
+		return nil
+	}
+	for _, peer := range policy.lookup(p) {
+		if peer.Export != nil {
+			return peer.Export
+		}
+	}
+	return nil
+}
+
+// reload the route policy, the rate limits and the firewall rules if they are configured
+func (r *Router) Reload() error {
+	if r.policyFile != "" {
+		if err := r.reloadPolicy(); err != nil {
+			return err
+		}
+	}
+	if r.rateLimitFile != "" {
+		if err := r.reloadRateLimits(); err != nil {
+			return err
+		}
+	}
+	if r.firewall != nil {
+		if err := r.firewall.Reload(); err != nil {
+			return err
+		}
+		logger.Printf("firewall rules reloaded")
+	}
+	return nil
+}
+
+// reload the policy file, paths no longer allowed are removed
+func (r *Router) reloadPolicy() error {
+	policy, err := LoadPolicy(r.policyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.policy = policy
+
+	all, err := r.allEntries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range all {
+		// the selected path goes last, so only allowed alternatives are promoted
+		ports := []*Port{}
+		for _, path := range entry.alternates() {
+			ports = append(ports, path.port)
+		}
+		ports = append(ports, entry.port)
+		for _, p := range ports {
+			if !policy.importFilter(p).allow(entry.network) {
+				if err := r.removePath(entry, p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// peers get the new exports on the next announcement
+	logger.Printf("policy reloaded from %s", r.policyFile)
+	return nil
+}
@@ -0,0 +1,155 @@
+package routing
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func parseNetwork(t *testing.T, cidr string) net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *network
+}
+
+// test a prefix covers the networks inside it of the same family
+func TestCovers(t *testing.T) {
+	for _, c := range []struct {
+		prefix  string
+		network string
+		covers  bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", true},
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.0.0.0/8", "10.1.2.3/32", true},
+		{"10.1.0.0/16", "10.0.0.0/8", false},
+		{"10.0.0.0/8", "11.0.0.0/16", false},
+		{"0.0.0.0/0", "192.168.1.0/24", true},
+		{"0.0.0.0/0", "fd00::/8", false},
+		{"::/0", "10.0.0.0/8", false},
+		{"fd00::/8", "fd00:1::/64", true},
+		{"fd00:1::/64", "fd00::/8", false},
+	} {
+		if covers := covers(parseNetwork(t, c.prefix), parseNetwork(t, c.network)); covers != c.covers {
+			t.Fatalf("%s covers %s: %v, want %v", c.prefix, c.network, covers, c.covers)
+		}
+	}
+}
+
+// test route filters by default routings, prefix lengths, denied and permitted prefixes
+func TestRouteFilterAllow(t *testing.T) {
+	filters := map[string]*RouteFilter{
+		"nil":          nil,
+		"empty":        {},
+		"deny default": {DenyDefault: true},
+		"max length":   {MaxLength: 24, MaxLength6: 64},
+		"permit":       {Permit: []string{"10.0.0.0/8", "fd00::/8"}},
+		"deny first":   {Permit: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}},
+	}
+	for name, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		if err := filter.parse(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	for _, c := range []struct {
+		filter  string
+		network string
+		allow   bool
+	}{
+		{"nil", "0.0.0.0/0", true},
+		{"empty", "0.0.0.0/0", true},
+		{"empty", "10.1.2.3/32", true},
+		{"deny default", "0.0.0.0/0", false},
+		{"deny default", "::/0", false},
+		{"deny default", "10.0.0.0/8", true},
+		{"max length", "10.1.2.0/24", true},
+		{"max length", "10.1.2.3/32", false},
+		{"max length", "fd00:1::/64", true},
+		{"max length", "fd00:1::1/128", false},
+		{"permit", "10.1.0.0/16", true},
+		{"permit", "fd00:1::/64", true},
+		{"permit", "192.168.0.0/16", false},
+		{"permit", "0.0.0.0/0", false},
+		{"deny first", "10.2.0.0/16", true},
+		{"deny first", "10.1.0.0/16", false},
+		{"deny first", "10.1.2.0/24", false},
+		{"deny first", "10.0.0.0/8", true},
+	} {
+		if allow := filters[c.filter].allow(parseNetwork(t, c.network)); allow != c.allow {
+			t.Fatalf("filter %s allows %s: %v, want %v", c.filter, c.network, allow, c.allow)
+		}
+	}
+}
+
+// test filters are looked up by the peer, then the wire type, then the default. the tunnel is never filtered
+func TestPolicyLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	data := `{
+		"default": {"import": {"max_length": 24}, "export": {"max_length": 16}},
+		"wires": {"wireguard": {"import": {"max_length": 20}}},
+		"peers": {"12D3KooWPeer": {"import": {"max_length": 32}}}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		endpoint string
+		// max length of the import and the export filter, -1 for no filter
+		importLength int
+		exportLength int
+	}{
+		{"ipfs/12D3KooWPeer", 32, 16},
+		{"ipfs/12D3KooWOther", 24, 16},
+		{"wireguard/wg0", 20, 16},
+		{"tun/goose0", -1, -1},
+	} {
+		p := newTestPort(c.endpoint)
+		for _, f := range []struct {
+			name   string
+			filter *RouteFilter
+			length int
+		}{
+			{"import", policy.importFilter(p), c.importLength},
+			{"export", policy.exportFilter(p), c.exportLength},
+		} {
+			length := -1
+			if f.filter != nil {
+				length = f.filter.MaxLength
+			}
+			if length != f.length {
+				t.Fatalf("%s %s filter has max length %d, want %d", c.endpoint, f.name, length, f.length)
+			}
+		}
+	}
+	var empty *Policy
+	if empty.importFilter(newTestPort("ipfs/12D3KooWPeer")) != nil {
+		t.Fatal("nil policy has filters")
+	}
+}
+
+// test invalid policies are rejected
+func TestLoadPolicyInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"default": {"import": {"permit": ["10.0.0.0"]}}}`,
+		`{"peers": {"12D3KooWPeer": {"export": {"deny": ["fd00::/129"]}}}}`,
+		`{"default": []}`,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicy(path); err == nil {
+			t.Fatalf("invalid policy %s loaded", data)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package routing
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+const (
+	// traffic directions of a port, in is received from the peer, out is sent to the peer
+	directionIn  = 0
+	directionOut = 1
+
+	// rate limit modes
+	modeShape  = "shape"
+	modePolice = "police"
+
+	// default burst is the traffic of this time at the rate
+	defaultBurstTime = time.Millisecond * 100
+	// min burst, a full sized packet always fits
+	minBurst = 16 * 1024
+	// packets received from a peer are delayed at most this long by shaping, the others are dropped
+	maxShapeDelay = time.Millisecond * 200
+	// packets received from a peer waiting for shaping
+	shapeQueueSize = portBufferSize / 4
+)
+
+var (
+	// direction names for metrics
+	directionNames = [2]string{"in", "out"}
+
+	// rate units in bytes per second, bare numbers are bytes per second
+	rateUnits = map[string]float64{
+		"bit":  1.0 / 8,
+		"kbit": 1e3 / 8,
+		"mbit": 1e6 / 8,
+		"gbit": 1e9 / 8,
+		"bps":  1,
+		"kbps": 1e3,
+		"mbps": 1e6,
+		"gbps": 1e9,
+	}
+
+	// size units in bytes, bare numbers are bytes
+	sizeUnits = map[string]float64{
+		"b":  1,
+		"kb": 1 << 10,
+		"mb": 1 << 20,
+		"gb": 1 << 30,
+	}
+)
+
+// rate limit of one direction
+type RateLimit struct {
+	// eg. 10mbit, 512kbit, 2mbps. 0 for no limit
+	Rate string `json:"rate"`
+	// eg. 64kb, 1mb. defaults to 100ms of traffic at the rate
+	Burst string `json:"burst,omitempty"`
+	// police drops packets over the rate, shape delays them. defaults to shape
+	Mode string `json:"mode,omitempty"`
+
+	// parsed rate in bytes per second and burst in bytes
+	rate  float64
+	burst int
+}
+
+// rate limits of a peer, by direction
+type PeerRateLimit struct {
+	// traffic received from the peer
+	In *RateLimit `json:"in,omitempty"`
+	// traffic sent to the peer
+	Out *RateLimit `json:"out,omitempty"`
+}
+
+// rate limits. the peer's limits are used first, then the wire type's, then the default.
+// ports of the same peer share the limits
+//
+//	{
+//	  "default": {"in": {"rate": "10mbit"}, "out": {"rate": "10mbit"}},
+//	  "wires": {"wireguard": {"out": {"rate": "2mbit", "mode": "police"}}},
+//	  "peers": {"12D3KooW...": {"in": {"rate": "0"}, "out": {"rate": "100mbit", "burst": "256kb"}}}
+//	}
+type RateLimits struct {
+	// default limits
+	Default PeerRateLimit `json:"default"`
+	// limits by wire type, eg. ipfs, wireguard
+	Wires map[string]PeerRateLimit `json:"wires,omitempty"`
+	// limits by peer id
+	Peers map[string]PeerRateLimit `json:"peers,omitempty"`
+}
+
+// load rate limits from a json file
+func LoadRateLimits(path string) (*RateLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	limits := &RateLimits{}
+	if err := json.Unmarshal(data, limits); err != nil {
+		return nil, errors.Wrapf(err, "invalid rate limits %s", path)
+	}
+	peers := []PeerRateLimit{limits.Default}
+	for _, p := range limits.Wires {
+		peers = append(peers, p)
+	}
+	for _, p := range limits.Peers {
+		peers = append(peers, p)
+	}
+	for _, p := range peers {
+		for _, limit := range []*RateLimit{p.In, p.Out} {
+			if limit == nil {
+				continue
+			}
+			if err := limit.parse(); err != nil {
+				return nil, errors.Wrapf(err, "invalid rate limits %s", path)
+			}
+		}
+	}
+	return limits, nil
+}
+
+func (l *RateLimit) parse() error {
+	rate, err := parseUnit(l.Rate, rateUnits)
+	if err != nil {
+		return errors.Wrapf(err, "rate %s", l.Rate)
+	}
+	l.rate = rate
+	l.burst = max(int(rate*defaultBurstTime.Seconds()), minBurst)
+	if l.Burst != "" {
+		burst, err := parseUnit(l.Burst, sizeUnits)
+		if err != nil {
+			return errors.Wrapf(err, "burst %s", l.Burst)
+		}
+		if burst < minBurst {
+			return errors.Errorf("burst %s is less than %d bytes", l.Burst, minBurst)
+		}
+		l.burst = int(burst)
+	}
+	switch l.Mode {
+	case "":
+		l.Mode = modeShape
+	case modeShape, modePolice:
+	default:
+		return errors.Errorf("unknown mode %s", l.Mode)
+	}
+	return nil
+}
+
+// parse a number with an optional unit, eg. 10mbit
+func parseUnit(s string, units map[string]float64) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	// longest unit first, so kbit is not taken as bit
+	suffixes := make([]string, 0, len(units))
+	for suffix := range units {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool {
+		return len(suffixes[i]) > len(suffixes[j])
+	})
+	scale := 1.0
+	for _, suffix := range suffixes {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			s, scale = number, units[suffix]
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if value < 0 {
+		return 0, errors.Errorf("negative value")
+	}
+	return value * scale, nil
+}
+
+// limits of the port, most specific first
+func (limits *RateLimits) lookup(p *Port) []PeerRateLimit {
+	peers := []PeerRateLimit{}
+	if peer, ok := limits.Peers[p.PeerID()]; ok {
+		peers = append(peers, peer)
+	}
+	protocol := strings.Split(p.w.Endpoint(), "/")[0]
+	if wire, ok := limits.Wires[protocol]; ok {
+		peers = append(peers, wire)
+	}
+	return append(peers, limits.Default)
+}
+
+// limiters of the port, nil if it's not limited. the tunnel port is not limited
+func (limits *RateLimits) limiter(p *Port) *portLimiter {
+	if limits == nil || p.IsTunnel() {
+		return nil
+	}
+	limiter := &portLimiter{}
+	for dir := range limiter.shapers {
+		for _, peer := range limits.lookup(p) {
+			limit := [2]*RateLimit{peer.In, peer.Out}[dir]
+			if limit == nil {
+				continue
+			}
+			// a zero rate overrides the less specific limits
+			if limit.rate > 0 {
+				limiter.shapers[dir] = &shaper{
+					bucket: utils.NewTokenBucket(limit.rate, limit.burst),
+					police: limit.Mode == modePolice,
+				}
+			}
+			break
+		}
+	}
+	if limiter.shapers[directionIn] == nil && limiter.shapers[directionOut] == nil {
+		return nil
+	}
+	return limiter
+}
+
+// token bucket of a direction
+type shaper struct {
+	bucket *utils.TokenBucket
+	// drop packets over the rate instead of delaying them
+	police bool
+}
+
+// rate limiters of a peer's ports, by direction
+type portLimiter struct {
+	shapers [2]*shaper
+}
+
+// shaper of the direction, nil if the direction is not limited
+func (l *portLimiter) shaper(dir int) *shaper {
+	if l == nil {
+		return nil
+	}
+	return l.shapers[dir]
+}
+
+// set the port's limiters, shared with the other ports of the peer. must be called with the lock held
+func (r *Router) applyRateLimit(p *Port) {
+	key := p.peerKey()
+	for other := range r.portStats {
+		if other != p && other.peerKey() == key {
+			p.limiter.Store(other.limiter.Load())
+			return
+		}
+	}
+	p.limiter.Store(r.rateLimits.limiter(p))
+}
+
+// reload the rate limits file, the new limits are applied to all ports with fresh buckets
+func (r *Router) reloadRateLimits() error {
+	limits, err := LoadRateLimits(r.rateLimitFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rateLimits = limits
+
+	limiters := map[string]*portLimiter{}
+	for p := range r.portStats {
+		key := p.peerKey()
+		limiter, ok := limiters[key]
+		if !ok {
+			limiter = limits.limiter(p)
+			limiters[key] = limiter
+		}
+		p.limiter.Store(limiter)
+	}
+	logger.Printf("rate limits reloaded from %s", r.rateLimitFile)
+	return nil
+}
+
+// a packet received from the peer, delayed by shaping
+type shapedPacket struct {
+	packet message.Packet
+	// output port
+	target *Port
+	// time it conforms to the rate
+	due time.Time
+}
+
+// police or shape a packet received from the peer, returns the delay of a shaped packet and false if it's dropped.
+// packets delayed longer than the max shape delay are dropped, so the peer is slowed down like by a full queue
+func (p *Port) limitInput(packet *message.Packet) (time.Duration, bool) {
+	s := p.limiter.Load().shaper(directionIn)
+	if s == nil {
+		return 0, true
+	}
+	if s.police {
+		if s.bucket.AllowN(len(packet.Data)) {
+			return 0, true
+		}
+		atomic.AddInt64(&p.policed[directionIn], 1)
+		return 0, false
+	}
+	delay, ok := s.bucket.ReserveWithin(len(packet.Data), maxShapeDelay)
+	if !ok {
+		atomic.AddInt64(&p.policed[directionIn], 1)
+		return 0, false
+	}
+	if delay > 0 {
+		atomic.AddInt64(&p.shaped[directionIn], 1)
+	}
+	return delay, true
+}
+
+// queue a shaped packet received from the peer, it's sent to the target when it conforms to the rate.
+// the input is never blocked, packets are dropped when the queue is full
+func (p *Port) delayInput(target *Port, packet *message.Packet, delay time.Duration) {
+	p.shapeOnce.Do(func() {
+		p.shapeQueue = make(chan shapedPacket, shapeQueueSize)
+		go p.handleShapedInput()
+	})
+	select {
+	case p.shapeQueue <- shapedPacket{packet: *packet, target: target, due: time.Now().Add(delay)}:
+	default:
+		atomic.AddInt64(&p.policed[directionIn], 1)
+	}
+}
+
+// send the shaped packets received from the peer in order, when they are due
+func (p *Port) handleShapedInput() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case shaped := <-p.shapeQueue:
+			if wait := time.Until(shaped.due); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-p.ctx.Done():
+					return
+				}
+			}
+			if !shaped.target.IsClosed() {
+				shaped.target.writeOutput(&shaped.packet, p)
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// police a packet sent to the peer, returns false if it's dropped. shaped packets are delayed in the output
+func (p *Port) policeOutput(packet *message.Packet) bool {
+	s := p.limiter.Load().shaper(directionOut)
+	if s == nil || !s.police {
+		return true
+	}
+	if s.bucket.AllowN(len(packet.Data)) {
+		return true
+	}
+	atomic.AddInt64(&p.policed[directionOut], 1)
+	return false
+}
+
+// wait until the packet sent to the peer conforms to the rate. routing messages are not delayed
+func (p *Port) shapeOutput(packet *message.Packet) error {
+	s := p.limiter.Load().shaper(directionOut)
+	if s == nil || s.police {
+		return nil
+	}
+	delay := s.bucket.ReserveN(len(packet.Data))
+	if delay <= 0 {
+		return nil
+	}
+	atomic.AddInt64(&p.shaped[directionOut], 1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case routings := <-p.announce:
+			if err := p.sendRouting(routings); err != nil {
+				return err
+			}
+		case <-p.ctx.Done():
+			return errors.Errorf("port(%s) closed", p.w.Endpoint())
+		}
+	}
+}
+
+// packets delayed by rate shaping, both directions
+func (p *Port) Shaped() int64 {
+	return atomic.LoadInt64(&p.shaped[directionIn]) + atomic.LoadInt64(&p.shaped[directionOut])
+}
+
+// packets dropped by rate limiting, both directions
+func (p *Port) Policed() int64 {
+	return atomic.LoadInt64(&p.policed[directionIn]) + atomic.LoadInt64(&p.policed[directionOut])
+}
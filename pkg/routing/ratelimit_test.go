@@ -0,0 +1,79 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+// test rates and sizes with and without units
+func TestParseUnit(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		units map[string]float64
+		value float64
+		ok    bool
+	}{
+		{"1000", rateUnits, 1000, true},
+		{"8bit", rateUnits, 1, true},
+		{"10mbit", rateUnits, 1.25e6, true},
+		{"512kbit", rateUnits, 64e3, true},
+		{"1gbit", rateUnits, 1.25e8, true},
+		{"2mbps", rateUnits, 2e6, true},
+		{" 10 MBit ", rateUnits, 1.25e6, true},
+		{"0", rateUnits, 0, true},
+		{"0.5kbps", rateUnits, 500, true},
+		{"64kb", sizeUnits, 64 * 1024, true},
+		{"1mb", sizeUnits, 1 << 20, true},
+		{"100b", sizeUnits, 100, true},
+		{"", rateUnits, 0, false},
+		{"mbit", rateUnits, 0, false},
+		{"10mbit/s", rateUnits, 0, false},
+		{"-1mbit", rateUnits, 0, false},
+		{"10kbit", sizeUnits, 0, false},
+	} {
+		value, err := parseUnit(c.s, c.units)
+		if (err == nil) != c.ok || value != c.value {
+			t.Fatalf("parse %q got %v %v, want %v ok %v", c.s, value, err, c.value, c.ok)
+		}
+	}
+}
+
+// test shaped input never blocks the writer, packets over the rate are delayed in order and the excess is dropped
+func TestShapedInput(t *testing.T) {
+	from := newTestPort("ipfs/in")
+	target := newTestPort("ipfs/out")
+	defer from.Close()
+	// 16 packets of the burst, then one every 100ms
+	from.limiter.Store(&portLimiter{shapers: [2]*shaper{directionIn: {bucket: utils.NewTokenBucket(10000, minBurst)}}})
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		target.WritePacket(&message.Packet{TTL: i, Data: make([]byte, 1000)}, from)
+	}
+	if elapsed := time.Since(start); elapsed > maxShapeDelay/2 {
+		t.Fatalf("shaped writes took %s", elapsed)
+	}
+	if n := target.queue.len(); n != 16 {
+		t.Fatalf("%d packets sent at once, want the 16 of the burst", n)
+	}
+	// 2 packets are delayed within the max delay, the others are dropped
+	if shaped, policed := from.shaped[directionIn], from.policed[directionIn]; shaped != 2 || policed != 12 {
+		t.Fatalf("%d packets shaped and %d dropped", shaped, policed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for target.queue.len() < 18 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i := 0; i < 18; i++ {
+		packet, ok := target.queue.dequeue()
+		if !ok {
+			t.Fatalf("delayed packet %d not sent", i)
+		}
+		if packet.TTL != i {
+			t.Fatalf("packet %d sent as %d", packet.TTL, i)
+		}
+	}
+}
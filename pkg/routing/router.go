@@ -5,29 +5,35 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/routing/discovery"
 	"github.com/nickjfree/goose/pkg/routing/fakeip"
+	"github.com/nickjfree/goose/pkg/routing/fib"
+	"github.com/nickjfree/goose/pkg/utils"
 	"github.com/nickjfree/goose/pkg/wire/filters"
+	"github.com/nickjfree/goose/pkg/wire/ipfs"
 	"github.com/pkg/errors"
 	"github.com/yl2chen/cidranger"
 )
 
 const (
-	// idle timeout
-	idleTimeout = time.Second * 300
-	// routing interval
-	routingInterval = time.Second * 30
-	// routing entry expire time
-	routingExpire = time.Second * 180
+	// min interval between triggered updates
+	triggeredInterval = time.Second * 2
 	// default routing
 	defaultRouting = "0.0.0.0/0"
 )
 
+var (
+	// all ipv4 and ipv6 networks
+	allNetworks = []net.IPNet{*cidranger.AllIPv4, *cidranger.AllIPv6}
+)
+
 // routing entry
 type routingEntry struct {
 	// network
@@ -42,6 +48,20 @@ type routingEntry struct {
 	origin string
 	// name
 	name string
+	// origin's public key
+	publicKey []byte
+	// origin's signature
+	signature []byte
+	// origin's seqno
+	seqno uint16
+	// anycast network
+	anycast bool
+	// restored from the saved state, not announced to peers until it's confirmed
+	provisional bool
+	// near equal cost paths, excluding the selected one
+	paths []routingEntry
+	// feasible backup paths, promoted when the selected one is removed
+	backups []routingEntry
 	// last updated
 	updatedAt time.Time
 }
@@ -54,6 +74,28 @@ func (entry *routingEntry) String() string {
 	return fmt.Sprintf("%s -> %s metric %d %s(%s) rtt %dms", entry.network.String(), entry.port, entry.metric%10, entry.origin, entry.name, entry.rtt)
 }
 
+// routing entry announced to peers
+func (entry *routingEntry) announcement() message.RoutingEntry {
+	return message.RoutingEntry{
+		Network:   entry.network,
+		Metric:    entry.metric,
+		Rtt:       entry.rtt,
+		Origin:    entry.origin,
+		Name:      entry.name,
+		PublicKey: entry.publicKey,
+		Signature: entry.signature,
+		Seqno:     entry.seqno,
+		Anycast:   entry.anycast,
+	}
+}
+
+// withdrawal of the routing entry
+func (entry *routingEntry) withdrawal() message.RoutingEntry {
+	withdrawal := entry.announcement()
+	withdrawal.Metric = message.MetricInfinity
+	return withdrawal
+}
+
 func (entry *routingEntry) Name() string {
 	if entry.name != "" {
 		return entry.name
@@ -61,10 +103,16 @@ func (entry *routingEntry) Name() string {
 	return entry.origin
 }
 
+// withdrawn routing entry
+type withdrawnEntry struct {
+	// entry
+	entry routingEntry
+	// port the entry was routed to
+	from *Port
+}
+
 type portState struct {
 	updatedAt time.Time
-	// routing entries
-	routings []routingEntry
 }
 
 // router
@@ -81,43 +129,174 @@ type Router struct {
 	portStats map[*Port]portState
 	// forward networks
 	forwardCIDRs []string
+	// tunnel addresses, ipv4 and an optional ipv6
+	addresses []net.IPNet
+	// networks of the tunnel addresses
+	tunnelNets []net.IPNet
 	// provided networks from local networks
 	localNets []net.IPNet
+	// anycast addresses served by this router
+	anycast []net.IPNet
 	// route table
 	routeTable cidranger.Ranger
+	// forwarding table of the data plane, published when routes change
+	forwardingTable atomic.Pointer[fib.Table[*routingEntry]]
+	// forwarding state changed since the last published table, read without the lock by the data plane
+	forwardingDirty atomic.Bool
+	// signaled when the forwarding state changes
+	publishing chan struct{}
 	// max metric allowed
 	maxMetric int
+	// route cost weights
+	cost CostWeights
+	// max equal cost paths of a network
+	maxPaths int
+	// route policy
+	policy *Policy
+	// route policy file
+	policyFile string
+	// per-peer rate limits
+	rateLimits *RateLimits
+	// rate limits file
+	rateLimitFile string
+	// packet filter of peer ports
+	firewall *filters.Firewall
 	// fake ip manager
 	fakeIP *fakeip.FakeIPManager
+	// flap penalties of networks
+	networkFlaps map[string]*flapState
+	// flap penalties of endpoints
+	endpointFlaps map[string]*flapState
+	// prefix advertiser and owner finder, nil if discovery is disabled
+	prefixFinder *discovery.PrefixFinder
+	// recent lookups of unrouted destinations
+	lookups map[string]time.Time
+	// lookups in progress
+	lookupSlots chan struct{}
+	// icmp error rate limiter
+	icmpLimiter *utils.TokenBucket
+	// admin api unix socket
+	adminSocket string
+	// prometheus metrics address
+	metricsAddr string
+	// accept unsigned host routings from legacy peers
+	allowUnsigned bool
+	// origin announcement signer
+	signer *originSigner
+	// origin signature verifier
+	verifier *originVerifier
+	// networks with best path changed, pending triggered updates
+	changed map[string]net.IPNet
+	// withdrawn entries pending to be sent
+	withdrawn []withdrawnEntry
+	// route requests pending to be sent
+	requests []routeRequest
+	// recently sent route requests
+	requested map[string]time.Time
+	// feasibility distances
+	sources map[string]source
+	// seqno of local routings
+	seqno uint16
+	// triggered update signal
+	triggered chan struct{}
+	// saved state file
+	statePath string
+	// recently connected endpoints
+	savedEndpoints map[string]savedEndpoint
+	// saved routings by endpoint, installed when the endpoint is connected again
+	provisional map[string][]savedRoute
+	// saved routings are not installed after this
+	provisionalUntil time.Time
+	// protocol timers
+	timers Timers
+	// unix nano time of the last topology change
+	changedAt int64
+	// discovery namespace
+	namespace string
+	// shutting down, no new ports are accepted
+	stopping bool
+	// nat rules are set up
+	nat  bool
+	nat6 bool
+	// close once
+	closeOnce sync.Once
 	// closed
 	closed chan struct{}
 }
 
+// localcidr is the ipv4 tunnel address, optionally followed by an ipv6 address. eg. 192.168.1.2/24,fd00::2/64
 func NewRouter(localcidr string, opts ...Option) *Router {
-	localNets := []net.IPNet{}
-	// ipaddress
-	address, _, err := net.ParseCIDR(localcidr)
+	addresses := []net.IPNet{}
+	tunnelNets := []net.IPNet{}
+	for _, cidr := range strings.Split(localcidr, ",") {
+		// ipaddress
+		address, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		// local ip/32 or ip/128
+		addresses = append(addresses, utils.HostNetwork(address))
+		tunnelNets = append(tunnelNets, *network)
+	}
+	// origin announcements are signed with the p2p host key
+	host := ipfs.GetP2PHost()
+	signer, err := newOriginSigner(host.Peerstore().PrivKey(host.ID()))
 	if err != nil {
 		logger.Fatal(err)
 	}
-	// local ip/32
-	localNets = append(localNets, net.IPNet{
-		IP:   address,
-		Mask: net.CIDRMask(32, 32),
-	})
 	r := &Router{
-		id:         uuid.New().String(),
-		portStats:  make(map[*Port]portState),
-		routeTable: cidranger.NewPCTrieRanger(),
-		localNets:  localNets,
-		closed:     make(chan struct{}),
+		id:             host.ID().String(),
+		portStats:      make(map[*Port]portState),
+		routeTable:     cidranger.NewPCTrieRanger(),
+		addresses:      addresses,
+		tunnelNets:     tunnelNets,
+		localNets:      []net.IPNet{},
+		cost:           DefaultCostWeights,
+		maxPaths:       1,
+		timers:         DefaultTimers,
+		signer:         signer,
+		verifier:       newOriginVerifier(),
+		changed:        make(map[string]net.IPNet),
+		requested:      make(map[string]time.Time),
+		sources:        make(map[string]source),
+		triggered:      make(chan struct{}, 1),
+		publishing:     make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+		icmpLimiter:    utils.NewTokenBucket(icmpRate, icmpBurst),
+		lookups:        make(map[string]time.Time),
+		networkFlaps:   make(map[string]*flapState),
+		endpointFlaps:  make(map[string]*flapState),
+		lookupSlots:    make(chan struct{}, maxLookups),
+		savedEndpoints: make(map[string]savedEndpoint),
+		provisional:    make(map[string][]savedRoute),
 	}
 	for _, opt := range opts {
 		if err := opt(r); err != nil {
 			logger.Fatal(err)
 		}
 	}
+	if r.namespace != "" {
+		r.enableDiscovery(r.namespace)
+	}
+	if r.statePath != "" {
+		r.enableState(r.statePath)
+	}
+	if c, ok := r.Connector.(*BaseConnector); ok {
+		go c.start()
+	}
 	go r.background()
+	go r.handleTriggered()
+	go r.handlePublish()
+	if r.adminSocket != "" {
+		go func() {
+			logger.Printf("admin api quit: %s", r.serveAdmin(r.adminSocket))
+		}()
+	}
+	if r.metricsAddr != "" {
+		go func() {
+			logger.Printf("metrics quit: %s", r.serveMetrics(r.metricsAddr))
+		}()
+	}
 	return r
 }
 
@@ -125,9 +304,14 @@ func (r *Router) RegisterPort(p *Port) error {
 	// handle the port
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	if r.stopping {
+		return errors.Errorf("router is shutting down, port(%s) rejected", p)
+	}
 	r.portStats[p] = portState{
 		updatedAt: time.Now(),
 	}
+	r.installProvisional(p, time.Now())
+	r.applyRateLimit(p)
 
 	// if fakeip is enabled, we wrap the tunnel with a filter
 	if r.fakeIP != nil && p.IsTunnel() {
@@ -135,6 +319,17 @@ func (r *Router) RegisterPort(p *Port) error {
 		filter.AddMiddleware(r.fakeIP)
 		p.w = filter
 	}
+	// filter traffics from peers, rules are keyed by the peer id or the wire type
+	if r.firewall != nil && !p.IsTunnel() {
+		filter := filters.WrapFilter(p.w)
+		keys := []string{}
+		if peer := p.PeerID(); peer != "" {
+			keys = append(keys, peer)
+		}
+		keys = append(keys, strings.Split(p.w.Endpoint(), "/")[0])
+		filter.AddMiddleware(r.firewall.Middleware(p.peerKey(), keys...))
+		p.w = filter
+	}
 
 	go func() {
 		logger.Printf("traffic quite for port(%s) %s", p, r.handleTraffic(p))
@@ -151,40 +346,27 @@ func (r *Router) RegisterPort(p *Port) error {
 // update single routing entry
 func (r *Router) updateEntry(myEntry, peerEntry *routingEntry) error {
 
-	// if a address with same ip but different origin is detected
-	mask, _ := peerEntry.network.Mask.Size()
-	if myEntry.origin != "" && peerEntry.origin != "" &&
+	// if a address with same ip but different origin is detected. anycast addresses have several origins
+	if myEntry.origin != "" && peerEntry.origin != "" && !(myEntry.anycast && peerEntry.anycast) &&
 		myEntry.port != peerEntry.port &&
-		myEntry.origin != peerEntry.origin && mask == 32 {
+		myEntry.origin != peerEntry.origin && utils.IsHostNetwork(peerEntry.network) {
 		return errors.Errorf("conflicting address %s", peerEntry.network.String())
 	}
 
-	// update routings for entries with smaller metric
-	if myEntry.metric > peerEntry.metric {
+	// feasible updates from the selected port are always accepted, the cost may grow.
+	// otherwise switch to a cheaper path, hysteresis prevents flapping
+	if myEntry.port == peerEntry.port || r.cost.better(myEntry, peerEntry) {
 		myEntry.port = peerEntry.port
 		myEntry.metric = peerEntry.metric
 		myEntry.rtt = peerEntry.rtt
 		myEntry.origin = peerEntry.origin
 		myEntry.name = peerEntry.name
+		myEntry.publicKey = peerEntry.publicKey
+		myEntry.signature = peerEntry.signature
+		myEntry.seqno = peerEntry.seqno
+		myEntry.anycast = peerEntry.anycast
 		myEntry.updatedAt = time.Now()
-		return nil
-	}
-	// same metric, select the one with smaller rtt
-	if myEntry.metric == peerEntry.metric {
-
-		if myEntry.port == peerEntry.port ||
-			(myEntry.port != peerEntry.port && peerEntry.port.Faster(myEntry.rtt-peerEntry.port.Rtt())) {
-			myEntry.port = peerEntry.port
-			myEntry.metric = peerEntry.metric
-			myEntry.rtt = peerEntry.rtt
-			myEntry.origin = peerEntry.origin
-			myEntry.name = peerEntry.name
-			myEntry.updatedAt = time.Now()
-		}
 	}
-
-	// TODO: metric + rtt
-
 	return nil
 }
 
@@ -194,7 +376,7 @@ func (r *Router) handleConflict(p *Port, routing message.Routing) error {
 
 	for _, entry := range routing.Routings {
 
-		target, err := r.FindDestPort(entry.Network.IP)
+		target, err := r.FindDestPort(entry.Network.IP, 0)
 		if err != nil {
 			return err
 		}
@@ -227,13 +409,59 @@ func (r *Router) UpdateRouting(p *Port, routing message.Routing) error {
 		}
 		return nil
 	}
+	// withdrawals and requests are not acked
+	if routing.Type == message.RoutingWithdraw {
+		return r.withdrawRouting(p, routing)
+	}
+	if routing.Type == message.RoutingRequest {
+		return r.handleRequest(p, routing)
+	}
+	// origin announcements must be signed by the origin
+	entries := []message.RoutingEntry{}
+	for _, entry := range routing.Routings {
+		// networks from local ports are originated by this router, signed later
+		if p.IsLocal() {
+			entries = append(entries, entry)
+			continue
+		}
+		// unsigned routings could hijack any network, they are only accepted from legacy peers if allowed
+		if entry.Origin == "" {
+			if !r.allowUnsigned {
+				logger.Printf("port(%s) rejected unsigned %s", p, entry.Network.String())
+				continue
+			}
+		} else if err := r.verifier.verify(&entry); err != nil {
+			logger.Printf("port(%s) rejected %s from origin %s: %s", p, entry.Network.String(), entry.Origin, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
 	// conflict entries to reply to peers
 	conflictEntries := []message.RoutingEntry{}
 	// log the peer provided networks
 	err := func() error {
 		r.lock.Lock()
 		defer r.lock.Unlock()
-		for _, entry := range routing.Routings {
+		filter := r.policy.importFilter(p)
+		for _, entry := range entries {
+			// routings denied by the import policy
+			if !filter.allow(entry.Network) {
+				myEntry, err := r.findEntry(entry.Network)
+				if err != nil {
+					return err
+				}
+				if myEntry != nil && myEntry.hasPath(p) {
+					if err := r.removePath(myEntry, p); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if p.IsLocal() && entry.Origin == "" {
+				if err := r.originate(&entry); err != nil {
+					return err
+				}
+			}
 			peerEntry := routingEntry{
 				network: entry.Network,
 				port:    p,
@@ -242,38 +470,86 @@ func (r *Router) UpdateRouting(p *Port, routing message.Routing) error {
 				rtt:       p.Rtt() + entry.Rtt,
 				origin:    entry.Origin,
 				name:      entry.Name,
+				publicKey: entry.PublicKey,
+				signature: entry.Signature,
+				seqno:     entry.Seqno,
+				anycast:   entry.Anycast,
 				updatedAt: time.Now(),
 			}
-			// routings reach max hops
-			if peerEntry.metric >= r.maxMetric {
-				continue
-			}
 			// find the same network
-			containing, err := r.routeTable.CoveredNetworks(peerEntry.network)
+			myEntry, err := r.findEntry(peerEntry.network)
 			if err != nil {
-				return errors.WithStack(err)
-			}
-			matched := false
-			for _, e := range containing {
-				if myEntry, ok := e.(*routingEntry); ok {
-					n := myEntry.Network()
-					// duplicated network
-					if n.String() == peerEntry.network.String() {
-						matched = true
-						// only update routings for entries with smaller metric
-						if err := r.updateEntry(myEntry, &peerEntry); err != nil {
-							conflictEntries = append(conflictEntries, entry)
-						}
-						break
+				return err
+			}
+			// restored routings are replaced by the first announcement of the network
+			if myEntry != nil && myEntry.provisional {
+				if err := r.removeProvisional(myEntry); err != nil {
+					return err
+				}
+				myEntry = nil
+			}
+			// unsigned routings are untrusted, they never replace signed ones
+			if myEntry != nil && myEntry.origin != "" && peerEntry.origin == "" {
+				continue
+			}
+			// routings reach max hops, or may form a loop
+			feasible := r.isFeasible(&entry)
+			if peerEntry.metric >= r.maxMetric || !feasible {
+				if myEntry == nil {
+					if !feasible {
+						r.requestSeqno(&entry)
+					}
+					continue
+				}
+				// the path is no longer usable, retract it
+				if err := r.removePath(myEntry, p); err != nil {
+					return err
+				}
+				continue
+			}
+			// flapping ports and networks are not used until they are stable
+			if r.isDampened(p, peerEntry.network, myEntry != nil, peerEntry.updatedAt) {
+				if myEntry != nil && myEntry.hasPath(p) {
+					if err := r.removePath(myEntry, p); err != nil {
+						return err
 					}
 				}
+				continue
 			}
-			// not matched, new routing info
-			if !matched {
+			// new routing info
+			if myEntry == nil {
 				if err := r.routeTable.Insert(&peerEntry); err != nil {
 					return errors.WithStack(err)
 				}
+				r.forwardingChanged()
+				r.updateSource(&peerEntry)
+				r.changed[peerEntry.network.String()] = peerEntry.network
+				routeChanges.WithLabelValues(routeAdded).Inc()
+				continue
+			}
+			port, metric, seqno := myEntry.port, myEntry.metric, myEntry.seqno
+			previous := *myEntry
+			// only update routings for entries with smaller metric
+			if err := r.updateEntry(myEntry, &peerEntry); err != nil {
+				conflictEntries = append(conflictEntries, entry)
+				continue
 			}
+			if myEntry.port == p {
+				r.updateSource(myEntry)
+			}
+			// the replaced path and the peer's path may be near equal
+			r.updatePaths(myEntry, previous, peerEntry)
+			if myEntry.port != port {
+				r.forwardingChanged()
+			}
+			// best path changed
+			if myEntry.port != port || myEntry.metric != metric || myEntry.seqno != seqno {
+				r.changed[myEntry.network.String()] = myEntry.network
+				routeChanges.WithLabelValues(routeUpdated).Inc()
+			}
+		}
+		if len(r.changed) > 0 {
+			r.trigger()
 		}
 		if state, ok := r.portStats[p]; ok {
 			state.updatedAt = time.Now()
@@ -311,35 +587,11 @@ func (r *Router) UpdateRouting(p *Port, routing message.Routing) error {
 	return nil
 }
 
-// find dest port
-func (r *Router) FindDestPort(dst net.IP) (*Port, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
-	containingNetworks, err := r.routeTable.ContainingNetworks(dst)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	var targetEntry *routingEntry
-	maskLen := -1
-	for _, e := range containingNetworks {
-		if entry, ok := e.(*routingEntry); ok {
-			n, _ := entry.network.Mask.Size()
-			if n > maskLen {
-				targetEntry = entry
-				maskLen = n
-			}
-		}
-	}
-	if targetEntry != nil {
-		return targetEntry.port, nil
-	}
-	return nil, nil
-}
-
 // Close the router
 func (r *Router) Close() {
-	close(r.closed)
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
 }
 
 func (r *Router) Done() <-chan struct{} {
@@ -361,24 +613,31 @@ func (r *Router) handleTraffic(p *Port) error {
 			// check packet ttl
 			packet.TTL -= 1
 			if packet.TTL <= 0 {
+				r.sendTimeExceeded(&packet)
 				continue
 			}
 			// routing
-			target, err := r.FindDestPort(packet.Dst)
+			target, err := r.FindDestPort(packet.Dst, utils.FlowHash(packet.Data))
 			if err != nil {
 				return err
 			}
-			if target != nil {
-				if err := target.WritePacket(&packet); err != nil {
-					// target port too slow or dead. we should close it. or it will slowdown everyone
-					logger.Printf("error relaying packet to port(%s). it is too slow. close port: %s", target, err)
-					target.Close()
+			if target == nil {
+				// the tunnel's multicast and link local packets, eg. router solicitations, are dropped silently
+				if !routableDestination(packet.Dst) {
+					continue
 				}
-			} else {
-				// TODO: record not routed dst ip
-				// TODO: dst ip as peer discovery keys
-				// logger.Printf("Send packet %s, no destination\n", packet)
+				// find the owner, the following packets may be routed
+				r.lookupDestination(packet.Dst)
+				r.sendUnreachable(&packet)
+				continue
 			}
+			// forwarded packets take a hop, packets delivered to the tunnel don't
+			if !target.IsTunnel() && utils.DecrementTTL(packet.Data) <= 0 {
+				r.sendTimeExceeded(&packet)
+				continue
+			}
+			// a slow target drops packets, it's closed only by the liveness checks
+			target.WritePacket(&packet, p)
 		}
 	}
 }
@@ -386,22 +645,32 @@ func (r *Router) handleTraffic(p *Port) error {
 // annouce routings to peers
 func (r *Router) handleRouting(p *Port) error {
 	defer p.Close()
-	// annouce routing everty 10 seconds
-	ticker := time.NewTicker(routingInterval)
-	defer ticker.Stop()
+	// annouce routings periodically, the interval adapts to topology changes in adaptive mode
+	interval := r.timers.RoutingInterval
+	lastAnnounced := time.Now()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-r.closed:
 			return nil
-		case <-ticker.C:
+		case routing := <-p.updates:
+			// triggered updates
+			if err := p.AnnouceRouting(&routing); err != nil {
+				return err
+			}
+		case <-timer.C:
+			interval = r.nextInterval(interval, lastAnnounced)
+			lastAnnounced = time.Now()
+			timer.Reset(interval)
 			// check routing status
 			r.lock.Lock()
 			state, ok := r.portStats[p]
 			r.lock.Unlock()
 			if ok {
 				diff := time.Now().Sub(state.updatedAt)
-				if diff > idleTimeout {
+				if diff > r.timers.IdleTimeout {
 					return errors.Errorf("port(%s) idle closed", p)
 				}
 			} else {
@@ -425,24 +694,35 @@ func (r *Router) handleRouting(p *Port) error {
 					Type:     message.MessageTypeRouting,
 					Routings: []message.RoutingEntry{},
 				}
-				// the first localnet is the tunnel address
-				origin := r.id
-				name := r.name
-				r.localNets[0] = net.IPNet{
-					IP:   p.Address(),
-					Mask: net.CIDRMask(32, 32),
-				}
-				for _, network := range r.localNets {
+				// the first address is the ipv4 tunnel address, it may be changed by conflict resolving
+				r.lock.Lock()
+				r.addresses[0] = utils.HostNetwork(p.Address())
+				addresses := append([]net.IPNet{}, r.addresses...)
+				r.lock.Unlock()
+				for _, network := range addresses {
 					routing.Routings = append(routing.Routings, message.RoutingEntry{
 						Network: network,
-						// local net, metric is always
+						// local net, metric is always 0
 						Metric: 0,
 						Rtt:    0,
-						Origin: origin,
-						Name:   name,
+						Name:   r.name,
+					})
+				}
+				for _, network := range r.localNets {
+					routing.Routings = append(routing.Routings, message.RoutingEntry{
+						Network: network,
+						Metric:  0,
+						Rtt:     0,
+					})
+				}
+				// anycast addresses may be announced by other origins too
+				for _, network := range r.anycast {
+					routing.Routings = append(routing.Routings, message.RoutingEntry{
+						Network: network,
+						Metric:  0,
+						Rtt:     0,
+						Anycast: true,
 					})
-					origin = ""
-					name = ""
 				}
 				if err := r.UpdateRouting(p, routing); err != nil {
 					return err
@@ -460,44 +740,44 @@ func (r *Router) getRoutingsForPort(p *Port) ([]message.RoutingEntry, error) {
 	routings := []message.RoutingEntry{}
 
 	// send my routing tables to peer
-	all, err := r.routeTable.CoveredNetworks(*cidranger.AllIPv4)
+	all, err := r.allEntries()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	for _, e := range all {
-		if entry, ok := e.(*routingEntry); ok {
-			// split horizon
-			if entry.port == p {
-				continue
+	filter := r.policy.exportFilter(p)
+	for _, entry := range all {
+		// split horizon
+		if entry.port == p {
+			continue
+		}
+		// denied by the export policy
+		if !filter.allow(entry.network) {
+			continue
+		}
+		// not tunnel
+		if !p.IsTunnel() {
+			// restored routings are not confirmed yet
+			if !entry.provisional {
+				routings = append(routings, entry.announcement())
 			}
-			// not tunnel
-			if !p.IsTunnel() {
+			continue
+		}
+		// tunnel
+		// route none default traffics
+		if !utils.IsDefaultNetwork(entry.network) {
+			routings = append(routings, message.RoutingEntry{
+				Network: entry.network,
+				Metric:  entry.metric,
+				Rtt:     entry.rtt,
+			})
+		} else if r.fakeIP != nil && entry.network.String() == defaultRouting {
+			// if fakeip is enabled, route dns traffics to the tunnel
+			for _, network := range r.fakeIP.DNSRoutings() {
 				routings = append(routings, message.RoutingEntry{
-					Network: entry.network,
+					Network: network,
 					Metric:  entry.metric,
 					Rtt:     entry.rtt,
-					Origin:  entry.origin,
-					Name:    entry.name,
 				})
-				continue
-			}
-			// tunnel
-			// route none default traffics
-			if entry.network.String() != defaultRouting {
-				routings = append(routings, message.RoutingEntry{
-					Network: entry.network,
-					Metric:  entry.metric,
-					Rtt:     entry.rtt,
-				})
-			} else if r.fakeIP != nil {
-				// if fakeip is enabled, route dns traffics to the tunnel
-				for _, network := range r.fakeIP.DNSRoutings() {
-					routings = append(routings, message.RoutingEntry{
-						Network: network,
-						Metric:  entry.metric,
-						Rtt:     entry.rtt,
-					})
-				}
 			}
 		}
 	}
@@ -508,22 +788,200 @@ func (r *Router) clearRouting(p *Port) error {
 	// remove port routing
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	// both port goroutines clear the routings, the port flaps once
+	if _, ok := r.portStats[p]; ok {
+		r.flapPort(p, time.Now())
+	}
 	delete(r.portStats, p)
-	all, err := r.routeTable.CoveredNetworks(*cidranger.AllIPv4)
+	all, err := r.allEntries()
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	for _, e := range all {
-		if entry, ok := e.(*routingEntry); ok {
-			if entry.port == p {
-				// entry expired, remove the routing
-				if _, err := r.routeTable.Remove(entry.Network()); err != nil {
-					return errors.WithStack(err)
+	for _, entry := range all {
+		// port closed, remove the paths
+		if err := r.removePath(entry, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withdraw routings announced by the port
+func (r *Router) withdrawRouting(p *Port, routing message.Routing) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, withdrawal := range routing.Routings {
+		entry, err := r.findEntry(withdrawal.Network)
+		if err != nil {
+			return err
+		}
+		// only the paths through the port are withdrawn
+		if entry == nil || !entry.hasPath(p) {
+			continue
+		}
+		logger.Printf("port(%s) withdrew %s", p, entry.network.String())
+		if err := r.removePath(entry, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue a withdrawal for the removed entry. must be called with the lock held
+func (r *Router) withdraw(entry *routingEntry) {
+	r.withdrawn = append(r.withdrawn, withdrawnEntry{
+		entry: *entry,
+		from:  entry.port,
+	})
+	delete(r.changed, entry.network.String())
+	routeChanges.WithLabelValues(routeWithdrawn).Inc()
+	r.trigger()
+}
+
+// signal the triggered update handler
+func (r *Router) trigger() {
+	r.topologyChanged()
+	select {
+	case r.triggered <- struct{}{}:
+	default:
+	}
+}
+
+// find the entry of the exact network. must be called with the lock held
+func (r *Router) findEntry(network net.IPNet) (*routingEntry, error) {
+	covered, err := r.routeTable.CoveredNetworks(network)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, e := range covered {
+		if entry, ok := e.(*routingEntry); ok && entry.network.String() == network.String() {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// send withdrawals as soon as possible, and rate limited triggered updates
+func (r *Router) handleTriggered() {
+	timer := time.NewTimer(triggeredInterval)
+	defer timer.Stop()
+	// allowed to send updates
+	ready := false
+	for {
+		select {
+		case <-r.triggered:
+		case <-timer.C:
+			ready = true
+		case <-r.closed:
+			return
+		}
+		sent, err := r.sendTriggered(ready)
+		if err != nil {
+			logger.Printf("send triggered updates failed with: %s", err)
+		}
+		if sent {
+			ready = false
+			timer.Reset(triggeredInterval)
+		}
+	}
+}
+
+// send pending withdrawals and requests, and changed routings if withUpdates is set. returns true if updates are sent
+func (r *Router) sendTriggered(withUpdates bool) (bool, error) {
+	r.lock.Lock()
+	withdrawn := r.withdrawn
+	r.withdrawn = nil
+	requests := r.requests
+	r.requests = nil
+	changed := []routingEntry{}
+	sendUpdates := withUpdates && len(r.changed) > 0
+	if sendUpdates {
+		for _, network := range r.changed {
+			entry, err := r.findEntry(network)
+			if err != nil {
+				r.lock.Unlock()
+				return false, err
+			}
+			if entry != nil {
+				changed = append(changed, *entry)
+			}
+		}
+		r.changed = make(map[string]net.IPNet)
+	}
+	ports := make([]*Port, 0, len(r.portStats))
+	filters := make(map[*Port]*RouteFilter)
+	for p := range r.portStats {
+		ports = append(ports, p)
+		filters[p] = r.policy.exportFilter(p)
+	}
+	r.lock.Unlock()
+
+	if len(withdrawn) == 0 && len(requests) == 0 && !sendUpdates {
+		return false, nil
+	}
+	for _, p := range ports {
+		msgs := []message.Routing{}
+		if p.IsTunnel() {
+			if len(withdrawn) == 0 && !sendUpdates {
+				continue
+			}
+			// tunnel port always takes the full routing table
+			routings, err := r.getRoutingsForPort(p)
+			if err != nil {
+				return sendUpdates, err
+			}
+			msgs = append(msgs, message.Routing{Routings: routings})
+		} else if !p.IsLocal() {
+			withdrawals := []message.RoutingEntry{}
+			for _, w := range withdrawn {
+				if w.from != p {
+					withdrawals = append(withdrawals, w.entry.withdrawal())
 				}
 			}
+			updates := []message.RoutingEntry{}
+			for _, entry := range changed {
+				if entry.provisional {
+					continue
+				}
+				if entry.port == p {
+					// poison reverse, the peer must not route it back to us
+					withdrawals = append(withdrawals, entry.withdrawal())
+				} else if filters[p].allow(entry.network) {
+					updates = append(updates, entry.announcement())
+				}
+			}
+			if len(withdrawals) > 0 {
+				msgs = append(msgs, message.Routing{
+					Type:     message.RoutingWithdraw,
+					Routings: withdrawals,
+					Message:  "withdraw",
+				})
+			}
+			if len(updates) > 0 {
+				msgs = append(msgs, message.Routing{Routings: updates})
+			}
+			seqnoRequests := []message.RoutingEntry{}
+			for _, request := range requests {
+				if request.from != p && (request.to == nil || request.to == p) {
+					seqnoRequests = append(seqnoRequests, request.entry)
+				}
+			}
+			if len(seqnoRequests) > 0 {
+				msgs = append(msgs, message.Routing{
+					Type:     message.RoutingRequest,
+					Routings: seqnoRequests,
+					Message:  "request",
+				})
+			}
+		}
+		for i := range msgs {
+			if !p.TriggerRouting(&msgs[i]) {
+				logger.Printf("port(%s) is busy, triggered update dropped", p)
+			}
 		}
 	}
-	return nil
+	return sendUpdates, nil
 }
 
 // refresh routing tables
@@ -533,35 +991,47 @@ func (r *Router) refreshRoutings() error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	all, err := r.routeTable.CoveredNetworks(*cidranger.AllIPv4)
+	all, err := r.allEntries()
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
+	r.expireSources(now)
+	r.expireFlaps(now)
+	// path rtts changed since the last table
+	r.forwardingChanged()
 
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"Network", "Port", "Metric", "RTT", "Name"})
-	for _, e := range all {
-		if entry, ok := e.(*routingEntry); ok {
-			t.AppendRow(table.Row{
-				entry.network.String(),
-				entry.port.String(),
-				entry.metric,
-				fmt.Sprintf("%d ms", entry.rtt),
-				entry.Name(),
-			})
-			if now.Sub(entry.updatedAt) > routingExpire {
-				// entry expired, remove the routing
-				if _, err := r.routeTable.Remove(entry.Network()); err != nil {
-					return errors.WithStack(err)
-				}
-			} else {
-				// update dns names for peers
-				if r.fakeIP != nil {
-					if mask, _ := entry.network.Mask.Size(); mask == 32 {
-						if name := entry.Name(); name != "" {
-							r.fakeIP.SetNameRecord(entry.Name(), entry.Network().IP)
-						}
+	t.AppendHeader(table.Row{"Network", "Port", "Metric", "RTT", "Cost", "Paths", "Penalty", "Name"})
+	for _, entry := range all {
+		t.AppendRow(table.Row{
+			entry.network.String(),
+			entry.port.String(),
+			entry.metric,
+			fmt.Sprintf("%d ms", entry.rtt),
+			fmt.Sprintf("%.0f", r.cost.cost(entry)),
+			fmt.Sprintf("%d+%d", len(entry.paths)+1, len(entry.backups)),
+			r.penalty(entry.network),
+			entry.Name(),
+		})
+		// drop expired paths
+		r.updatePaths(entry)
+		expire := r.timers.RoutingExpire
+		if entry.provisional {
+			expire = provisionalExpire
+		}
+		if now.Sub(entry.updatedAt) > expire {
+			// entry expired, remove the routing
+			if err := r.removePath(entry, entry.port); err != nil {
+				return err
+			}
+		} else {
+			// update dns names for peers
+			if r.fakeIP != nil {
+				// dns names are ipv4 only, anycast addresses have no name
+				if entry.network.IP.To4() != nil && utils.IsHostNetwork(entry.network) && !entry.anycast {
+					if name := entry.Name(); name != "" {
+						r.fakeIP.SetNameRecord(entry.Name(), entry.Network().IP)
 					}
 				}
 			}
@@ -571,11 +1041,28 @@ func (r *Router) refreshRoutings() error {
 	return nil
 }
 
+// all routing entries, ipv4 and ipv6. must be called with the lock held
+func (r *Router) allEntries() ([]*routingEntry, error) {
+	entries := []*routingEntry{}
+	for _, network := range allNetworks {
+		all, err := r.routeTable.CoveredNetworks(network)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, e := range all {
+			if entry, ok := e.(*routingEntry); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
 // do background works
 // refresh routing table
 func (r *Router) background() {
 
-	ticker := time.NewTicker(routingInterval)
+	ticker := time.NewTicker(r.timers.RoutingInterval)
 	defer ticker.Stop()
 
 	for {
@@ -0,0 +1,176 @@
+package routing
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/yl2chen/cidranger"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+	"github.com/nickjfree/goose/pkg/wire"
+)
+
+const (
+	// max metric of test routers, as the goose command
+	testMaxMetric = 16
+)
+
+// wire of test ports, it sends nothing
+type testWire struct {
+	wire.BaseWire
+	endpoint string
+}
+
+func (w *testWire) Endpoint() string {
+	return w.endpoint
+}
+
+// a port without the output goroutine, its packets stay queued and its announcements are buffered
+func newTestPort(endpoint string) *Port {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Port{
+		w:        &testWire{endpoint: endpoint},
+		queue:    newScheduler(portBufferSize),
+		announce: make(chan message.Routing, 64),
+		updates:  make(chan message.Routing, portUpdateBuffer),
+		closeFunc: func() error {
+			cancel()
+			return nil
+		},
+		ctx:      ctx,
+		priority: utils.NewTokenBucket(peerPriorityRate, peerPriorityBurst),
+		hash:     utils.StringHash(endpoint),
+		id:       lastPortID.Add(1),
+		done:     make(chan struct{}),
+	}
+}
+
+// a node's identity, it signs the networks it originates
+type testOrigin struct {
+	id     string
+	signer *originSigner
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newOriginSigner(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testOrigin{id: id.String(), signer: signer}
+}
+
+// signed announcement of the network
+func (o *testOrigin) announce(t *testing.T, cidr string, metric int, seqno uint16) message.RoutingEntry {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := message.RoutingEntry{Network: *network, Metric: metric, Origin: o.id, Seqno: seqno}
+	if err := o.signer.sign(&entry); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// a router without the p2p host and the background goroutines
+func newTestRouter(t *testing.T) *Router {
+	origin := newTestOrigin(t)
+	return &Router{
+		id:             origin.id,
+		portStats:      make(map[*Port]portState),
+		routeTable:     cidranger.NewPCTrieRanger(),
+		maxMetric:      testMaxMetric,
+		cost:           DefaultCostWeights,
+		maxPaths:       1,
+		timers:         DefaultTimers,
+		signer:         origin.signer,
+		verifier:       newOriginVerifier(),
+		changed:        make(map[string]net.IPNet),
+		requested:      make(map[string]time.Time),
+		sources:        make(map[string]source),
+		triggered:      make(chan struct{}, 1),
+		publishing:     make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+		icmpLimiter:    utils.NewTokenBucket(icmpRate, icmpBurst),
+		lookups:        make(map[string]time.Time),
+		networkFlaps:   make(map[string]*flapState),
+		endpointFlaps:  make(map[string]*flapState),
+		lookupSlots:    make(chan struct{}, maxLookups),
+		savedEndpoints: make(map[string]savedEndpoint),
+		provisional:    make(map[string][]savedRoute),
+	}
+}
+
+// connect a test port to the router
+func (r *Router) addTestPort(endpoint string) *Port {
+	p := newTestPort(endpoint)
+	p.router = r
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.portStats[p] = portState{updatedAt: time.Now()}
+	return p
+}
+
+// the routing entry of the network, nil if it's not routed
+func (r *Router) testEntry(t *testing.T, cidr string) *routingEntry {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, err := r.findEntry(*network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// announce the entries from the port
+func (r *Router) testUpdate(t *testing.T, p *Port, entries ...message.RoutingEntry) {
+	if err := r.UpdateRouting(p, message.Routing{Routings: entries}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// test routings reaching the max metric are not installed, and the max metric must stay below the packet ttl
+func TestMaxMetric(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	p := r.addTestPort("ipfs/peer")
+
+	r.testUpdate(t, p, origin.announce(t, "10.1.0.0/16", testMaxMetric-1, 1), origin.announce(t, "10.2.0.0/16", testMaxMetric-2, 1))
+	if r.testEntry(t, "10.1.0.0/16") != nil {
+		t.Fatal("routing at the max metric installed")
+	}
+	if entry := r.testEntry(t, "10.2.0.0/16"); entry == nil || entry.metric != testMaxMetric-1 {
+		t.Fatalf("routing below the max metric not installed: %+v", entry)
+	}
+	for _, c := range []struct {
+		metric int
+		ok     bool
+	}{
+		{0, false},
+		{1, true},
+		{testMaxMetric, true},
+		{message.PacketTTL - 1, true},
+		{message.PacketTTL, false},
+	} {
+		if err := WithMaxMetric(c.metric)(&Router{}); (err == nil) != c.ok {
+			t.Fatalf("max metric %d: error %v, want ok %v", c.metric, err, c.ok)
+		}
+	}
+}
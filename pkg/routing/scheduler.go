@@ -0,0 +1,344 @@
+package routing
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+const (
+	// traffic classes, served in strict priority
+	classControl     = 0
+	classInteractive = 1
+	classDefault     = 2
+	classBulk        = 3
+	numClasses       = 4
+
+	// bytes an input port may send in each drr round
+	drrQuantum = 1500
+	// packets of an input port queued at a port, so a heavy peer can't fill the whole queue
+	portInputLimit = portBufferSize / 4
+
+	// codel, packets queued longer than the target for an interval start to be dropped
+	codelTarget   = time.Millisecond * 5
+	codelInterval = time.Millisecond * 100
+	// a queue holding less than a full sized packet is never dropped from
+	codelMinBytes = 1500
+	// the codel state of an input is kept while it's idle for less than this, so a bursty input
+	// resumes at its last drop rate. the same window codel uses to reuse the last drop count
+	codelIdleTimeout = 16 * codelInterval
+
+	// priority traffic accepted from a peer in bytes per second, and its burst. the excess is served as default traffic
+	peerPriorityRate  = 1 << 20
+	peerPriorityBurst = 64 * 1024
+)
+
+var (
+	// class names for metrics
+	classNames = [numClasses]string{"control", "interactive", "default", "bulk"}
+)
+
+// traffic class of the packet by its dscp
+func classify(data []byte) int {
+	switch dscp := utils.DSCP(data); {
+	// cs6 and cs7, network control
+	case dscp >= 48:
+		return classControl
+	// cs4, af4x, cs5 and ef, real time and interactive traffic
+	case dscp >= 32:
+		return classInteractive
+	// cs1 and le, lower effort
+	case dscp == 8 || dscp == 1:
+		return classBulk
+	}
+	return classDefault
+}
+
+// traffic class of the packet from the input port. the dscp of traffic originated by this node is trusted.
+// peers can't claim network control, and their priority traffic over the peer priority rate is served as default
+func trafficClass(data []byte, from *Port) int {
+	class := classify(data)
+	if from == nil || from.IsTunnel() || class == classDefault || class == classBulk {
+		return class
+	}
+	if from.priority.AllowN(len(data)) {
+		return classInteractive
+	}
+	return classDefault
+}
+
+// a queued packet
+type queuedPacket struct {
+	packet     message.Packet
+	enqueuedAt time.Time
+}
+
+// packets queued from an input port, a flow of the fair queue with its own codel state
+type inputQueue struct {
+	// input port, nil for packets generated by the router
+	from *Port
+	// queued packets
+	packets []queuedPacket
+	// queued bytes
+	bytes int
+	// drr deficit in bytes
+	deficit int
+	// codel, the sojourn time is above the target until this time
+	firstAbove time.Time
+	// codel, dropping packets
+	dropping bool
+	// codel, time of the next drop
+	dropNext time.Time
+	// codel, drops since entering the dropping state, and at the last entering
+	count     int
+	lastCount int
+	// when the queue became empty
+	idleSince time.Time
+}
+
+// packets of a traffic class, input ports take turns by deficit round robin
+type classQueue struct {
+	// queues by input port, empty queues are kept for their codel state until they expire
+	inputs map[*Port]*inputQueue
+	// input queues with packets, in round robin order
+	active []*inputQueue
+}
+
+// output queue of a port. control traffic goes first, then the dscp classes in priority,
+// input ports share each class fairly. packets are dropped by codel when they stay queued too long,
+// and from the longest input queue when the queue is full, so writers never wait
+type scheduler struct {
+	lock sync.Mutex
+	// queues by class
+	classes [numClasses]classQueue
+	// queued packets
+	size int
+	// max queued packets
+	capacity int
+	// signaled when packets are queued
+	ready chan struct{}
+	// packets dropped for a full queue
+	overflow int64
+	// packets dropped by codel
+	expired int64
+	// last time idle input queues were expired
+	lastExpire time.Time
+}
+
+func newScheduler(capacity int) *scheduler {
+	s := &scheduler{
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+	}
+	for i := range s.classes {
+		s.classes[i].inputs = make(map[*Port]*inputQueue)
+	}
+	return s
+}
+
+// queue the packet. if the queue or the input's share of it is full, the oldest packet of the longest input queue is dropped
+func (s *scheduler) enqueue(packet message.Packet, from *Port, class int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	c := &s.classes[class]
+	q, ok := c.inputs[from]
+	if ok && len(q.packets) >= portInputLimit {
+		s.drop(c, q, now)
+		s.overflow += 1
+	} else if s.size >= s.capacity {
+		longestClass, longestQueue := s.longest()
+		s.drop(longestClass, longestQueue, now)
+		s.overflow += 1
+	}
+	if !ok {
+		q = &inputQueue{from: from}
+		c.inputs[from] = q
+	}
+	// the dropped queue may be the input's own
+	if len(q.packets) == 0 {
+		c.active = append(c.active, q)
+	}
+	q.packets = append(q.packets, queuedPacket{packet: packet, enqueuedAt: now})
+	q.bytes += len(packet.Data)
+	s.size += 1
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// the longest input queue and its class. must be called with the lock held
+func (s *scheduler) longest() (*classQueue, *inputQueue) {
+	var longestClass *classQueue
+	var longestQueue *inputQueue
+	for i := range s.classes {
+		c := &s.classes[i]
+		for _, q := range c.active {
+			if longestQueue == nil || len(q.packets) > len(longestQueue.packets) {
+				longestClass, longestQueue = c, q
+			}
+		}
+	}
+	return longestClass, longestQueue
+}
+
+// remove the head packet of the input queue, the queue leaves the round robin when it's empty. must be called with the lock held
+func (s *scheduler) drop(c *classQueue, q *inputQueue, now time.Time) message.Packet {
+	packet := q.packets[0].packet
+	q.packets[0] = queuedPacket{}
+	q.packets = q.packets[1:]
+	q.bytes -= len(packet.Data)
+	s.size -= 1
+	if len(q.packets) == 0 {
+		// idle inputs don't keep their credit
+		for i, active := range c.active {
+			if active == q {
+				c.active = append(c.active[:i], c.active[i+1:]...)
+				break
+			}
+		}
+		q.deficit = 0
+		q.idleSince = now
+		// an empty queue has no delay, the drop count is kept for the next dropping state
+		q.firstAbove = time.Time{}
+		q.dropping = false
+	}
+	return packet
+}
+
+// forget the input queues idle for longer than the idle timeout, at most once per timeout. must be called with the lock held
+func (s *scheduler) expire(now time.Time) {
+	if now.Sub(s.lastExpire) < codelIdleTimeout {
+		return
+	}
+	s.lastExpire = now
+	for i := range s.classes {
+		c := &s.classes[i]
+		for from, q := range c.inputs {
+			if len(q.packets) == 0 && now.Sub(q.idleSince) >= codelIdleTimeout {
+				delete(c.inputs, from)
+			}
+		}
+	}
+}
+
+// codel, true if the head packet of the input queue may be dropped. must be called with the lock held
+func (q *inputQueue) okToDrop(now time.Time) bool {
+	sojourn := now.Sub(q.packets[0].enqueuedAt)
+	if sojourn < codelTarget || q.bytes <= codelMinBytes {
+		q.firstAbove = time.Time{}
+		return false
+	}
+	if q.firstAbove.IsZero() {
+		q.firstAbove = now.Add(codelInterval)
+		return false
+	}
+	return !now.Before(q.firstAbove)
+}
+
+// codel, drops get more frequent with the square root of the drop count
+func controlLaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(codelInterval) / math.Sqrt(float64(count))))
+}
+
+// remove the head packet of the input queue, dropping the ones queued too long.
+// returns false if all the packets are dropped. must be called with the lock held
+func (s *scheduler) pop(c *classQueue, q *inputQueue, now time.Time) (message.Packet, bool) {
+	ok := q.okToDrop(now)
+	if q.dropping {
+		if !ok {
+			// the delay is under control
+			q.dropping = false
+		}
+		for q.dropping && !now.Before(q.dropNext) {
+			s.drop(c, q, now)
+			s.expired += 1
+			q.count += 1
+			if len(q.packets) == 0 {
+				return message.Packet{}, false
+			}
+			if !q.okToDrop(now) {
+				q.dropping = false
+			} else {
+				q.dropNext = controlLaw(q.dropNext, q.count)
+			}
+		}
+	} else if ok {
+		s.drop(c, q, now)
+		s.expired += 1
+		if len(q.packets) == 0 {
+			return message.Packet{}, false
+		}
+		q.dropping = true
+		// dropped recently, start near the last drop rate
+		delta := q.count - q.lastCount
+		q.count = 1
+		if delta > 1 && now.Sub(q.dropNext) < codelIdleTimeout {
+			q.count = delta
+		}
+		q.lastCount = q.count
+		q.dropNext = controlLaw(now, q.count)
+	}
+	return s.drop(c, q, now), true
+}
+
+// next packet to send, the highest class first
+func (s *scheduler) dequeue() (message.Packet, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for i := range s.classes {
+		c := &s.classes[i]
+		for len(c.active) > 0 {
+			q := c.active[0]
+			if len(q.packets[0].packet.Data) > q.deficit {
+				// its turn is over, it gets more credit next round
+				q.deficit += drrQuantum
+				c.active = append(c.active[1:], q)
+				continue
+			}
+			packet, ok := s.pop(c, q, now)
+			if !ok {
+				continue
+			}
+			q.deficit -= len(packet.Data)
+			return packet, true
+		}
+	}
+	return message.Packet{}, false
+}
+
+// queued packets
+func (s *scheduler) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// queued packets by class
+func (s *scheduler) classLens() [numClasses]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lens := [numClasses]int{}
+	for i := range s.classes {
+		for _, q := range s.classes[i].inputs {
+			lens[i] += len(q.packets)
+		}
+	}
+	return lens
+}
+
+// packets dropped for a full queue and by codel
+func (s *scheduler) drops() (overflow, expired int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.overflow, s.expired
+}
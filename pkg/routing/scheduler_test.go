@@ -0,0 +1,256 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+// test codel drops a standing queue by the control law, and an input resumes at its last drop rate after it drains
+func TestCodelDropSchedule(t *testing.T) {
+	s := newScheduler(portBufferSize)
+	from := newTestPort("ipfs/peer")
+	start := time.Now()
+	fill := func() {
+		for i := 0; i < 100; i++ {
+			s.enqueue(message.Packet{Data: make([]byte, 1000)}, from, classDefault)
+		}
+	}
+	fill()
+	c := &s.classes[classDefault]
+	q := c.inputs[from]
+	// packets dropped by a dequeue at the time
+	popAt := func(d time.Duration) int64 {
+		expired := s.expired
+		if _, ok := s.pop(c, q, start.Add(d)); !ok {
+			t.Fatalf("queue drained at %s", d)
+		}
+		return s.expired - expired
+	}
+	ms := time.Millisecond
+	// above the target for an interval, then drops at 100ms / sqrt(count) apart
+	schedule := []struct {
+		at    time.Duration
+		drops int64
+	}{
+		{10 * ms, 0},
+		{50 * ms, 0},
+		{120 * ms, 1},
+		{200 * ms, 0},
+		{220 * ms, 1},
+		{290 * ms, 0},
+		{291 * ms, 1},
+		{348 * ms, 0},
+		{349 * ms, 1},
+	}
+	for _, step := range schedule {
+		if drops := popAt(step.at); drops != step.drops {
+			t.Fatalf("at %s dropped %d, want %d", step.at, drops, step.drops)
+		}
+	}
+	// drained, the input keeps its codel state
+	for len(q.packets) > 0 {
+		s.drop(c, q, start.Add(400*ms))
+	}
+	if c.inputs[from] != q || len(c.active) != 0 || q.dropping || q.count != 4 {
+		t.Fatalf("drained queue state %+v", q)
+	}
+	// dropping again soon, it starts at the last rate instead of 100ms
+	fill()
+	if c.inputs[from] != q || len(c.active) != 1 {
+		t.Fatal("refilled queue is not the kept one")
+	}
+	for _, step := range []struct {
+		at    time.Duration
+		drops int64
+	}{
+		{410 * ms, 0},
+		{520 * ms, 1},
+		{577 * ms, 0},
+		{578 * ms, 1},
+	} {
+		if drops := popAt(step.at); drops != step.drops {
+			t.Fatalf("resumed at %s dropped %d, want %d", step.at, drops, step.drops)
+		}
+	}
+}
+
+// test idle inputs are forgotten only after the idle timeout
+func TestCodelIdleExpire(t *testing.T) {
+	s := newScheduler(portBufferSize)
+	from := newTestPort("ipfs/peer")
+	s.enqueue(message.Packet{Data: make([]byte, 100)}, from, classDefault)
+	c := &s.classes[classDefault]
+	idle := time.Now()
+	s.drop(c, c.inputs[from], idle)
+
+	s.lastExpire = time.Time{}
+	s.expire(idle.Add(codelIdleTimeout - time.Millisecond))
+	if _, ok := c.inputs[from]; !ok {
+		t.Fatal("input expired before the idle timeout")
+	}
+	s.lastExpire = time.Time{}
+	s.expire(idle.Add(codelIdleTimeout))
+	if _, ok := c.inputs[from]; ok {
+		t.Fatal("idle input not expired")
+	}
+}
+
+// test writers never wait for a congested port, it drops packets and is never closed
+func TestWritePacketNeverBlocks(t *testing.T) {
+	p := newTestPort("ipfs/out")
+	inputs := []*Port{}
+	for _, endpoint := range []string{"ipfs/a", "ipfs/b", "ipfs/c", "ipfs/d", "ipfs/e", "ipfs/f", "ipfs/g", "ipfs/h"} {
+		inputs = append(inputs, newTestPort(endpoint))
+	}
+	const rounds = portBufferSize
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			for _, from := range inputs {
+				p.WritePacket(&message.Packet{Data: make([]byte, 100)}, from)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("WritePacket blocked on a congested port")
+	}
+	if p.IsClosed() {
+		t.Fatal("congested port closed")
+	}
+	if n := p.queue.len(); n != portBufferSize {
+		t.Fatalf("queue holds %d packets, want %d", n, portBufferSize)
+	}
+	overflow, expired := p.queue.drops()
+	if overflow != int64(rounds*len(inputs)-portBufferSize) || expired != 0 {
+		t.Fatalf("dropped %d for overflow and %d by codel", overflow, expired)
+	}
+	for from, q := range p.queue.classes[classDefault].inputs {
+		if len(q.packets) > portInputLimit {
+			t.Fatalf("input %s holds %d packets, over its share", from, len(q.packets))
+		}
+	}
+}
+
+// ipv4 packet of the size with the dscp, tagged by its ttl
+func dscpPacket(dscp uint8, size int, tag uint8) message.Packet {
+	data := make([]byte, size)
+	data[0] = 0x45
+	data[1] = dscp << 2
+	return message.Packet{TTL: int(tag), Data: data}
+}
+
+// test classes are served in strict priority, packets of a class in order
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler(portBufferSize)
+	from := newTestPort("ipfs/peer")
+	order := []struct {
+		class int
+		tag   uint8
+	}{
+		{classBulk, 1}, {classDefault, 2}, {classInteractive, 3}, {classBulk, 4},
+		{classControl, 5}, {classDefault, 6}, {classInteractive, 7}, {classControl, 8},
+	}
+	for _, p := range order {
+		s.enqueue(dscpPacket(0, 100, p.tag), from, p.class)
+	}
+	if lens := s.classLens(); lens != [numClasses]int{2, 2, 2, 2} {
+		t.Fatalf("class lengths %v", lens)
+	}
+	for _, want := range []int{5, 8, 3, 7, 2, 6, 1, 4} {
+		packet, ok := s.dequeue()
+		if !ok || packet.TTL != want {
+			t.Fatalf("dequeued packet %d, want %d", packet.TTL, want)
+		}
+	}
+	if _, ok := s.dequeue(); ok || s.len() != 0 {
+		t.Fatal("packets left")
+	}
+}
+
+// test two busy inputs of a class get the same bytes, whatever their packet sizes
+func TestSchedulerFairness(t *testing.T) {
+	s := newScheduler(portBufferSize)
+	large, small := newTestPort("ipfs/large"), newTestPort("ipfs/small")
+	for i := 0; i < 100; i++ {
+		s.enqueue(dscpPacket(0, 1500, 1), large, classDefault)
+	}
+	for i := 0; i < 300; i++ {
+		s.enqueue(dscpPacket(0, 500, 2), small, classDefault)
+	}
+	sent := map[int]int{}
+	for i := 0; i < 200; i++ {
+		packet, ok := s.dequeue()
+		if !ok {
+			t.Fatal("queue drained")
+		}
+		sent[packet.TTL] += len(packet.Data)
+	}
+	if diff := sent[1] - sent[2]; diff > drrQuantum || diff < -drrQuantum {
+		t.Fatalf("large input sent %d bytes, small input %d", sent[1], sent[2])
+	}
+}
+
+// test an input holds at most its share of the queue, its oldest packets are dropped and the others are not
+func TestSchedulerInputLimit(t *testing.T) {
+	s := newScheduler(portBufferSize)
+	heavy, light := newTestPort("ipfs/heavy"), newTestPort("ipfs/light")
+	for i := 0; i < portInputLimit+10; i++ {
+		packet := dscpPacket(0, 100, 1)
+		packet.Data[2] = byte(i)
+		s.enqueue(packet, heavy, classDefault)
+	}
+	s.enqueue(dscpPacket(0, 100, 2), light, classDefault)
+	if overflow, _ := s.drops(); overflow != 10 || s.len() != portInputLimit+1 {
+		t.Fatalf("%d queued, %d dropped", s.len(), overflow)
+	}
+	q := s.classes[classDefault].inputs[heavy]
+	if len(q.packets) != portInputLimit || q.packets[0].packet.Data[2] != 10 {
+		t.Fatalf("heavy input holds %d packets from %d", len(q.packets), q.packets[0].packet.Data[2])
+	}
+	if q := s.classes[classDefault].inputs[light]; len(q.packets) != 1 {
+		t.Fatal("light input dropped")
+	}
+}
+
+// test the dscp of the tunnel is trusted, peers can't claim control traffic and their priority traffic is rate limited
+func TestTrafficClass(t *testing.T) {
+	tunnel, peer := newTestPort("tun/goose"), newTestPort("ipfs/peer")
+	for _, c := range []struct {
+		name  string
+		dscp  uint8
+		from  *Port
+		class int
+	}{
+		{"router control", 48, nil, classControl},
+		{"tunnel control", 56, tunnel, classControl},
+		{"tunnel ef", 46, tunnel, classInteractive},
+		{"tunnel default", 0, tunnel, classDefault},
+		{"tunnel bulk", 8, tunnel, classBulk},
+		{"peer control", 48, peer, classInteractive},
+		{"peer ef", 46, peer, classInteractive},
+		{"peer bulk", 1, peer, classBulk},
+	} {
+		if class := trafficClass(dscpPacket(c.dscp, 100, 0).Data, c.from); class != c.class {
+			t.Fatalf("%s: class %s, want %s", c.name, classNames[class], classNames[c.class])
+		}
+	}
+	// the burst is used up, the excess is default traffic
+	packet := dscpPacket(46, 1500, 0)
+	interactive := 0
+	for i := 0; i < peerPriorityBurst/1500+10; i++ {
+		if trafficClass(packet.Data, peer) == classInteractive {
+			interactive += 1
+		}
+	}
+	if interactive > peerPriorityBurst/1500+1 {
+		t.Fatalf("%d interactive packets over the burst", interactive)
+	}
+	if class := trafficClass(packet.Data, tunnel); class != classInteractive {
+		t.Fatalf("tunnel limited as %s", classNames[class])
+	}
+}
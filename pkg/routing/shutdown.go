@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+const (
+	// output queues are checked in this interval while draining
+	drainInterval = time.Millisecond * 50
+)
+
+// shut down the router. peers are told to withdraw the routings through this router, the output queues are drained,
+// all the ports are closed, then the host routes and nat rules are removed. returns when done or the context expires
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.lock.Lock()
+	if r.stopping {
+		r.lock.Unlock()
+		return errors.Errorf("router is shutting down")
+	}
+	// no more new ports
+	r.stopping = true
+	r.lock.Unlock()
+	// the connected endpoints and their routings are restored on the next start
+	if err := r.saveState(); err != nil {
+		logger.Printf("shutdown: save state failed: %s", err)
+	}
+	r.lock.Lock()
+	ports := make([]*Port, 0, len(r.portStats))
+	for p := range r.portStats {
+		ports = append(ports, p)
+	}
+	all, err := r.allEntries()
+	r.lock.Unlock()
+	if err != nil {
+		logger.Printf("get routings failed: %s", err)
+	}
+
+	// withdraw everything, peers drop the paths through us at once instead of waiting for them to expire
+	withdrawals := make([]message.RoutingEntry, 0, len(all))
+	for _, entry := range all {
+		withdrawals = append(withdrawals, entry.withdrawal())
+	}
+	if len(withdrawals) > 0 {
+		msg := message.Routing{
+			Type:     message.RoutingWithdraw,
+			Routings: withdrawals,
+			Message:  "shutdown",
+		}
+		for _, p := range ports {
+			if p.IsLocal() {
+				continue
+			}
+			select {
+			case p.announce <- msg:
+			case <-p.ctx.Done():
+			case <-ctx.Done():
+			}
+		}
+	}
+	logger.Printf("shutdown: withdrew %d routings from %d ports", len(withdrawals), len(ports))
+
+	// drain the output queues
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for _, p := range ports {
+		for p.queue.len() > 0 && !p.IsClosed() && ctx.Err() == nil {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	// stop the background workers and close the wires
+	r.Close()
+	for _, p := range ports {
+		p.Close()
+	}
+	for _, p := range ports {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+		}
+	}
+
+	// restore host state
+	if err := utils.RouteTable.Flush(ctx); err != nil {
+		logger.Printf("shutdown: flush host routes failed: %s", err)
+	}
+	if r.nat {
+		if err := utils.RemoveNAT(); err != nil {
+			logger.Printf("shutdown: remove nat failed: %s", err)
+		}
+	}
+	if r.nat6 {
+		if err := utils.RemoveNAT6(); err != nil {
+			logger.Printf("shutdown: remove nat6 failed: %s", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "shutdown")
+	}
+	logger.Printf("shutdown: done")
+	return nil
+}
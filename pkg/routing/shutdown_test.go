@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+// test every peer port gets one withdrawal of all the routings before the ports are closed, and a second shutdown fails
+func TestShutdown(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	peers := []*Port{r.addTestPort("ipfs/a"), r.addTestPort("ipfs/b")}
+	local := r.addTestPort("tun/goose")
+	r.testUpdate(t, peers[0], origin.announce(t, "10.1.0.0/16", 1, 1), origin.announce(t, "10.2.0.0/16", 1, 1))
+	r.testUpdate(t, local, message.RoutingEntry{Network: parseNetwork(t, "192.168.1.0/24")})
+
+	// messages queued for each port when it's closed
+	queued := map[*Port]int{}
+	for _, p := range append(peers, local) {
+		// drop the acks of the updates
+		for len(p.announce) > 0 {
+			<-p.announce
+		}
+		closeWire := p.closeFunc
+		p.closeFunc = func() error {
+			queued[p] = len(p.announce)
+			close(p.done)
+			return closeWire()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		if queued[p] != 1 {
+			t.Fatalf("port(%s) closed with %d queued messages", p, queued[p])
+		}
+		msg := <-p.announce
+		if msg.Type != message.RoutingWithdraw || len(msg.Routings) != 3 {
+			t.Fatalf("shutdown message %+v", msg)
+		}
+		for _, entry := range msg.Routings {
+			if entry.Metric != message.MetricInfinity {
+				t.Fatalf("withdrawal %+v", entry)
+			}
+		}
+	}
+	// the local port gets none
+	if _, ok := queued[local]; !ok || len(local.announce) != 0 {
+		t.Fatal("shutdown message to the local port")
+	}
+	select {
+	case <-r.Done():
+	default:
+		t.Fatal("router not closed")
+	}
+	if err := r.Shutdown(ctx); err == nil {
+		t.Fatal("second shutdown succeeded")
+	}
+	if err := r.RegisterPort(newTestPort("ipfs/c")); err == nil {
+		t.Fatal("port registered after shutdown")
+	}
+}
@@ -0,0 +1,291 @@
+package routing
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/wire/ipfs"
+)
+
+const (
+	// state is saved in this interval and on shutdown
+	stateSaveInterval = time.Second * 60
+	// endpoints not connected for this long are forgotten
+	stateMaxAge = time.Hour * 24
+	// max saved endpoints
+	maxSavedEndpoints = 64
+	// restored routings are dropped if not confirmed in this time
+	provisionalExpire = time.Second * 90
+)
+
+// state persisted across restarts
+type savedState struct {
+	SavedAt   time.Time       `json:"saved_at"`
+	Endpoints []savedEndpoint `json:"endpoints"`
+	Routes    []savedRoute    `json:"routes"`
+}
+
+// a recently connected endpoint
+type savedEndpoint struct {
+	Endpoint string `json:"endpoint"`
+	// last known multiaddrs of ipfs peers
+	Addrs       []string  `json:"addrs,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// a routing learned from an endpoint
+type savedRoute struct {
+	Network   string `json:"network"`
+	Endpoint  string `json:"endpoint"`
+	Metric    int    `json:"metric"`
+	Rtt       int    `json:"rtt"`
+	Origin    string `json:"origin"`
+	Name      string `json:"name"`
+	PublicKey []byte `json:"public_key,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	Seqno     uint16 `json:"seqno"`
+	Anycast   bool   `json:"anycast"`
+}
+
+// restore the saved state, then save it periodically until the router is closed
+func (r *Router) enableState(path string) {
+	r.statePath = path
+	state, err := loadState(path)
+	if err != nil {
+		logger.Printf("load state failed: %s", err)
+	} else if state != nil {
+		r.restoreState(state)
+	}
+	go r.persistState()
+}
+
+func loadState(path string) (*savedState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	state := &savedState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+	return state, nil
+}
+
+// redial the saved endpoints. saved routings are installed as provisional when their endpoints are connected again
+func (r *Router) restoreState(state *savedState) {
+	now := time.Now()
+	endpoints := []savedEndpoint{}
+	r.lock.Lock()
+	for _, ep := range state.Endpoints {
+		if now.Sub(ep.ConnectedAt) > stateMaxAge {
+			continue
+		}
+		r.savedEndpoints[ep.Endpoint] = ep
+		endpoints = append(endpoints, ep)
+	}
+	routes := 0
+	for _, route := range state.Routes {
+		if _, ok := r.savedEndpoints[route.Endpoint]; ok {
+			r.provisional[route.Endpoint] = append(r.provisional[route.Endpoint], route)
+			routes += 1
+		}
+	}
+	r.provisionalUntil = now.Add(provisionalExpire)
+	r.lock.Unlock()
+	logger.Printf("restored %d endpoints and %d routings saved at %s", len(endpoints), routes, state.SavedAt.Format(time.DateTime))
+
+	if r.Connector == nil || len(endpoints) == 0 {
+		return
+	}
+	go func() {
+		for _, ep := range endpoints {
+			// ipfs peers are dialed at their last known addresses, without waiting for the dht
+			if peerID, ok := strings.CutPrefix(ep.Endpoint, "ipfs/"); ok {
+				host := ipfs.GetP2PHost()
+				if err := host.AddPeerAddrs(peerID, ep.Addrs); err != nil {
+					logger.Printf("restore addrs of %s failed: %s", peerID, err)
+				}
+				host.AllowPeer(peerID)
+			}
+			r.Dial(ep.Endpoint)
+		}
+	}()
+}
+
+// install the restored routings learned from the port's endpoint. must be called with the lock held
+func (r *Router) installProvisional(p *Port, now time.Time) {
+	routes, ok := r.provisional[p.w.Endpoint()]
+	if !ok {
+		return
+	}
+	delete(r.provisional, p.w.Endpoint())
+	if now.After(r.provisionalUntil) {
+		return
+	}
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(route.Network)
+		if err != nil {
+			continue
+		}
+		myEntry, err := r.findEntry(*network)
+		if err != nil || myEntry != nil {
+			continue
+		}
+		entry := &routingEntry{
+			network:     *network,
+			port:        p,
+			metric:      route.Metric,
+			rtt:         route.Rtt,
+			origin:      route.Origin,
+			name:        route.Name,
+			publicKey:   route.PublicKey,
+			signature:   route.Signature,
+			seqno:       route.Seqno,
+			anycast:     route.Anycast,
+			provisional: true,
+			updatedAt:   now,
+		}
+		if err := r.routeTable.Insert(entry); err != nil {
+			logger.Printf("restore routing %s failed: %s", route.Network, err)
+			continue
+		}
+		// the tunnel takes it, peers don't until it's confirmed
+		r.changed[entry.network.String()] = entry.network
+	}
+	r.trigger()
+	r.forwardingChanged()
+}
+
+// drop a provisional routing, it was never announced to peers. must be called with the lock held
+func (r *Router) removeProvisional(entry *routingEntry) error {
+	if _, err := r.routeTable.Remove(entry.Network()); err != nil {
+		return errors.WithStack(err)
+	}
+	r.forwardingChanged()
+	r.changed[entry.network.String()] = entry.network
+	r.trigger()
+	return nil
+}
+
+// save the state periodically until the router is closed
+func (r *Router) persistState() {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.saveState(); err != nil {
+				logger.Printf("save state failed: %s", err)
+			}
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// save connected endpoints and the routings learned from them
+func (r *Router) saveState() error {
+	if r.statePath == "" {
+		return nil
+	}
+	now := time.Now()
+	state := savedState{
+		SavedAt:   now,
+		Endpoints: []savedEndpoint{},
+		Routes:    []savedRoute{},
+	}
+
+	r.lock.Lock()
+	connected := map[string]bool{}
+	for p := range r.portStats {
+		if !p.IsLocal() && !p.IsClosed() {
+			connected[p.w.Endpoint()] = true
+		}
+	}
+	all, err := r.allEntries()
+	if err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	for _, entry := range all {
+		if entry.provisional || entry.origin == r.id || entry.port.IsLocal() {
+			continue
+		}
+		state.Routes = append(state.Routes, savedRoute{
+			Network:   entry.network.String(),
+			Endpoint:  entry.port.w.Endpoint(),
+			Metric:    entry.metric,
+			Rtt:       entry.rtt,
+			Origin:    entry.origin,
+			Name:      entry.name,
+			PublicKey: entry.publicKey,
+			Signature: entry.signature,
+			Seqno:     entry.seqno,
+			Anycast:   entry.anycast,
+		})
+	}
+	for endpoint := range connected {
+		r.savedEndpoints[endpoint] = savedEndpoint{
+			Endpoint:    endpoint,
+			Addrs:       r.savedEndpoints[endpoint].Addrs,
+			ConnectedAt: now,
+		}
+	}
+	for endpoint, ep := range r.savedEndpoints {
+		if now.Sub(ep.ConnectedAt) > stateMaxAge {
+			delete(r.savedEndpoints, endpoint)
+			continue
+		}
+		state.Endpoints = append(state.Endpoints, ep)
+	}
+	r.lock.Unlock()
+
+	// most recent first
+	sort.Slice(state.Endpoints, func(i, j int) bool {
+		return state.Endpoints[i].ConnectedAt.After(state.Endpoints[j].ConnectedAt)
+	})
+	if len(state.Endpoints) > maxSavedEndpoints {
+		state.Endpoints = state.Endpoints[:maxSavedEndpoints]
+	}
+	updated := []savedEndpoint{}
+	for i, ep := range state.Endpoints {
+		if peerID, ok := strings.CutPrefix(ep.Endpoint, "ipfs/"); ok && connected[ep.Endpoint] {
+			if addrs := ipfs.GetP2PHost().PeerAddrs(peerID); len(addrs) > 0 {
+				state.Endpoints[i].Addrs = addrs
+				updated = append(updated, state.Endpoints[i])
+			}
+		}
+	}
+	r.lock.Lock()
+	for _, ep := range updated {
+		r.savedEndpoints[ep.Endpoint] = ep
+	}
+	r.lock.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.statePath), 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	// write and rename, so a crash never leaves a partial file
+	tmp := r.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp, r.statePath); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
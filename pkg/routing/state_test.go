@@ -0,0 +1,89 @@
+package routing
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// test connected endpoints and their routings are saved, and restored as provisional routings when the endpoints connect again
+func TestStateRestore(t *testing.T) {
+	r := newTestRouter(t)
+	r.statePath = filepath.Join(t.TempDir(), "state.json")
+	origin := newTestOrigin(t)
+	p := r.addTestPort("udp/10.0.0.1:1234")
+	r.testUpdate(t, p, origin.announce(t, "10.1.0.0/16", 1, 7))
+	if err := r.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(r.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Endpoints) != 1 || len(state.Routes) != 1 || state.Routes[0].Seqno != 7 {
+		t.Fatalf("saved state %+v", state)
+	}
+	// an endpoint not connected for too long is forgotten with its routings
+	state.Endpoints = append(state.Endpoints, savedEndpoint{Endpoint: "udp/10.0.0.2:1234", ConnectedAt: time.Now().Add(-stateMaxAge - time.Hour)})
+	state.Routes = append(state.Routes, savedRoute{Network: "10.2.0.0/16", Endpoint: "udp/10.0.0.2:1234", Metric: 2})
+
+	restored := newTestRouter(t)
+	restored.restoreState(state)
+	if len(restored.savedEndpoints) != 1 || len(restored.provisional) != 1 {
+		t.Fatalf("restored %d endpoints and routings of %d endpoints", len(restored.savedEndpoints), len(restored.provisional))
+	}
+	// installed when the endpoint connects again, until confirmed
+	q := restored.addTestPort("udp/10.0.0.1:1234")
+	restored.lock.Lock()
+	restored.installProvisional(q, time.Now())
+	restored.lock.Unlock()
+	entry := restored.testEntry(t, "10.1.0.0/16")
+	if entry == nil || !entry.provisional || entry.port != q || entry.metric != 2 {
+		t.Fatalf("provisional routing %+v", entry)
+	}
+	// the first announcement replaces it
+	restored.testUpdate(t, q, origin.announce(t, "10.1.0.0/16", 1, 8))
+	if entry := restored.testEntry(t, "10.1.0.0/16"); entry == nil || entry.provisional || entry.seqno != 8 {
+		t.Fatalf("confirmed routing %+v", entry)
+	}
+}
+
+// test restored routings are not installed after the provisional time, and unconfirmed ones expire
+func TestStateExpire(t *testing.T) {
+	state := &savedState{
+		Endpoints: []savedEndpoint{{Endpoint: "udp/10.0.0.1:1234", ConnectedAt: time.Now()}},
+		Routes:    []savedRoute{{Network: "10.1.0.0/16", Endpoint: "udp/10.0.0.1:1234", Metric: 2}},
+	}
+	r := newTestRouter(t)
+	r.restoreState(state)
+	p := r.addTestPort("udp/10.0.0.1:1234")
+	r.lock.Lock()
+	r.installProvisional(p, time.Now().Add(provisionalExpire+time.Second))
+	r.lock.Unlock()
+	if entry := r.testEntry(t, "10.1.0.0/16"); entry != nil {
+		t.Fatalf("routing installed after the provisional time %+v", entry)
+	}
+
+	r = newTestRouter(t)
+	r.restoreState(state)
+	p = r.addTestPort("udp/10.0.0.1:1234")
+	r.lock.Lock()
+	r.installProvisional(p, time.Now())
+	r.lock.Unlock()
+	entry := r.testEntry(t, "10.1.0.0/16")
+	if entry == nil {
+		t.Fatal("provisional routing not installed")
+	}
+	// not confirmed in time
+	entry.updatedAt = time.Now().Add(-provisionalExpire - time.Second)
+	if err := r.refreshRoutings(); err != nil {
+		t.Fatal(err)
+	}
+	if entry := r.testEntry(t, "10.1.0.0/16"); entry != nil {
+		t.Fatalf("unconfirmed routing not expired %+v", entry)
+	}
+	// it was never announced, so it's not withdrawn
+	if len(r.withdrawn) != 0 {
+		t.Fatalf("%d withdrawals of a provisional routing", len(r.withdrawn))
+	}
+}
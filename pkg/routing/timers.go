@@ -0,0 +1,97 @@
+package routing
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// protocol timers
+type Timers struct {
+	// routings are announced to peers in this interval
+	RoutingInterval time.Duration
+	// routings not refreshed in this time are removed
+	RoutingExpire time.Duration
+	// ports without routing updates in this time are closed
+	IdleTimeout time.Duration
+	// failed endpoints are first retried after this, the delay doubles with each failure
+	RetryInterval time.Duration
+	// max delay between retries
+	RetryMaxBackoff time.Duration
+	// endpoints failed this many times are forgotten
+	MaxRetries int
+	// peers are searched in the namespace in this interval
+	SearchInterval time.Duration
+	// this node is advertised in the namespace in this interval
+	AdvertiseInterval time.Duration
+	// announce faster while the topology is changing, back off when it's stable
+	Adaptive bool
+}
+
+var (
+	DefaultTimers = Timers{
+		RoutingInterval:   time.Second * 30,
+		RoutingExpire:     time.Second * 180,
+		IdleTimeout:       time.Second * 300,
+		RetryInterval:     time.Second * 15,
+		RetryMaxBackoff:   time.Minute * 10,
+		MaxRetries:        32,
+		SearchInterval:    time.Second * 300,
+		AdvertiseInterval: time.Second * 300,
+	}
+)
+
+func (t Timers) validate() error {
+	for name, d := range map[string]time.Duration{
+		"routing interval":   t.RoutingInterval,
+		"retry interval":     t.RetryInterval,
+		"search interval":    t.SearchInterval,
+		"advertise interval": t.AdvertiseInterval,
+	} {
+		if d <= 0 {
+			return errors.Errorf("%s must be positive", name)
+		}
+	}
+	// a routing survives a lost announcement
+	if t.RoutingExpire < t.RoutingInterval*2 {
+		return errors.Errorf("routing expire %s is less than twice the routing interval %s", t.RoutingExpire, t.RoutingInterval)
+	}
+	if t.IdleTimeout < t.RoutingExpire {
+		return errors.Errorf("idle timeout %s is less than the routing expire %s", t.IdleTimeout, t.RoutingExpire)
+	}
+	if t.RetryMaxBackoff < t.RetryInterval {
+		return errors.Errorf("max backoff %s is less than the retry interval %s", t.RetryMaxBackoff, t.RetryInterval)
+	}
+	if t.MaxRetries <= 0 {
+		return errors.Errorf("max retries must be positive")
+	}
+	return nil
+}
+
+// fastest adaptive announcement interval, used while the topology is changing
+func (t Timers) minInterval() time.Duration {
+	return t.RoutingInterval / 3
+}
+
+// slowest adaptive announcement interval, peers still get 3 announcements before their routings expire
+func (t Timers) maxInterval() time.Duration {
+	return max(t.RoutingInterval, t.RoutingExpire/3)
+}
+
+// the topology changed, announcements are sped up in adaptive mode
+func (r *Router) topologyChanged() {
+	atomic.StoreInt64(&r.changedAt, time.Now().UnixNano())
+}
+
+// interval to the next periodic announcement of a port. in adaptive mode it's the fastest
+// if the topology changed since the last announcement, otherwise it doubles up to the slowest
+func (r *Router) nextInterval(interval time.Duration, lastAnnounced time.Time) time.Duration {
+	if !r.timers.Adaptive {
+		return r.timers.RoutingInterval
+	}
+	if atomic.LoadInt64(&r.changedAt) > lastAnnounced.UnixNano() {
+		return r.timers.minInterval()
+	}
+	return min(max(interval*2, r.timers.minInterval()), r.timers.maxInterval())
+}
@@ -0,0 +1,84 @@
+package routing
+
+import (
+	"testing"
+	"time"
+)
+
+// test the adaptive interval doubles from the fastest to the slowest, and resets when the topology changes
+func TestNextInterval(t *testing.T) {
+	r := newTestRouter(t)
+	// fastest 10s, slowest 60s
+	announced := time.Now()
+	for _, c := range []struct {
+		name     string
+		adaptive bool
+		interval time.Duration
+		changed  bool
+		want     time.Duration
+	}{
+		{"fixed", false, time.Second * 10, false, time.Second * 30},
+		{"fixed after a change", false, time.Second * 10, true, time.Second * 30},
+		{"first", true, 0, false, time.Second * 10},
+		{"doubled", true, time.Second * 10, false, time.Second * 20},
+		{"doubled again", true, time.Second * 20, false, time.Second * 40},
+		{"capped", true, time.Second * 40, false, time.Second * 60},
+		{"slowest", true, time.Second * 60, false, time.Second * 60},
+		{"reset", true, time.Second * 60, true, time.Second * 10},
+		{"reset at the fastest", true, time.Second * 10, true, time.Second * 10},
+	} {
+		r.timers.Adaptive = c.adaptive
+		r.changedAt = announced.Add(-time.Second).UnixNano()
+		if c.changed {
+			r.changedAt = announced.Add(time.Second).UnixNano()
+		}
+		if got := r.nextInterval(c.interval, announced); got != c.want {
+			t.Fatalf("%s: next interval %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	// a change after the last announcement speeds up the next one
+	r.timers.Adaptive = true
+	announced = time.Now().Add(-time.Millisecond)
+	r.topologyChanged()
+	if got := r.nextInterval(time.Second*60, announced); got != time.Second*10 {
+		t.Fatalf("next interval %s after a topology change, want 10s", got)
+	}
+	if got := r.nextInterval(time.Second*10, time.Now()); got != time.Second*20 {
+		t.Fatalf("next interval %s after announcing the change, want 20s", got)
+	}
+}
+
+// test timers are validated
+func TestValidateTimers(t *testing.T) {
+	if err := DefaultTimers.validate(); err != nil {
+		t.Fatalf("default timers are invalid: %s", err)
+	}
+	for _, c := range []struct {
+		name   string
+		change func(timers *Timers)
+	}{
+		{"zero routing interval", func(timers *Timers) { timers.RoutingInterval = 0 }},
+		{"negative retry interval", func(timers *Timers) { timers.RetryInterval = -time.Second }},
+		{"zero search interval", func(timers *Timers) { timers.SearchInterval = 0 }},
+		{"zero advertise interval", func(timers *Timers) { timers.AdvertiseInterval = 0 }},
+		{"expire within two intervals", func(timers *Timers) { timers.RoutingExpire = timers.RoutingInterval*2 - 1 }},
+		{"idle before expire", func(timers *Timers) { timers.IdleTimeout = timers.RoutingExpire - 1 }},
+		{"backoff below the retry interval", func(timers *Timers) { timers.RetryMaxBackoff = timers.RetryInterval - 1 }},
+		{"zero retries", func(timers *Timers) { timers.MaxRetries = 0 }},
+	} {
+		timers := DefaultTimers
+		c.change(&timers)
+		if err := timers.validate(); err == nil {
+			t.Fatalf("%s: timers are valid", c.name)
+		}
+	}
+	// the limits themselves are valid
+	timers := DefaultTimers
+	timers.RoutingExpire = timers.RoutingInterval * 2
+	timers.IdleTimeout = timers.RoutingExpire
+	timers.RetryMaxBackoff = timers.RetryInterval
+	if err := timers.validate(); err != nil {
+		t.Fatalf("timers at the limits are invalid: %s", err)
+	}
+}
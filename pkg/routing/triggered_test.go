@@ -0,0 +1,148 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+)
+
+const (
+	// announcements have no routing type
+	typeAnnouncement = 0
+)
+
+// triggered updates queued for the port
+func drainUpdates(p *Port) []message.Routing {
+	msgs := []message.Routing{}
+	for {
+		select {
+		case msg := <-p.updates:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// networks and metrics of the queued messages of the type
+func updatedNetworks(msgs []message.Routing, routingType int) map[string]int {
+	networks := map[string]int{}
+	for _, msg := range msgs {
+		if msg.Type != routingType {
+			continue
+		}
+		for _, entry := range msg.Routings {
+			networks[entry.Network.String()] = entry.Metric
+		}
+	}
+	return networks
+}
+
+func sendTriggered(t *testing.T, r *Router, withUpdates bool) bool {
+	sent, err := r.sendTriggered(withUpdates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sent
+}
+
+// test changed routings are sent to the other ports, poisoned back to the next hop, and only the changed ones
+func TestTriggeredUpdates(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	a, b, c := r.addTestPort("ipfs/a"), r.addTestPort("ipfs/b"), r.addTestPort("ipfs/c")
+	announce := func(cidr string, rtt int) message.RoutingEntry {
+		entry := origin.announce(t, cidr, 1, 1)
+		entry.Rtt = rtt
+		return entry
+	}
+	r.testUpdate(t, a, announce("10.1.0.0/16", 100), announce("10.2.0.0/16", 100))
+	if !sendTriggered(t, r, true) {
+		t.Fatal("new routings not sent")
+	}
+	// poison reverse to the next hop
+	if withdrawn := updatedNetworks(drainUpdates(a), message.RoutingWithdraw); len(withdrawn) != 2 || withdrawn["10.1.0.0/16"] != message.MetricInfinity {
+		t.Fatalf("poison reverse to the next hop %v", withdrawn)
+	}
+	for _, p := range []*Port{b, c} {
+		if updated := updatedNetworks(drainUpdates(p), typeAnnouncement); len(updated) != 2 || updated["10.1.0.0/16"] != 2 {
+			t.Fatalf("updates to port(%s) %v", p, updated)
+		}
+	}
+	if sendTriggered(t, r, true) {
+		t.Fatal("updates sent without changes")
+	}
+
+	// the best path of one network changes, only it is sent
+	r.testUpdate(t, b, announce("10.1.0.0/16", 10))
+	if entry := r.testEntry(t, "10.1.0.0/16"); entry == nil || entry.port != b {
+		t.Fatalf("best path %+v", entry)
+	}
+	sendTriggered(t, r, true)
+	if updated := updatedNetworks(drainUpdates(c), typeAnnouncement); len(updated) != 1 || updated["10.1.0.0/16"] != 2 {
+		t.Fatalf("partial update %v", updated)
+	}
+	if withdrawn := updatedNetworks(drainUpdates(b), message.RoutingWithdraw); len(withdrawn) != 1 || withdrawn["10.1.0.0/16"] != message.MetricInfinity {
+		t.Fatalf("poison reverse to the new next hop %v", withdrawn)
+	}
+	if updated := updatedNetworks(drainUpdates(a), typeAnnouncement); len(updated) != 1 {
+		t.Fatalf("update to the old next hop %v", updated)
+	}
+}
+
+// test a closed port's routings are withdrawn from the other ports at once, while updates wait for the interval
+func TestTriggeredWithdrawals(t *testing.T) {
+	r := newTestRouter(t)
+	origin := newTestOrigin(t)
+	a, b, c := r.addTestPort("ipfs/a"), r.addTestPort("ipfs/b"), r.addTestPort("ipfs/c")
+	r.testUpdate(t, a, origin.announce(t, "10.1.0.0/16", 1, 1))
+	sendTriggered(t, r, true)
+	for _, p := range []*Port{a, b, c} {
+		drainUpdates(p)
+	}
+
+	// a changed routing, and the closed port's routing
+	r.testUpdate(t, b, origin.announce(t, "10.3.0.0/16", 1, 1))
+	if err := r.clearRouting(a); err != nil {
+		t.Fatal(err)
+	}
+	if r.testEntry(t, "10.1.0.0/16") != nil {
+		t.Fatal("routing of the closed port not removed")
+	}
+	if sendTriggered(t, r, false) {
+		t.Fatal("updates sent before the interval")
+	}
+	for _, p := range []*Port{b, c} {
+		msgs := drainUpdates(p)
+		if withdrawn := updatedNetworks(msgs, message.RoutingWithdraw); withdrawn["10.1.0.0/16"] != message.MetricInfinity {
+			t.Fatalf("withdrawals to port(%s) %v", p, withdrawn)
+		}
+		if updated := updatedNetworks(msgs, typeAnnouncement); len(updated) != 0 {
+			t.Fatalf("updates to port(%s) before the interval %v", p, updated)
+		}
+	}
+	if len(drainUpdates(a)) != 0 {
+		t.Fatal("withdrawal sent back to the closed port")
+	}
+
+	// the handler sends the pending update when the interval has passed, then waits again
+	start := time.Now()
+	go r.handleTriggered()
+	defer r.Close()
+	r.trigger()
+	select {
+	case msg := <-c.updates:
+		if elapsed := time.Since(start); msg.Type != typeAnnouncement || elapsed < triggeredInterval-time.Millisecond*100 {
+			t.Fatalf("update %+v sent after %s", msg, elapsed)
+		}
+	case <-time.After(triggeredInterval * 2):
+		t.Fatal("update not sent")
+	}
+	r.testUpdate(t, b, origin.announce(t, "10.4.0.0/16", 1, 1))
+	select {
+	case msg := <-c.updates:
+		t.Fatalf("update %+v sent before the interval", msg)
+	case <-time.After(triggeredInterval / 2):
+	}
+}
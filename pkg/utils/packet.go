@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+)
+
+const (
+	// ip header sizes
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+
+	// fnv-1a
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+
+	// protocols with ports
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+
+	// ipv6 extension headers before the upper layer header
+	protoHopByHop = 0
+	protoRouting  = 43
+	protoFragment = 44
+	protoDstOpts  = 60
+)
+
+// ip version of the raw packet, 4, 6 or 0 if it's not an ip packet
+func IPVersion(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= ipv4HeaderSize {
+			return 4
+		}
+	case 6:
+		if len(packet) >= ipv6HeaderSize {
+			return 6
+		}
+	}
+	return 0
+}
+
+// src and dst address of an ipv4 or ipv6 packet
+func PacketAddresses(packet []byte) (net.IP, net.IP, bool) {
+	switch IPVersion(packet) {
+	case 4:
+		src := make(net.IP, net.IPv4len)
+		dst := make(net.IP, net.IPv4len)
+		copy(src, packet[12:16])
+		copy(dst, packet[16:20])
+		return src, dst, true
+	case 6:
+		src := make(net.IP, net.IPv6len)
+		dst := make(net.IP, net.IPv6len)
+		copy(src, packet[8:24])
+		copy(dst, packet[24:40])
+		return src, dst, true
+	}
+	return nil, nil, false
+}
+
+// host network of the address, /32 for ipv4 and /128 for ipv6
+func HostNetwork(ip net.IP) net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return net.IPNet{
+			IP:   v4,
+			Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len),
+		}
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len),
+	}
+}
+
+// true if the network is a single host
+func IsHostNetwork(network net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return bits > 0 && ones == bits
+}
+
+// true if the network is a default route, 0.0.0.0/0 or ::/0
+func IsDefaultNetwork(network net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return bits > 0 && ones == 0
+}
+
+// hash of the packet's 5-tuple, packets of the same flow have the same hash.
+// fragments are hashed without ports, so they stay on the same path
+func FlowHash(packet []byte) uint64 {
+	var proto byte
+	var payload []byte
+	h := uint64(fnvOffset)
+	switch IPVersion(packet) {
+	case 4:
+		h = fnvHash(h, packet[12:20])
+		proto = packet[9]
+		ihl := int(packet[0]&0x0f) * 4
+		// not fragmented
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff == 0 && ihl >= ipv4HeaderSize && len(packet) >= ihl {
+			payload = packet[ihl:]
+		}
+	case 6:
+		h = fnvHash(h, packet[8:40])
+		proto, payload = ipv6Payload(packet)
+	default:
+		return 0
+	}
+	h = fnvHash(h, []byte{proto})
+	if (proto == protoTCP || proto == protoUDP || proto == protoSCTP) && len(payload) >= 4 {
+		h = fnvHash(h, payload[:4])
+	}
+	return h
+}
+
+// fnv-1a hash of the string
+func StringHash(s string) uint64 {
+	return fnvHash(fnvOffset, []byte(s))
+}
+
+func fnvHash(h uint64, b []byte) uint64 {
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime
+	}
+	return h
+}
+
+// 5-tuple of a packet
+type Flow struct {
+	Src     netip.Addr
+	Dst     netip.Addr
+	Proto   uint8
+	SrcPort uint16
+	DstPort uint16
+}
+
+// reversed flow, for the replies
+func (f Flow) Reverse() Flow {
+	return Flow{
+		Src:     f.Dst,
+		Dst:     f.Src,
+		Proto:   f.Proto,
+		SrcPort: f.DstPort,
+		DstPort: f.SrcPort,
+	}
+}
+
+// parse the 5-tuple of an ipv4 or ipv6 packet. ports are zero for fragments and protocols without ports
+func ParseFlow(packet []byte) (Flow, bool) {
+	flow := Flow{}
+	var payload []byte
+	switch IPVersion(packet) {
+	case 4:
+		flow.Src = netip.AddrFrom4([4]byte(packet[12:16]))
+		flow.Dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		flow.Proto = packet[9]
+		ihl := int(packet[0]&0x0f) * 4
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff == 0 && ihl >= ipv4HeaderSize && len(packet) >= ihl {
+			payload = packet[ihl:]
+		}
+	case 6:
+		flow.Src = netip.AddrFrom16([16]byte(packet[8:24]))
+		flow.Dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		flow.Proto, payload = ipv6Payload(packet)
+	default:
+		return flow, false
+	}
+	if (flow.Proto == protoTCP || flow.Proto == protoUDP || flow.Proto == protoSCTP) && len(payload) >= 4 {
+		flow.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+		flow.DstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+	return flow, true
+}
+
+// upper layer protocol and payload of an ipv6 packet, extension headers are skipped.
+// the payload is nil for fragments and truncated extension headers
+func ipv6Payload(packet []byte) (byte, []byte) {
+	proto := packet[6]
+	payload := packet[ipv6HeaderSize:]
+	for {
+		switch proto {
+		case protoHopByHop, protoRouting, protoDstOpts:
+			if len(payload) < 8 || len(payload) < (int(payload[1])+1)*8 {
+				return proto, nil
+			}
+			proto, payload = payload[0], payload[(int(payload[1])+1)*8:]
+		case protoFragment:
+			if len(payload) < 8 {
+				return proto, nil
+			}
+			// fragments have no ports, like ipv4 fragments
+			return payload[0], nil
+		default:
+			return proto, payload
+		}
+	}
+}
+
+// decrement the ttl of an ipv4 packet or the hop limit of an ipv6 packet, returns the new value.
+// packets with a zero ttl are not changed
+func DecrementTTL(packet []byte) int {
+	switch IPVersion(packet) {
+	case 4:
+		if packet[8] == 0 {
+			return 0
+		}
+		// incremental header checksum update, HC' = ~(~HC + ~m + m') of rfc 1624. the ttl is the high byte of its word,
+		// the result is the same as a recomputed checksum, never 0xffff
+		old := binary.BigEndian.Uint16(packet[8:10])
+		packet[8] -= 1
+		sum := uint32(^binary.BigEndian.Uint16(packet[10:12])) + uint32(^old) + uint32(binary.BigEndian.Uint16(packet[8:10]))
+		sum = (sum & 0xffff) + (sum >> 16)
+		sum = (sum & 0xffff) + (sum >> 16)
+		binary.BigEndian.PutUint16(packet[10:12], ^uint16(sum))
+		return int(packet[8])
+	case 6:
+		if packet[7] == 0 {
+			return 0
+		}
+		packet[7] -= 1
+		return int(packet[7])
+	}
+	return 0
+}
+
+// dscp of the packet, the upper 6 bits of the ipv4 tos or the ipv6 traffic class. 0 if it's not an ip packet
+func DSCP(packet []byte) uint8 {
+	switch IPVersion(packet) {
+	case 4:
+		return packet[1] >> 2
+	case 6:
+		return (packet[0]&0x0f)<<2 | packet[1]>>6
+	}
+	return 0
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// ones' complement checksum of the data
+func checksum(data []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// ipv4 header with the ttl and a computed checksum
+func ipv4Header(ttl uint8, id uint16) []byte {
+	header := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, ttl, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	binary.BigEndian.PutUint16(header[4:6], id)
+	binary.BigEndian.PutUint16(header[10:12], checksum(header))
+	return header
+}
+
+// header whose checksum is the value, found by the identification field
+func ipv4HeaderWithChecksum(t *testing.T, ttl uint8, sum uint16) []byte {
+	for id := 0; id <= 0xffff; id++ {
+		if header := ipv4Header(ttl, uint16(id)); binary.BigEndian.Uint16(header[10:12]) == sum {
+			return header
+		}
+	}
+	t.Fatalf("no header of checksum %#04x", sum)
+	return nil
+}
+
+// test the ttl is decremented and the checksum is the same as a recomputed one, and the hop limit of ipv6 packets
+func TestDecrementTTL(t *testing.T) {
+	headers := [][]byte{
+		// the new checksum wraps to 0x0000, not 0xffff
+		ipv4HeaderWithChecksum(t, 64, 0xfeff),
+		ipv4HeaderWithChecksum(t, 64, 0x0000),
+		ipv4HeaderWithChecksum(t, 64, 0xff00),
+		ipv4Header(1, 0),
+		ipv4Header(255, 0xffff),
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		headers = append(headers, ipv4Header(uint8(1+rnd.Intn(255)), uint16(rnd.Intn(0x10000))))
+	}
+	for _, header := range headers {
+		ttl := header[8]
+		if got := DecrementTTL(header); got != int(ttl)-1 || header[8] != ttl-1 {
+			t.Fatalf("ttl %d decremented to %d", ttl, got)
+		}
+		want := binary.BigEndian.Uint16(ipv4Header(header[8], binary.BigEndian.Uint16(header[4:6]))[10:12])
+		if got := binary.BigEndian.Uint16(header[10:12]); got != want {
+			t.Fatalf("checksum %#04x, recomputed %#04x", got, want)
+		}
+	}
+	// a zero ttl is not changed
+	header := ipv4Header(0, 0)
+	if DecrementTTL(header) != 0 || header[8] != 0 || checksum(header) != 0 {
+		t.Fatal("zero ttl changed")
+	}
+
+	packet := make([]byte, 40)
+	packet[0], packet[7] = 0x60, 2
+	if DecrementTTL(packet) != 1 || DecrementTTL(packet) != 0 || DecrementTTL(packet) != 0 || packet[7] != 0 {
+		t.Fatalf("hop limit %d", packet[7])
+	}
+	if DecrementTTL([]byte{0x45}) != 0 {
+		t.Fatal("truncated packet decremented")
+	}
+}
+
+// ipv4 packet from 10.0.0.1 to 10.0.0.2, flags are the flags and fragment offset field
+func ipv4Packet(proto uint8, flags uint16, payload ...byte) []byte {
+	header := ipv4Header(64, 0)
+	header[9] = proto
+	binary.BigEndian.PutUint16(header[6:8], flags)
+	return append(header, payload...)
+}
+
+// ipv6 packet from fd00::1 to fd00::2, the payload starts with the next header
+func ipv6Packet(next uint8, payload ...byte) []byte {
+	header := make([]byte, ipv6HeaderSize)
+	header[0], header[6], header[7] = 0x60, next, 64
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(payload)))
+	copy(header[8:24], net.ParseIP("fd00::1"))
+	copy(header[24:40], net.ParseIP("fd00::2"))
+	return append(header, payload...)
+}
+
+// ports 12345 to 53 followed by the rest of a udp header
+var udpPorts = []byte{0x30, 0x39, 0x00, 0x35, 0, 8, 0, 0}
+
+// test the ip version is only reported for complete headers
+func TestIPVersion(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		packet  []byte
+		version int
+	}{
+		{"empty", nil, 0},
+		{"ipv4", ipv4Header(64, 0), 4},
+		{"truncated ipv4", ipv4Header(64, 0)[:19], 0},
+		{"ipv6", ipv6Packet(protoUDP), 6},
+		{"truncated ipv6", ipv6Packet(protoUDP)[:39], 0},
+		{"not ip", []byte{0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0},
+	} {
+		if got := IPVersion(c.packet); got != c.version {
+			t.Fatalf("%s: version %d, want %d", c.name, got, c.version)
+		}
+	}
+}
+
+// test the addresses of ipv4 and ipv6 packets, truncated packets have none
+func TestPacketAddresses(t *testing.T) {
+	for _, c := range []struct {
+		packet   []byte
+		src, dst string
+	}{
+		{ipv4Packet(protoUDP, 0, udpPorts...), "10.0.0.1", "10.0.0.2"},
+		{ipv6Packet(protoUDP, udpPorts...), "fd00::1", "fd00::2"},
+	} {
+		src, dst, ok := PacketAddresses(c.packet)
+		if !ok || !src.Equal(net.ParseIP(c.src)) || !dst.Equal(net.ParseIP(c.dst)) {
+			t.Fatalf("addresses %s %s %v, want %s %s", src, dst, ok, c.src, c.dst)
+		}
+	}
+	for _, packet := range [][]byte{nil, ipv4Header(64, 0)[:19], ipv6Packet(protoUDP)[:39]} {
+		if src, dst, ok := PacketAddresses(packet); ok {
+			t.Fatalf("truncated packet of %d bytes has addresses %s %s", len(packet), src, dst)
+		}
+	}
+}
+
+// test the 5-tuple of ipv4 and ipv6 packets. fragments and truncated upper layer headers have no ports,
+// and ipv6 extension headers are skipped
+func TestParseFlow(t *testing.T) {
+	v4 := func(proto uint8, srcPort, dstPort uint16) Flow {
+		return Flow{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), proto, srcPort, dstPort}
+	}
+	v6 := func(proto uint8, srcPort, dstPort uint16) Flow {
+		return Flow{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2"), proto, srcPort, dstPort}
+	}
+	for _, c := range []struct {
+		name   string
+		packet []byte
+		flow   Flow
+	}{
+		{"ipv4 udp", ipv4Packet(protoUDP, 0, udpPorts...), v4(protoUDP, 12345, 53)},
+		{"ipv4 tcp", ipv4Packet(protoTCP, 0x4000, udpPorts...), v4(protoTCP, 12345, 53)},
+		{"ipv4 icmp", ipv4Packet(1, 0, 8, 0, 0, 0), v4(1, 0, 0)},
+		{"ipv4 first fragment", ipv4Packet(protoUDP, 0x2000, udpPorts...), v4(protoUDP, 0, 0)},
+		{"ipv4 fragment", ipv4Packet(protoUDP, 0x0010, udpPorts...), v4(protoUDP, 0, 0)},
+		{"ipv4 truncated udp", ipv4Packet(protoUDP, 0, udpPorts[:3]...), v4(protoUDP, 0, 0)},
+		{"ipv6 udp", ipv6Packet(protoUDP, udpPorts...), v6(protoUDP, 12345, 53)},
+		{"ipv6 truncated udp", ipv6Packet(protoUDP, udpPorts[:3]...), v6(protoUDP, 0, 0)},
+		{"ipv6 hop by hop", ipv6Packet(protoHopByHop, extension6(protoUDP, udpPorts)...), v6(protoUDP, 12345, 53)},
+		{"ipv6 extension chain", ipv6Packet(protoHopByHop, extension6(protoRouting, extension6(protoDstOpts, extension6(protoTCP, udpPorts)))...), v6(protoTCP, 12345, 53)},
+		{"ipv6 long extension", ipv6Packet(protoDstOpts, append([]byte{protoUDP, 1}, append(make([]byte, 14), udpPorts...)...)...), v6(protoUDP, 12345, 53)},
+		{"ipv6 fragment", ipv6Packet(protoFragment, extension6(protoUDP, udpPorts)...), v6(protoUDP, 0, 0)},
+		{"ipv6 truncated extension", ipv6Packet(protoHopByHop, protoUDP, 0, 0, 0), v6(protoHopByHop, 0, 0)},
+		{"ipv6 extension beyond the packet", ipv6Packet(protoHopByHop, append([]byte{protoUDP, 1}, make([]byte, 8)...)...), v6(protoHopByHop, 0, 0)},
+	} {
+		flow, ok := ParseFlow(c.packet)
+		if !ok || flow != c.flow {
+			t.Fatalf("%s: flow %+v %v, want %+v", c.name, flow, ok, c.flow)
+		}
+	}
+	for _, packet := range [][]byte{nil, ipv4Header(64, 0)[:19], ipv6Packet(protoUDP)[:39]} {
+		if flow, ok := ParseFlow(packet); ok {
+			t.Fatalf("truncated packet of %d bytes has flow %+v", len(packet), flow)
+		}
+	}
+	if got, want := v4(protoUDP, 12345, 53).Reverse(), (Flow{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), protoUDP, 53, 12345}); got != want {
+		t.Fatalf("reversed flow %+v, want %+v", got, want)
+	}
+}
+
+// test packets of a flow have the same hash, including fragments and ipv6 extension headers
+func TestFlowHash(t *testing.T) {
+	otherPorts := []byte{0x30, 0x3a, 0x00, 0x35, 0, 8, 0, 0}
+	same := [][][]byte{
+		{ipv4Packet(protoUDP, 0, udpPorts...), ipv4Packet(protoUDP, 0, append(udpPorts, 1, 2, 3)...)},
+		// fragments are hashed without ports
+		{ipv4Packet(protoUDP, 0x2000, udpPorts...), ipv4Packet(protoUDP, 0x0010, 1, 2, 3, 4)},
+		{ipv6Packet(protoUDP, udpPorts...), ipv6Packet(protoHopByHop, extension6(protoUDP, udpPorts[:4])...)},
+		{ipv6Packet(protoFragment, protoUDP, 0, 0, 1, 0, 0, 0, 1), ipv6Packet(protoFragment, protoUDP, 0, 0, 8, 0, 0, 0, 1, 9, 9, 9, 9)},
+	}
+	for i, packets := range same {
+		if a, b := FlowHash(packets[0]), FlowHash(packets[1]); a != b || a == 0 {
+			t.Fatalf("packets %d of a flow have hashes %#x and %#x", i, a, b)
+		}
+	}
+	different := [][][]byte{
+		{ipv4Packet(protoUDP, 0, udpPorts...), ipv4Packet(protoUDP, 0, otherPorts...)},
+		{ipv4Packet(protoUDP, 0, udpPorts...), ipv4Packet(protoTCP, 0, udpPorts...)},
+		{ipv6Packet(protoUDP, udpPorts...), ipv6Packet(protoHopByHop, extension6(protoUDP, otherPorts)...)},
+		{ipv4Packet(protoUDP, 0, udpPorts...), ipv6Packet(protoUDP, udpPorts...)},
+	}
+	for i, packets := range different {
+		if FlowHash(packets[0]) == FlowHash(packets[1]) {
+			t.Fatalf("packets %d of different flows have the same hash", i)
+		}
+	}
+	for _, packet := range [][]byte{nil, ipv4Header(64, 0)[:19], ipv6Packet(protoUDP)[:39]} {
+		if h := FlowHash(packet); h != 0 {
+			t.Fatalf("truncated packet of %d bytes has hash %#x", len(packet), h)
+		}
+	}
+}
+
+// an 8 byte ipv6 extension header followed by the next header
+func extension6(next uint8, rest []byte) []byte {
+	return append([]byte{next, 0, 0, 0, 0, 0, 0, 0}, rest...)
+}
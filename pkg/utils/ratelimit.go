@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// token bucket rate limiter
+type TokenBucket struct {
+	// tokens added per second
+	rate float64
+	// max tokens
+	burst float64
+	// available tokens
+	tokens float64
+	// last refill time
+	last time.Time
+	// lock
+	lock sync.Mutex
+}
+
+// create a full token bucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take a token if there is one
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// take n tokens if there are enough
+func (b *TokenBucket) AllowN(n int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// take n tokens even if there are not enough, returns the time until the debt is paid off.
+// callers wait this long before sending, so the average rate is kept
+func (b *TokenBucket) ReserveN(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take n tokens if the debt is paid off within max, returns the time until it's paid off.
+// no tokens are taken if it takes longer
+func (b *TokenBucket) ReserveWithin(n int, max time.Duration) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	tokens := b.tokens - float64(n)
+	if tokens >= 0 {
+		b.tokens = tokens
+		return 0, true
+	}
+	delay := time.Duration(-tokens / b.rate * float64(time.Second))
+	if delay > max {
+		return delay, false
+	}
+	b.tokens = tokens
+	return delay, true
+}
+
+// add the tokens since the last refill. must be called with the lock held
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// test the burst is taken at once, then tokens come at the rate
+func TestTokenBucketAllow(t *testing.T) {
+	b := NewTokenBucket(1000, 100)
+	if !b.AllowN(100) {
+		t.Fatal("burst not allowed")
+	}
+	if b.AllowN(10) {
+		t.Fatal("allowed over the burst")
+	}
+	time.Sleep(time.Millisecond * 50)
+	if !b.AllowN(40) {
+		t.Fatal("tokens not refilled at the rate")
+	}
+	// the bucket never holds more than the burst
+	time.Sleep(time.Millisecond * 200)
+	if b.AllowN(101) {
+		t.Fatal("allowed over the burst after idling")
+	}
+}
+
+// test reservations go into debt and return the time to pay it off
+func TestTokenBucketReserve(t *testing.T) {
+	b := NewTokenBucket(1000, 100)
+	if delay := b.ReserveN(100); delay != 0 {
+		t.Fatalf("burst delayed %s", delay)
+	}
+	// 50 tokens in debt at 1000 tokens per second
+	if delay := b.ReserveN(50); delay < time.Millisecond*45 || delay > time.Millisecond*50 {
+		t.Fatalf("debt of 50 tokens delayed %s", delay)
+	}
+	// over the max delay, nothing is taken
+	if delay, ok := b.ReserveWithin(1000, time.Millisecond*100); ok || delay < time.Second {
+		t.Fatalf("reserved %s over the max delay", delay)
+	}
+	if delay, ok := b.ReserveWithin(40, time.Millisecond*100); !ok || delay < time.Millisecond*85 || delay > time.Millisecond*90 {
+		t.Fatalf("reserved within the max delay: %s %v", delay, ok)
+	}
+}
@@ -1,12 +1,18 @@
 package utils
 
 import (
+	"context"
 	"sync"
 	"time"
 )
 
 var RouteTable *HostRoute
 
+const (
+	// ipv4 default route
+	defaultRoute = "0.0.0.0/0"
+)
+
 func init() {
 	RouteTable = &HostRoute{
 		rules:   make(map[string]route),
@@ -21,6 +27,9 @@ type route struct {
 	target  string
 	gateway string
 	ref     int
+	// routes to remove when flushing, done is closed after they are removed
+	flush []route
+	done  chan struct{}
 }
 
 // host route tables
@@ -76,6 +85,32 @@ func (h *HostRoute) RemoveRoute(target string) error {
 	return nil
 }
 
+// remove all the routes and restore the default route, waits until they are removed
+func (h *HostRoute) Flush(ctx context.Context) error {
+	h.mu.Lock()
+	flush := route{
+		flush: make([]route, 0, len(h.rules)),
+		done:  make(chan struct{}),
+	}
+	for _, r := range h.rules {
+		flush.flush = append(flush.flush, r)
+	}
+	h.rules = make(map[string]route)
+	select {
+	case h.actions <- flush:
+		h.mu.Unlock()
+	case <-ctx.Done():
+		h.mu.Unlock()
+		return ctx.Err()
+	}
+	select {
+	case <-flush.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // refresh route
 func (h *HostRoute) Start() error {
 
@@ -88,7 +123,23 @@ func (h *HostRoute) Start() error {
 		select {
 		// handle route update and delete
 		case r := <-h.actions:
-			if r.ref <= 0 {
+			if r.done != nil {
+				for _, f := range r.flush {
+					if f.target == defaultRoute {
+						// restore the system default route
+						logger.Printf("restore host route %s -> %s", f.target, defaultGateway)
+						if err := SetRoute(f.target, defaultGateway); err != nil {
+							logger.Printf("error set route %s", err)
+						}
+						continue
+					}
+					logger.Printf("delete host route %s -> %s", f.target, f.gateway)
+					if err := RemoveRoute(f.target, f.gateway); err != nil {
+						logger.Printf("error set route %s", err)
+					}
+				}
+				close(r.done)
+			} else if r.ref <= 0 {
 				// delete route
 				logger.Printf("delete host route %s -> %s", r.target, r.gateway)
 				if err := RemoveRoute(r.target, r.gateway); err != nil {
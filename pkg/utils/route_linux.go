@@ -13,6 +13,10 @@ var (
 	defaultGateway string
 	// default interface
 	defaultInterface string
+	// mss clamp for the tunnel mtu 1400
+	tcpMSS = "1360"
+	// ipv6 header is 20 bytes larger
+	tcpMSS6 = "1340"
 	// iptables output partterns
 	isNotExistPatterns = []string{
 		"Bad rule (does a matching rule exist in that chain?)",
@@ -61,13 +65,13 @@ func RemoveRoute(network string, gateway string) error {
 	return nil
 }
 
-// ensure iptables rule
-func iptablesEnsureRule(table, chain string, rule ...string) error {
+// ensure iptables rule, bin is iptables or ip6tables
+func iptablesEnsureRule(bin, table, chain string, rule ...string) error {
 	cmd := []string{"-t", table, "-C", chain}
 	cmd = append(cmd, rule...)
 	// check rule exists
 	for {
-		if _, err := RunCmd("iptables", cmd...); err != nil {
+		if _, err := RunCmd(bin, cmd...); err != nil {
 			// if something went wrong with the command
 			if !isNotExist(err.Error()) {
 				return err
@@ -80,12 +84,12 @@ func iptablesEnsureRule(table, chain string, rule ...string) error {
 	}
 }
 
-// ensure iptables chain
-func iptablesEnsureChain(table, chain string) error {
+// ensure iptables chain, bin is iptables or ip6tables
+func iptablesEnsureChain(bin, table, chain string) error {
 	cmd := []string{"-t", table, "-L", chain}
 	// check chain exists
 	for {
-		if _, err := RunCmd("iptables", cmd...); err != nil {
+		if _, err := RunCmd(bin, cmd...); err != nil {
 			// if something went wrong with the command
 			if !isNotExist(err.Error()) {
 				return err
@@ -127,12 +131,12 @@ func SetupNAT(tun string) error {
 		{
 			Table: "mangle",
 			Chain: "GOOSE-FORWARD",
-			Rule:  []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-i", tun, "-j", "TCPMSS", "--set-mss", "940"},
+			Rule:  []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-i", tun, "-j", "TCPMSS", "--set-mss", tcpMSS},
 		},
 		{
 			Table: "mangle",
 			Chain: "GOOSE-FORWARD",
-			Rule:  []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-o", tun, "-j", "TCPMSS", "--set-mss", "940"},
+			Rule:  []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-o", tun, "-j", "TCPMSS", "--set-mss", tcpMSS},
 		},
 	}
 
@@ -213,11 +217,11 @@ func SetupNAT(tun string) error {
 	for _, rules := range [][]Rule{mssClamp, markMASQ, blockDoH, masq, system} {
 		for _, rule := range rules {
 			//  ensure chain
-			if err := iptablesEnsureChain(rule.Table, rule.Chain); err != nil {
+			if err := iptablesEnsureChain("iptables", rule.Table, rule.Chain); err != nil {
 				return err
 			}
 			// ensure rule
-			if err := iptablesEnsureRule(rule.Table, rule.Chain, rule.Rule...); err != nil {
+			if err := iptablesEnsureRule("iptables", rule.Table, rule.Chain, rule.Rule...); err != nil {
 				return err
 			}
 		}
@@ -225,3 +229,119 @@ func SetupNAT(tun string) error {
 
 	return nil
 }
+
+// set up ip6tables rules for forwarded ipv6 networks
+func SetupNAT6(tun string) error {
+	// enabled ipv6 forward
+	if out, err := RunCmd("sysctl", "-w", "net.ipv6.conf.all.forwarding=1"); err != nil {
+		return errors.Wrap(err, string(out))
+	}
+
+	rules := []Rule{
+		{
+			Table: "mangle",
+			Chain: "GOOSE-FORWARD",
+			Rule:  []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-i", tun, "-j", "TCPMSS", "--set-mss", tcpMSS6},
+		},
+		{
+			Table: "mangle",
+			Chain: "GOOSE-FORWARD",
+			Rule:  []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-o", tun, "-j", "TCPMSS", "--set-mss", tcpMSS6},
+		},
+		{
+			Table: "mangle",
+			Chain: "GOOSE-FORWARD",
+			Rule:  []string{"-i", tun, "-j", "MARK", "--set-xmark", "0x0200/0x0200"},
+		},
+		{
+			Table: "nat",
+			Chain: "GOOSE-MASQ",
+			Rule:  []string{"-m", "mark", "--mark", "0x0200/0x0200", "-j", "MASQUERADE"},
+		},
+		{
+			Table: "mangle",
+			Chain: "FORWARD",
+			Rule:  []string{"-j", "GOOSE-FORWARD"},
+		},
+	}
+	if !options.Router {
+		rules = append(rules, Rule{
+			Table: "nat",
+			Chain: "POSTROUTING",
+			Rule:  []string{"-j", "GOOSE-MASQ"},
+		})
+	}
+	for _, rule := range rules {
+		if err := iptablesEnsureChain("ip6tables", rule.Table, rule.Chain); err != nil {
+			return err
+		}
+		if err := iptablesEnsureRule("ip6tables", rule.Table, rule.Chain, rule.Rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete iptables rule until it's gone, bin is iptables or ip6tables
+func iptablesDeleteRule(bin, table, chain string, rule ...string) error {
+	cmd := []string{"-t", table, "-D", chain}
+	cmd = append(cmd, rule...)
+	for {
+		if _, err := RunCmd(bin, cmd...); err != nil {
+			if !isNotExist(err.Error()) {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// flush and delete iptables chain, bin is iptables or ip6tables
+func iptablesDeleteChain(bin, table, chain string) error {
+	for _, op := range []string{"-F", "-X"} {
+		if _, err := RunCmd(bin, "-t", table, op, chain); err != nil {
+			if !isNotExist(err.Error()) {
+				return err
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// remove the jumps to the goose chains and the chains themselves
+func removeNAT(bin string, chains []Rule) error {
+	system := []Rule{
+		{Table: "filter", Chain: "FORWARD", Rule: []string{"-j", "GOOSE-FORWARD"}},
+		{Table: "mangle", Chain: "FORWARD", Rule: []string{"-j", "GOOSE-FORWARD"}},
+		{Table: "nat", Chain: "POSTROUTING", Rule: []string{"-j", "GOOSE-MASQ"}},
+	}
+	for _, rule := range system {
+		if err := iptablesDeleteRule(bin, rule.Table, rule.Chain, rule.Rule...); err != nil {
+			return err
+		}
+	}
+	for _, chain := range chains {
+		if err := iptablesDeleteChain(bin, chain.Table, chain.Chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove iptables rules set up by SetupNAT
+func RemoveNAT() error {
+	return removeNAT("iptables", []Rule{
+		{Table: "filter", Chain: "GOOSE-FORWARD"},
+		{Table: "mangle", Chain: "GOOSE-FORWARD"},
+		{Table: "nat", Chain: "GOOSE-MASQ"},
+	})
+}
+
+// remove ip6tables rules set up by SetupNAT6
+func RemoveNAT6() error {
+	return removeNAT("ip6tables", []Rule{
+		{Table: "mangle", Chain: "GOOSE-FORWARD"},
+		{Table: "nat", Chain: "GOOSE-MASQ"},
+	})
+}
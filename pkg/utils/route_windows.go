@@ -145,3 +145,18 @@ func RemoveRoute(network string, gateway string) error {
 func SetupNAT(tun string) error {
 	return nil
 }
+
+// ipv6 nat rules
+func SetupNAT6(tun string) error {
+	return nil
+}
+
+// remove nat rules
+func RemoveNAT() error {
+	return nil
+}
+
+// remove ipv6 nat rules
+func RemoveNAT6() error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package wire
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -41,6 +42,17 @@ type Wire interface {
 	Close() error
 }
 
+// the packet is larger than the wire can send, it's not sent.
+// the router tells the source the mtu, the wire stays open
+type PacketTooBigError struct {
+	// largest ip packet the wire can send
+	MTU int
+}
+
+func (e *PacketTooBigError) Error() string {
+	return fmt.Sprintf("packet too big, mtu %d", e.MTU)
+}
+
 // base wire
 type BaseWire struct{}
 
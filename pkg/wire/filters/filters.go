@@ -54,24 +54,32 @@ func (filter *Filter) Encode(msg *message.Message) error {
 }
 
 func (filter *Filter) Decode(msg *message.Message) error {
-	if err := filter.Wire.Decode(msg); err != nil {
-		return err
-	}
-	if msg.Type == message.MessageTypePacket {
+	for {
+		if err := filter.Wire.Decode(msg); err != nil {
+			return err
+		}
+		if msg.Type != message.MessageTypePacket {
+			return nil
+		}
 		packet, ok := msg.Payload.(message.Packet)
 		if !ok {
 			return errors.Errorf("got invalid packet struct %s", msg.Payload)
 		}
+		drop := false
 		for _, mid := range filter.middlewares {
-			drop, err := mid.Ingress(&packet)
-			if err != nil {
+			var err error
+			if drop, err = mid.Ingress(&packet); err != nil {
 				return err
 			}
 			if drop {
-				return nil
+				break
 			}
 		}
+		// dropped packet, read the next message
+		if drop {
+			continue
+		}
 		msg.Payload = packet
+		return nil
 	}
-	return nil
 }
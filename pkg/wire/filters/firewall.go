@@ -0,0 +1,405 @@
+package filters
+
+import (
+	"container/list"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+const (
+	// firewall actions
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+
+	// connection states
+	StateNew         = "new"
+	StateEstablished = "established"
+
+	// rules for all peers
+	AnyPeer = "*"
+
+	// conntrack timeouts
+	conntrackTCPTimeout   = time.Minute * 30
+	conntrackOtherTimeout = time.Second * 60
+	// max tracked flows of a peer, the least recently seen flow is evicted
+	conntrackPeerEntries = 16384
+)
+
+var (
+	// protocol numbers
+	protocols = map[string]uint8{
+		"icmp":   1,
+		"tcp":    6,
+		"udp":    17,
+		"icmpv6": 58,
+		"sctp":   132,
+	}
+)
+
+// firewall rule, empty fields match everything
+type FirewallRule struct {
+	// allow or deny
+	Action string `json:"action"`
+	// source cidrs
+	Src []string `json:"src,omitempty"`
+	// destination cidrs
+	Dst []string `json:"dst,omitempty"`
+	// protocol name, eg. tcp, udp, icmp
+	Proto string `json:"proto,omitempty"`
+	// destination ports or port ranges, eg. 22, 8000-8080
+	Ports []string `json:"ports,omitempty"`
+	// new or established
+	State string `json:"state,omitempty"`
+
+	// parsed fields
+	src   []net.IPNet
+	dst   []net.IPNet
+	proto uint8
+	ports [][2]uint16
+}
+
+// firewall rules of peers
+//
+//	{
+//	  "default": "deny",
+//	  "rules": {
+//	    "*": [{"action": "allow", "state": "established"}, {"action": "allow", "proto": "icmp"}],
+//	    "12D3KooW...": [{"action": "allow", "proto": "tcp", "dst": ["10.1.1.0/24"], "ports": ["22"]}]
+//	  }
+//	}
+type FirewallRules struct {
+	// action of packets matching no rule, allow if empty
+	Default string `json:"default"`
+	// rules by peer id or wire type, "*" for all peers
+	Rules map[string][]FirewallRule `json:"rules"`
+}
+
+// stateful firewall shared by all the ports
+type Firewall struct {
+	// rules file
+	path string
+	// rules
+	rules *FirewallRules
+	// tracked flows by peer
+	conntrack map[string]*conntrack
+	// last expiring time
+	expiredAt time.Time
+	// lock
+	lock sync.Mutex
+}
+
+// a tracked flow and the last seen time
+type trackedFlow struct {
+	flow utils.Flow
+	seen time.Time
+}
+
+// tracked flows of a peer, so a peer can only evict its own flows
+type conntrack struct {
+	flows map[utils.Flow]*list.Element
+	// tracked flows, the most recently seen in front
+	lru *list.List
+}
+
+// firewall middleware of a port
+type portFirewall struct {
+	*Firewall
+	// conntrack key, the peer id or the endpoint
+	peer string
+	// rule keys, most specific first
+	keys []string
+}
+
+func NewFirewall(path string) (*Firewall, error) {
+	f := &Firewall{
+		path:      path,
+		conntrack: make(map[string]*conntrack),
+		expiredAt: time.Now(),
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload rules from the file, tracked flows are kept
+func (f *Firewall) Reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rules := &FirewallRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return errors.Wrapf(err, "invalid firewall rules %s", f.path)
+	}
+	if rules.Default == "" {
+		rules.Default = ActionAllow
+	}
+	if rules.Default != ActionAllow && rules.Default != ActionDeny {
+		return errors.Errorf("invalid firewall default action %s", rules.Default)
+	}
+	for key := range rules.Rules {
+		for i := range rules.Rules[key] {
+			if err := rules.Rules[key][i].parse(); err != nil {
+				return errors.Wrapf(err, "invalid firewall rule %d of %s", i, key)
+			}
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rules = rules
+	return nil
+}
+
+// middleware for a port, flows are tracked by the peer. rules are looked up by the keys in order, then "*"
+func (f *Firewall) Middleware(peer string, keys ...string) Middleware {
+	return &portFirewall{
+		Firewall: f,
+		peer:     peer,
+		keys:     append(keys, AnyPeer),
+	}
+}
+
+// filter packets from the peer
+func (f *portFirewall) Ingress(p *message.Packet) (bool, error) {
+	flow, ok := utils.ParseFlow(p.Data)
+	if !ok {
+		return true, nil
+	}
+	now := time.Now()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expire(now)
+
+	// icmp errors of a tracked flow are established, they are not tracked themselves
+	related, isError := icmpErrorFlow(p.Data)
+	established := f.tracked(f.peer, flow, now)
+	if isError {
+		established = f.tracked(f.peer, related, now)
+	}
+	action := f.rules.Default
+	for _, key := range f.keys {
+		rules, ok := f.rules.Rules[key]
+		if !ok {
+			continue
+		}
+		matched := false
+		for i := range rules {
+			if rules[i].match(flow, established) {
+				action, matched = rules[i].Action, true
+				break
+			}
+		}
+		if matched {
+			break
+		}
+	}
+	if action != ActionAllow {
+		return true, nil
+	}
+	if !isError {
+		f.track(f.peer, flow, now)
+	}
+	return false, nil
+}
+
+// packets to the peer are not filtered, their flows are tracked so replies are established
+func (f *portFirewall) Egress(p *message.Packet) (bool, error) {
+	flow, ok := utils.ParseFlow(p.Data)
+	if !ok {
+		return false, nil
+	}
+	now := time.Now()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expire(now)
+	f.track(f.peer, flow, now)
+	return false, nil
+}
+
+// true if the flow or its reply is tracked for the peer and not timed out
+func (f *Firewall) tracked(peer string, flow utils.Flow, now time.Time) bool {
+	ct, ok := f.conntrack[peer]
+	if !ok {
+		return false
+	}
+	timeout := conntrackTimeout(flow)
+	for _, key := range []utils.Flow{flow, flow.Reverse()} {
+		if e, ok := ct.flows[key]; ok && now.Sub(e.Value.(*trackedFlow).seen) < timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// track the flow of the peer, the least recently seen flow of the peer is evicted when it has too many
+func (f *Firewall) track(peer string, flow utils.Flow, now time.Time) {
+	ct, ok := f.conntrack[peer]
+	if !ok {
+		ct = &conntrack{flows: make(map[utils.Flow]*list.Element), lru: list.New()}
+		f.conntrack[peer] = ct
+	}
+	if e, ok := ct.flows[flow]; ok {
+		e.Value.(*trackedFlow).seen = now
+		ct.lru.MoveToFront(e)
+		return
+	}
+	if ct.lru.Len() >= conntrackPeerEntries {
+		oldest := ct.lru.Back()
+		ct.lru.Remove(oldest)
+		delete(ct.flows, oldest.Value.(*trackedFlow).flow)
+	}
+	ct.flows[flow] = ct.lru.PushFront(&trackedFlow{flow: flow, seen: now})
+}
+
+// drop timed out flows
+func (f *Firewall) expire(now time.Time) {
+	if now.Sub(f.expiredAt) < conntrackOtherTimeout {
+		return
+	}
+	for peer, ct := range f.conntrack {
+		for e := ct.lru.Front(); e != nil; {
+			next := e.Next()
+			if tracked := e.Value.(*trackedFlow); now.Sub(tracked.seen) > conntrackTimeout(tracked.flow) {
+				ct.lru.Remove(e)
+				delete(ct.flows, tracked.flow)
+			}
+			e = next
+		}
+		if ct.lru.Len() == 0 {
+			delete(f.conntrack, peer)
+		}
+	}
+	f.expiredAt = now
+}
+
+// flow of the packet an icmp error is about, false if the packet is not an icmp error
+func icmpErrorFlow(packet []byte) (utils.Flow, bool) {
+	var icmp []byte
+	switch utils.IPVersion(packet) {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[9] != protocols["icmp"] || len(packet) < ihl+8 {
+			return utils.Flow{}, false
+		}
+		icmp = packet[ihl:]
+		// destination unreachable, time exceeded, parameter problem
+		if icmp[0] != 3 && icmp[0] != 11 && icmp[0] != 12 {
+			return utils.Flow{}, false
+		}
+	case 6:
+		if packet[6] != protocols["icmpv6"] || len(packet) < 40+8 {
+			return utils.Flow{}, false
+		}
+		icmp = packet[40:]
+		// destination unreachable, packet too big, time exceeded, parameter problem
+		if icmp[0] < 1 || icmp[0] > 4 {
+			return utils.Flow{}, false
+		}
+	default:
+		return utils.Flow{}, false
+	}
+	// the original packet follows the 8 bytes icmp header
+	original := icmp[8:]
+	if utils.IPVersion(original) != utils.IPVersion(packet) {
+		return utils.Flow{}, false
+	}
+	return utils.ParseFlow(original)
+}
+
+func conntrackTimeout(flow utils.Flow) time.Duration {
+	if flow.Proto == protocols["tcp"] {
+		return conntrackTCPTimeout
+	}
+	return conntrackOtherTimeout
+}
+
+func (rule *FirewallRule) parse() error {
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		return errors.Errorf("invalid action %s", rule.Action)
+	}
+	if rule.State != "" && rule.State != StateNew && rule.State != StateEstablished {
+		return errors.Errorf("invalid state %s", rule.State)
+	}
+	if rule.Proto != "" {
+		proto, ok := protocols[strings.ToLower(rule.Proto)]
+		if !ok {
+			return errors.Errorf("unknown protocol %s", rule.Proto)
+		}
+		rule.proto = proto
+	}
+	for _, cidrs := range []struct {
+		in  []string
+		out *[]net.IPNet
+	}{{rule.Src, &rule.src}, {rule.Dst, &rule.dst}} {
+		for _, cidr := range cidrs.in {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			*cidrs.out = append(*cidrs.out, *network)
+		}
+	}
+	for _, port := range rule.Ports {
+		lo, hi, found := strings.Cut(port, "-")
+		if !found {
+			hi = lo
+		}
+		from, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return errors.Errorf("invalid port %s", port)
+		}
+		to, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || to < from {
+			return errors.Errorf("invalid port %s", port)
+		}
+		rule.ports = append(rule.ports, [2]uint16{uint16(from), uint16(to)})
+	}
+	return nil
+}
+
+func (rule *FirewallRule) match(flow utils.Flow, established bool) bool {
+	if (rule.State == StateEstablished && !established) || (rule.State == StateNew && established) {
+		return false
+	}
+	if rule.proto != 0 && rule.proto != flow.Proto {
+		return false
+	}
+	if !matchNetworks(rule.src, flow.Src.AsSlice()) || !matchNetworks(rule.dst, flow.Dst.AsSlice()) {
+		return false
+	}
+	if len(rule.ports) == 0 {
+		return true
+	}
+	for _, r := range rule.ports {
+		if flow.DstPort >= r[0] && flow.DstPort <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// true if networks is empty or one of them contains the ip
+func matchNetworks(networks []net.IPNet, ip net.IP) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
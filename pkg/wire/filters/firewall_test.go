@@ -0,0 +1,210 @@
+package filters
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
+)
+
+// ipv4 packet with a payload
+func ipv4Packet(src, dst string, proto uint8, payload []byte) []byte {
+	packet := make([]byte, 20, 20+len(payload))
+	packet[0] = 0x45
+	packet[8] = 64
+	packet[9] = proto
+	copy(packet[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dst).AsSlice())
+	packet = append(packet, payload...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	return packet
+}
+
+// tcp or udp header with the ports
+func portsHeader(srcPort, dstPort uint16) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header[0:2], srcPort)
+	binary.BigEndian.PutUint16(header[2:4], dstPort)
+	return header
+}
+
+// icmp destination unreachable error about the original packet
+func icmpUnreachable(src, dst string, original []byte) []byte {
+	return ipv4Packet(src, dst, protocols["icmp"], append([]byte{3, 1, 0, 0, 0, 0, 0, 0}, original...))
+}
+
+func flowOf(t *testing.T, packet []byte) utils.Flow {
+	flow, ok := utils.ParseFlow(packet)
+	if !ok {
+		t.Fatalf("invalid packet %v", packet)
+	}
+	return flow
+}
+
+// test rule parsing, valid rules get their parsed fields
+func TestFirewallRuleParse(t *testing.T) {
+	cases := []struct {
+		name string
+		rule FirewallRule
+		ok   bool
+	}{
+		{"empty allow", FirewallRule{Action: ActionAllow}, true},
+		{"full", FirewallRule{Action: ActionDeny, Src: []string{"10.0.0.0/8"}, Dst: []string{"fd00::/8"}, Proto: "TCP", Ports: []string{"22", "8000-8080"}, State: StateNew}, true},
+		{"no action", FirewallRule{}, false},
+		{"unknown action", FirewallRule{Action: "reject"}, false},
+		{"unknown state", FirewallRule{Action: ActionAllow, State: "related"}, false},
+		{"unknown protocol", FirewallRule{Action: ActionAllow, Proto: "gre"}, false},
+		{"invalid cidr", FirewallRule{Action: ActionAllow, Src: []string{"10.0.0.1"}}, false},
+		{"invalid port", FirewallRule{Action: ActionAllow, Ports: []string{"ssh"}}, false},
+		{"port out of range", FirewallRule{Action: ActionAllow, Ports: []string{"65536"}}, false},
+		{"reversed range", FirewallRule{Action: ActionAllow, Ports: []string{"8080-8000"}}, false},
+	}
+	for i := range cases {
+		c := &cases[i]
+		err := c.rule.parse()
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: parse error %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+	rule := cases[1].rule
+	if rule.proto != 6 || len(rule.src) != 1 || len(rule.dst) != 1 || len(rule.ports) != 2 || rule.ports[1] != [2]uint16{8000, 8080} {
+		t.Fatalf("parsed rule %+v", rule)
+	}
+}
+
+// test rule matching of addresses, protocols, ports and states
+func TestFirewallRuleMatch(t *testing.T) {
+	ssh := flowOf(t, ipv4Packet("10.0.0.1", "10.1.1.2", protocols["tcp"], portsHeader(40000, 22)))
+	dns := flowOf(t, ipv4Packet("10.0.0.1", "10.2.0.1", protocols["udp"], portsHeader(40000, 53)))
+	ping := flowOf(t, ipv4Packet("10.0.0.1", "10.1.1.2", protocols["icmp"], make([]byte, 8)))
+	cases := []struct {
+		name        string
+		rule        FirewallRule
+		flow        utils.Flow
+		established bool
+		match       bool
+	}{
+		{"empty rule", FirewallRule{Action: ActionAllow}, ssh, false, true},
+		{"protocol", FirewallRule{Action: ActionAllow, Proto: "tcp"}, ssh, false, true},
+		{"other protocol", FirewallRule{Action: ActionAllow, Proto: "udp"}, ssh, false, false},
+		{"source", FirewallRule{Action: ActionAllow, Src: []string{"10.0.0.0/24"}}, ssh, false, true},
+		{"other source", FirewallRule{Action: ActionAllow, Src: []string{"10.9.0.0/16"}}, ssh, false, false},
+		{"destination", FirewallRule{Action: ActionAllow, Dst: []string{"10.9.0.0/16", "10.1.1.0/24"}}, ssh, false, true},
+		{"other destination", FirewallRule{Action: ActionAllow, Dst: []string{"10.1.1.0/24"}}, dns, false, false},
+		{"port", FirewallRule{Action: ActionAllow, Ports: []string{"22"}}, ssh, false, true},
+		{"port range", FirewallRule{Action: ActionAllow, Ports: []string{"50-60"}}, dns, false, true},
+		{"other port", FirewallRule{Action: ActionAllow, Ports: []string{"80", "443"}}, ssh, false, false},
+		{"ports of portless protocol", FirewallRule{Action: ActionAllow, Ports: []string{"22"}}, ping, false, false},
+		{"new", FirewallRule{Action: ActionAllow, State: StateNew}, ssh, false, true},
+		{"new established", FirewallRule{Action: ActionAllow, State: StateNew}, ssh, true, false},
+		{"established", FirewallRule{Action: ActionAllow, State: StateEstablished}, ssh, true, true},
+		{"established new", FirewallRule{Action: ActionAllow, State: StateEstablished}, ssh, false, false},
+	}
+	for _, c := range cases {
+		if err := c.rule.parse(); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if match := c.rule.match(c.flow, c.established); match != c.match {
+			t.Fatalf("%s: match %v, want %v", c.name, match, c.match)
+		}
+	}
+}
+
+// firewall of the rules in a temporary file
+func newTestFirewall(t *testing.T, rules string) *Firewall {
+	path := filepath.Join(t.TempDir(), "firewall.json")
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFirewall(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// test replies and icmp errors of tracked flows are established, per peer
+func TestFirewallConntrack(t *testing.T) {
+	f := newTestFirewall(t, `{"default": "deny", "rules": {"*": [{"action": "allow", "state": "established"}]}}`)
+	a := f.Middleware("peer-a", "peer-a", "ipfs")
+	b := f.Middleware("peer-b", "peer-b", "ipfs")
+
+	request := ipv4Packet("10.0.0.1", "10.1.1.2", protocols["tcp"], portsHeader(40000, 22))
+	reply := ipv4Packet("10.1.1.2", "10.0.0.1", protocols["tcp"], portsHeader(22, 40000))
+	other := ipv4Packet("10.1.1.2", "10.0.0.1", protocols["tcp"], portsHeader(22, 40001))
+	steps := []struct {
+		name    string
+		m       Middleware
+		egress  bool
+		packet  []byte
+		dropped bool
+	}{
+		{"reply before request", a, false, reply, true},
+		{"request to a", a, true, request, false},
+		{"reply from a", a, false, reply, false},
+		{"same reply from b", b, false, reply, true},
+		{"other flow from a", a, false, other, true},
+		{"related icmp error from a", a, false, icmpUnreachable("10.1.1.1", "10.0.0.1", request), false},
+		{"related icmp error from b", b, false, icmpUnreachable("10.1.1.1", "10.0.0.1", request), true},
+		{"unrelated icmp error from a", a, false, icmpUnreachable("10.1.1.1", "10.0.0.1", other), true},
+	}
+	for _, step := range steps {
+		process := step.m.Ingress
+		if step.egress {
+			process = step.m.Egress
+		}
+		dropped, err := process(&message.Packet{Data: step.packet})
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if dropped != step.dropped {
+			t.Fatalf("%s: dropped %v, want %v", step.name, dropped, step.dropped)
+		}
+	}
+}
+
+// test a peer with too many flows evicts its least recently seen flow, not the other peers' flows
+func TestFirewallConntrackEviction(t *testing.T) {
+	f := newTestFirewall(t, `{}`)
+	now := time.Now()
+	flow := func(port int) utils.Flow {
+		return flowOf(t, ipv4Packet("10.0.0.1", "10.1.1.2", protocols["udp"], portsHeader(uint16(port), 53)))
+	}
+	f.track("peer-b", flow(0), now)
+	for port := 0; port < conntrackPeerEntries; port++ {
+		f.track("peer-a", flow(port), now)
+	}
+	// seen again, it's the most recent
+	f.track("peer-a", flow(0), now)
+	f.track("peer-a", flow(conntrackPeerEntries), now)
+
+	if n := f.conntrack["peer-a"].lru.Len(); n != conntrackPeerEntries {
+		t.Fatalf("peer tracks %d flows, want %d", n, conntrackPeerEntries)
+	}
+	for _, c := range []struct {
+		peer    string
+		port    int
+		tracked bool
+	}{
+		{"peer-a", 0, true},
+		{"peer-a", 1, false},
+		{"peer-a", 2, true},
+		{"peer-a", conntrackPeerEntries, true},
+		{"peer-b", 0, true},
+	} {
+		if tracked := f.tracked(c.peer, flow(c.port), now); tracked != c.tracked {
+			t.Fatalf("%s flow %d tracked %v, want %v", c.peer, c.port, tracked, c.tracked)
+		}
+	}
+	// timed out flows expire, and so does the empty peer
+	f.expiredAt = time.Time{}
+	f.expire(now.Add(conntrackOtherTimeout + time.Second))
+	if len(f.conntrack) != 0 {
+		t.Fatalf("%d peers left after expiring", len(f.conntrack))
+	}
+}
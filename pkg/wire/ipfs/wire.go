@@ -13,6 +13,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -62,6 +63,18 @@ const (
 	transientErrorString = "limited connection"
 	// key size
 	keyBits = 2048
+	// hello message
+	helloMessage = "hello"
+	// time to wait for the hello reply. legacy peers never reply
+	helloTimeout = time.Second * 5
+	// accept legacy gob peers during the transition to the binary codec
+	minCodecVersion = message.CodecGob
+	// initial max datagram payload size, lowered when quic reports a smaller one
+	defaultDatagramSize = 1200
+	// memory limit for incomplete messages of a wire
+	reassemblyMemory = 256 * 1024
+	// incomplete messages are dropped after this
+	reassemblyTimeout = time.Second * 5
 )
 
 var (
@@ -69,6 +82,11 @@ var (
 
 	// manager
 	ipfsWireManager *IPFSWireManager
+	// the p2p host is created on first use, so admin clients don't start one
+	ipfsWireManagerOnce sync.Once
+
+	// the message doesn't fit in a datagram and the peer can't reassemble fragments
+	errTooLarge = errors.New("message too large for legacy peer")
 )
 
 // register ipfs wire manager
@@ -81,8 +99,26 @@ func init() {
 		bootstraps = strings.Split(options.Bootstraps, ",")
 	}
 
-	ipfsWireManager = newIPFSWireManager()
-	wire.RegisterWireManager(ipfsWireManager)
+	wire.RegisterWireManager(&lazyWireManager{})
+}
+
+// create the manager and the p2p host once
+func getManager() *IPFSWireManager {
+	ipfsWireManagerOnce.Do(func() {
+		ipfsWireManager = newIPFSWireManager()
+	})
+	return ipfsWireManager
+}
+
+// registered wire manager, starts the real one on the first dial
+type lazyWireManager struct{}
+
+func (m *lazyWireManager) Dial(endpoint string) error {
+	return getManager().Dial(endpoint)
+}
+
+func (m *lazyWireManager) Protocol() string {
+	return "ipfs"
 }
 
 func isP2PCircuitAddress(addr ma.Multiaddr) bool {
@@ -118,17 +154,40 @@ type IPFSWire struct {
 	s network.Stream
 	// quic connection
 	conn quic.Connection
+	// negotiated codec version
+	version int
+	// max datagram payload size
+	maxDatagramSize int
+	// next fragment id
+	fragmentID atomic.Uint32
+	// fragment reassembler
+	reassembler *message.Reassembler
 	// close func
 	closeFunc func() error
 }
 
+func newIPFSWire(s network.Stream, version int, closeFunc func() error) *IPFSWire {
+	return &IPFSWire{
+		s:               s,
+		conn:            getQuicConn(s.Conn()),
+		version:         version,
+		maxDatagramSize: defaultDatagramSize,
+		reassembler:     message.NewReassembler(reassemblyMemory, reassemblyTimeout),
+		closeFunc:       closeFunc,
+	}
+}
+
 func (w *IPFSWire) Endpoint() string {
 	return fmt.Sprintf("ipfs/%s", w.s.Conn().RemotePeer())
 }
 
 func (w *IPFSWire) Address() net.IP {
 	peerAddr := w.s.Conn().RemoteMultiaddr()
-	ip, _ := peerAddr.ValueForProtocol(ma.P_IP4)
+	// ipv6 peers have no ipv4 address
+	ip, err := peerAddr.ValueForProtocol(ma.P_IP4)
+	if err != nil {
+		ip, _ = peerAddr.ValueForProtocol(ma.P_IP6)
+	}
 	return net.ParseIP(ip)
 }
 
@@ -143,40 +202,131 @@ func (w *IPFSWire) Encode(msg *message.Message) error {
 			return err
 		}
 	} else {
-		// traffic message, risk of exceeding MTU
-		// TODO: fix this, can we lower the MTU of the tunnel interface?
+		// traffic message, fragmented if it exceeds the datagram size
 		msgs = []message.Message{*msg}
 	}
 	for _, msg := range msgs {
-		buf, err := msg.Encode()
+		buf, err := msg.EncodeVersion(w.version)
 		if err != nil {
 			return err
 		}
-		if err := w.conn.SendDatagram(buf); err != nil {
-			return errors.WithStack(err)
+		if err := w.send(buf); err != nil {
+			if !errors.Is(err, errTooLarge) {
+				return err
+			}
+			// the source of a packet is told the largest packet the peer can receive
+			if packet, ok := msg.Payload.(message.Packet); ok {
+				return &wire.PacketTooBigError{MTU: w.maxDatagramSize - (len(buf) - len(packet.Data))}
+			}
+			logger.Printf("drop %d bytes message to legacy peer %s, max datagram size %d", len(buf), w.Endpoint(), w.maxDatagramSize)
 		}
 	}
 	return nil
 }
 
-// Decode
-func (w *IPFSWire) Decode(msg *message.Message) error {
-	buf, err := w.conn.ReceiveDatagram(context.Background())
-	if err != nil {
-		return errors.WithStack(err)
+// send encoded message, fragment it if it's too large for a datagram
+func (w *IPFSWire) send(buf []byte) error {
+	if len(buf) <= w.maxDatagramSize {
+		err := w.conn.SendDatagram(buf)
+		tooLarge := &quic.DatagramTooLargeError{}
+		if !errors.As(err, &tooLarge) {
+			return errors.WithStack(err)
+		}
+		// path mtu is smaller than we thought
+		w.maxDatagramSize = int(tooLarge.MaxDatagramPayloadSize)
 	}
-	if err := msg.Decode(buf); err != nil {
+	// legacy peers can't reassemble fragments
+	if w.version < message.CodecBinary {
+		return errTooLarge
+	}
+	fragments, err := message.SplitFragments(buf, w.fragmentID.Add(1), w.maxDatagramSize-message.FragmentOverhead)
+	if err != nil {
 		return err
 	}
+	for _, fragment := range fragments {
+		data, err := fragment.EncodeVersion(w.version)
+		if err != nil {
+			return err
+		}
+		if err := w.conn.SendDatagram(data); err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	return nil
 }
 
+// Decode
+func (w *IPFSWire) Decode(msg *message.Message) error {
+	for {
+		buf, err := w.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := msg.DecodeVersion(w.version, buf); err != nil {
+			return err
+		}
+		if msg.Type != message.MessageTypeFragment {
+			return nil
+		}
+		fragment, ok := msg.Payload.(message.Fragment)
+		if !ok {
+			return errors.Errorf("invalid fragment %+v", msg)
+		}
+		buf, err = w.reassembler.Add(&fragment)
+		if err != nil {
+			logger.Printf("drop fragment from %s: %s", w.Endpoint(), err)
+			continue
+		}
+		// wait for more fragments
+		if buf == nil {
+			continue
+		}
+		if err := msg.DecodeVersion(w.version, buf); err != nil {
+			return err
+		}
+		if msg.Type == message.MessageTypeFragment {
+			return errors.Errorf("nested fragment from %s", w.Endpoint())
+		}
+		return nil
+	}
+}
+
 // send message to ipfs wire
 func (w *IPFSWire) Close() error {
 	w.closeFunc()
 	return nil
 }
 
+// hello message carrying our codec version
+func helloWithVersion(version int) []byte {
+	return []byte(fmt.Sprintf("%s %d", helloMessage, version))
+}
+
+// parse the codec version in peer's hello. a bare hello is from a legacy gob peer
+func parseHello(data []byte) (int, error) {
+	hello := strings.TrimRight(string(data), "\x00")
+	if hello == helloMessage {
+		return message.CodecGob, nil
+	}
+	version := 0
+	if _, err := fmt.Sscanf(hello, helloMessage+" %d", &version); err != nil {
+		return 0, errors.Errorf("invalid hello %q", hello)
+	}
+	return version, nil
+}
+
+// select the codec version both sides support
+func negotiateVersion(peerVersion int) (int, error) {
+	version := peerVersion
+	if version > message.CodecVersion {
+		version = message.CodecVersion
+	}
+	if version < minCodecVersion {
+		return 0, errors.Errorf("codec version %d not supported", peerVersion)
+	}
+	return version, nil
+}
+
 // IPFS wire manager
 type IPFSWireManager struct {
 	wire.BaseWireManager
@@ -184,7 +334,7 @@ type IPFSWireManager struct {
 }
 
 func GetP2PHost() *P2PHost {
-	return ipfsWireManager.P2PHost
+	return getManager().P2PHost
 }
 
 func newIPFSWireManager() *IPFSWireManager {
@@ -213,7 +363,8 @@ func newIPFSWireManager() *IPFSWireManager {
 		}
 		// read the hello
 		buf := make([]byte, 32)
-		if _, err := s.Read(buf); err != nil {
+		n, err := s.Read(buf)
+		if err != nil {
 			close()
 			logger.Printf("error reading client hello %s", err)
 			return
@@ -224,13 +375,29 @@ func newIPFSWireManager() *IPFSWireManager {
 			logger.Printf("ignore unlimited relay %+v", s.Conn())
 			return
 		}
-		logger.Printf("received new stream(%s) peerId (%s) data %s", s.ID(), s.Conn().RemotePeer(), string(buf))
-		// got an inbound wire
-		m.In <- &IPFSWire{
-			s:         s,
-			conn:      getQuicConn(s.Conn()),
-			closeFunc: close,
+		logger.Printf("received new stream(%s) peerId (%s) data %s", s.ID(), s.Conn().RemotePeer(), string(buf[:n]))
+		peerVersion, err := parseHello(buf[:n])
+		if err != nil {
+			close()
+			logger.Printf("error parsing client hello %s", err)
+			return
 		}
+		version, err := negotiateVersion(peerVersion)
+		if err != nil {
+			close()
+			logger.Printf("reject peer (%s): %s", s.Conn().RemotePeer(), err)
+			return
+		}
+		// legacy peers don't expect a reply
+		if peerVersion > message.CodecGob {
+			if _, err := s.Write(helloWithVersion(version)); err != nil {
+				close()
+				logger.Printf("error sending hello reply %s", err)
+				return
+			}
+		}
+		// got an inbound wire
+		m.In <- newIPFSWire(s, version, close)
 	})
 	return m
 }
@@ -271,7 +438,7 @@ func (m *IPFSWireManager) Dial(endpoint string) error {
 			return nil
 		}
 		// send hello to make sure there is only one stream bettwen 2 peers
-		if _, err := s.Write([]byte("hello")); err != nil {
+		if _, err := s.Write(helloWithVersion(message.CodecVersion)); err != nil {
 			close()
 			return errors.WithStack(err)
 		}
@@ -280,16 +447,36 @@ func (m *IPFSWireManager) Dial(endpoint string) error {
 			close()
 			return errors.Errorf("ignore unlimited relay %+v", s.Conn())
 		}
-		// got an outbound wire
-		m.Out <- &IPFSWire{
-			s:         s,
-			conn:      getQuicConn(s.Conn()),
-			closeFunc: close,
+		// wait for the hello reply with the negotiated codec version
+		version, err := m.readHelloReply(s)
+		if err != nil {
+			close()
+			return err
 		}
+		// got an outbound wire
+		m.Out <- newIPFSWire(s, version, close)
 		return nil
 	}
 }
 
+// read server's hello reply. legacy servers don't reply, fallback to gob
+func (m *IPFSWireManager) readHelloReply(s network.Stream) (int, error) {
+	if err := s.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer s.SetReadDeadline(time.Time{})
+
+	peerVersion := message.CodecGob
+	buf := make([]byte, 32)
+	n, err := s.Read(buf)
+	if err != nil {
+		logger.Printf("no hello reply from %s, assume legacy peer: %s", s.Conn().RemotePeer(), err)
+	} else if peerVersion, err = parseHello(buf[:n]); err != nil {
+		return 0, err
+	}
+	return negotiateVersion(peerVersion)
+}
+
 func (m *IPFSWireManager) Protocol() string {
 	return "ipfs"
 }
@@ -469,6 +656,37 @@ func (h *P2PHost) AllowPeer(peer string) error {
 	return nil
 }
 
+// known addresses of the peer
+func (h *P2PHost) PeerAddrs(peerID string) []string {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return nil
+	}
+	addrs := []string{}
+	for _, addr := range h.Peerstore().Addrs(id) {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// add addresses of the peer, so it can be dialed before it's found in the dht
+func (h *P2PHost) AddPeerAddrs(peerID string, addrs []string) error {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	maddrs := []ma.Multiaddr{}
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	h.Peerstore().AddAddrs(id, maddrs, peerstore.AddressTTL)
+	return nil
+}
+
 func (h *P2PHost) PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) (err error) {
 	return h.dht.PutValue(ctx, key, value, opts...)
 }
@@ -515,11 +733,16 @@ func getPrivKey(path string) (crypto.PrivKey, error) {
 	}
 }
 
+// folder of the keyfile and other persisted state of the namespace
+func DataFolder() string {
+	return fmt.Sprintf("data/%s", strings.ReplaceAll(options.Namespace, "-", "_"))
+}
+
 // create libp2p node
 // circuit relay need to be enabled to hide the real server ip.
 func createHost(peerSource func(ctx context.Context, numPeers int) <-chan peer.AddrInfo) (host.Host, *dht.IpfsDHT, error) {
 
-	folder := fmt.Sprintf("data/%s", strings.ReplaceAll(options.Namespace, "-", "_"))
+	folder := DataFolder()
 	if err := os.MkdirAll(folder, 0644); err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
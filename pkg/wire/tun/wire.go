@@ -9,7 +9,6 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/songgao/water"
-	"github.com/songgao/water/waterutil"
 
 	"github.com/nickjfree/goose/pkg/message"
 	"github.com/nickjfree/goose/pkg/utils"
@@ -25,8 +24,12 @@ var (
 const (
 	// max receive buffer size
 	tunBuffSize = 2048
+	// tunnel mtu, oversized packets are fragmented by the wires
+	tunMTU = 1400
 	// ignored routing
 	defaultRouting = "0.0.0.0/0"
+	// flag of anycast addresses in the tunnel endpoint
+	anycastFlag = "@"
 )
 
 // register ipfs wire manager
@@ -49,6 +52,14 @@ type TunWire struct {
 	gateway net.IP
 	// local network
 	network net.IPNet
+	// ipv6 address, nil if ipv6 is disabled
+	address6 net.IP
+	// ipv6 gateway
+	gateway6 net.IP
+	// ipv6 local network
+	network6 net.IPNet
+	// anycast addresses
+	anycast []net.IPNet
 	// current routings
 	routings []net.IPNet
 }
@@ -114,14 +125,15 @@ func (w *TunWire) readPacket(msg *message.Message) error {
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if !waterutil.IsIPv4(buff) {
-			// logger.Printf("recv: ignore none ipv4 packet len %d", n)
+		src, dst, ok := utils.PacketAddresses(buff[:n])
+		if !ok {
+			// logger.Printf("recv: ignore none ip packet len %d", n)
 			continue
 		} else {
 			msg.Type = message.MessageTypePacket
 			msg.Payload = message.Packet{
-				Src:  waterutil.IPv4Source(buff),
-				Dst:  waterutil.IPv4Destination(buff),
+				Src:  src,
+				Dst:  dst,
 				TTL:  message.PacketTTL,
 				Data: buff[0:n],
 			}
@@ -135,8 +147,8 @@ func (w *TunWire) writePacket(msg *message.Message) error {
 	if !ok {
 		return errors.Errorf("got invalid packet struct %s", msg.Payload)
 	}
-	if !waterutil.IsIPv4(packet.Data) {
-		logger.Printf("sent: not ipv4 packet len %d", len(packet.Data))
+	if utils.IPVersion(packet.Data) == 0 {
+		logger.Printf("sent: not ip packet len %d", len(packet.Data))
 		return nil
 	}
 	if _, err := w.ifTun.Write(packet.Data); err != nil {
@@ -153,6 +165,10 @@ func (w *TunWire) setupHostRouting(routings []message.RoutingEntry) error {
 	newRoutings := []net.IPNet{}
 	// routings to add
 	for _, routing := range routings {
+		// ipv6 is disabled on the tunnel
+		if routing.Network.IP.To4() == nil && w.address6 == nil {
+			continue
+		}
 		// ignore defult routing
 		netString := routing.Network.String()
 		newRoutings = append(newRoutings, routing.Network)
@@ -187,7 +203,7 @@ func (w *TunWire) setupHostRouting(routings []message.RoutingEntry) error {
 		}
 		remove = append(remove, exists)
 	}
-	if err := setRouting(add, remove, w.gateway.String()); err != nil {
+	if err := w.setRouting(add, remove); err != nil {
 		return err
 	}
 	// update routings
@@ -198,8 +214,11 @@ func (w *TunWire) setupHostRouting(routings []message.RoutingEntry) error {
 func (w *TunWire) resolveConflict(routings []message.RoutingEntry) error {
 
 	for _, entry := range routings {
-		n, _ := entry.Network.Mask.Size()
-		if n == 32 && !entry.Network.IP.Equal(w.address) {
+		// only conflicts of our ipv4 address are resolved, ipv6 addresses are random ULAs
+		if !utils.IsHostNetwork(entry.Network) || !entry.Network.IP.Equal(w.address) {
+			if entry.Network.IP.Equal(w.address6) {
+				logger.Printf("ipv6 address %s conflicts, ignored", w.address6)
+			}
 			continue
 		}
 		// handle conflict ip
@@ -247,10 +266,9 @@ func (w *TunWire) resolveConflict(routings []message.RoutingEntry) error {
 	return nil
 }
 
-func setRouting(add, remove []net.IPNet, gateway string) error {
+func (w *TunWire) setRouting(add, remove []net.IPNet) error {
 	for _, network := range add {
-		netString := network.String()
-		if err := utils.RouteTable.SetRoute(netString, gateway); err != nil {
+		if err := utils.RouteTable.SetRoute(network.String(), w.gatewayFor(network)); err != nil {
 			return err
 		}
 	}
@@ -270,6 +288,14 @@ func setRouting(add, remove []net.IPNet, gateway string) error {
 	return nil
 }
 
+// tunnel gateway of the same address family
+func (w *TunWire) gatewayFor(network net.IPNet) string {
+	if network.IP.To4() == nil {
+		return w.gateway6.String()
+	}
+	return w.gateway.String()
+}
+
 // Tun-wire manager
 type TunWireManager struct {
 	wire.BaseWireManager
@@ -298,6 +324,41 @@ func (m *TunWireManager) Dial(endpoint string) error {
 	return nil
 }
 
+// split the tunnel addresses. the ipv4 address goes first, followed by an optional ipv6 address.
+// anycast addresses are flagged, eg. 192.168.1.2/24,fd00::2/64,@10.200.0.53/32. unflagged single host
+// addresses are anycast only after the ipv6 address, so fd00::5/128 can be the tunnel's ipv6 address
+func splitAddresses(addr string) (string, string, []string) {
+	addrs := strings.Split(addr, ",")
+	addr6 := ""
+	anycast := []string{}
+	for _, a := range addrs[1:] {
+		if strings.HasPrefix(a, anycastFlag) {
+			anycast = append(anycast, strings.TrimPrefix(a, anycastFlag))
+			continue
+		}
+		ip, network, err := net.ParseCIDR(a)
+		if err == nil && utils.IsHostNetwork(*network) && (addr6 != "" || ip.To4() != nil) {
+			anycast = append(anycast, a)
+		} else if addr6 == "" {
+			addr6 = a
+		}
+	}
+	return addrs[0], addr6, anycast
+}
+
+// set anycast addresses to the tunnel interface, so local services can receive them
+func (w *TunWire) setAnycast(addrs []string) {
+	for _, addr := range addrs {
+		if err := w.addAddress(addr); err != nil {
+			logger.Printf("set anycast address %s failed: %s", addr, err)
+			continue
+		}
+		_, network, _ := net.ParseCIDR(addr)
+		w.anycast = append(w.anycast, *network)
+		logger.Printf("set anycast address %s", addr)
+	}
+}
+
 func (m *TunWireManager) Protocol() string {
 	return "tun"
 }
@@ -15,6 +15,8 @@ import (
 
 // create tun device on linux
 func NewTunWire(name string, addr string) (wire.Wire, error) {
+	// ipv4 address, an optional ipv6 address and anycast addresses
+	addr, addr6, anycast := splitAddresses(addr)
 	// tun config
 	config := water.Config{
 		DeviceType: water.TUN,
@@ -33,8 +35,8 @@ func NewTunWire(name string, addr string) (wire.Wire, error) {
 	if out, err := utils.RunCmd("ip", "addr", "add", addr, "dev", name); err != nil {
 		return nil, errors.Wrap(err, string(out))
 	}
-	// set mtu to 1200
-	if out, err := utils.RunCmd("ifconfig", name, "mtu", "1000", "up"); err != nil {
+	// set mtu
+	if out, err := utils.RunCmd("ifconfig", name, "mtu", fmt.Sprintf("%d", tunMTU), "up"); err != nil {
 		return nil, errors.Wrap(err, string(out))
 	}
 	// bring the tunnel interface up
@@ -46,13 +48,52 @@ func NewTunWire(name string, addr string) (wire.Wire, error) {
 		ifTun.Close()
 		return nil, err
 	}
-	return &TunWire{
+	w := &TunWire{
 		ifTun:   ifTun,
 		name:    name,
 		address: address,
 		network: *network,
 		gateway: gateway,
-	}, nil
+	}
+	// ipv6 is optional, keep running with ipv4 only if it fails
+	if addr6 != "" {
+		if err := w.setAddress6(addr6); err != nil {
+			logger.Printf("ipv6 disabled: %s", err)
+		}
+	}
+	w.setAnycast(anycast)
+	return w, nil
+}
+
+// add a single host address to the tunnel interface
+func (w *TunWire) addAddress(addr string) error {
+	if out, err := utils.RunCmd("ip", "addr", "add", addr, "dev", w.name); err != nil {
+		return errors.Wrap(err, string(out))
+	}
+	return nil
+}
+
+// set ipv6 address to the tunnel interface
+func (w *TunWire) setAddress6(addr string) error {
+	address, network, err := net.ParseCIDR(addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if address.To4() != nil {
+		return errors.Errorf("%s is not an ipv6 address", addr)
+	}
+	gateway, err := defaultGateway(addr)
+	if err != nil {
+		return err
+	}
+	if out, err := utils.RunCmd("ip", "-6", "addr", "add", addr, "dev", w.name); err != nil {
+		return errors.Wrap(err, string(out))
+	}
+	w.address6 = address
+	w.network6 = *network
+	w.gateway6 = gateway
+	logger.Printf("set tunnel ipv6 address to %s", addr)
+	return nil
 }
 
 func (w *TunWire) ChangeAddress(addr string) error {
@@ -6,6 +6,7 @@ import (
 	"github.com/nickjfree/goose/pkg/utils"
 	"github.com/nickjfree/goose/pkg/wire"
 	"net"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -128,3 +129,28 @@ func TestTraffic(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// test anycast addresses are flagged, or follow the ipv6 address
+func TestSplitAddresses(t *testing.T) {
+	for _, c := range []struct {
+		addr    string
+		addr6   string
+		anycast []string
+	}{
+		{"192.168.1.2/24", "", []string{}},
+		{"192.168.1.2/24,fd00::2/64", "fd00::2/64", []string{}},
+		// a single host ipv6 address is the tunnel's address
+		{"192.168.1.2/24,fd00::5/128", "fd00::5/128", []string{}},
+		{"192.168.1.2/24,fd00::5/128,fd00::53/128", "fd00::5/128", []string{"fd00::53/128"}},
+		{"192.168.1.2/24,@fd00::53/128", "", []string{"fd00::53/128"}},
+		{"192.168.1.2/24,@fd00::53/128,fd00::5/128", "fd00::5/128", []string{"fd00::53/128"}},
+		{"192.168.1.2/24,fd00::2/64,@10.200.0.53/32,@fd00::53/128", "fd00::2/64", []string{"10.200.0.53/32", "fd00::53/128"}},
+		// legacy unflagged ipv4 anycast addresses
+		{"192.168.1.2/24,10.200.0.53/32,fd00::2/64", "fd00::2/64", []string{"10.200.0.53/32"}},
+	} {
+		addr, addr6, anycast := splitAddresses(c.addr)
+		if addr != "192.168.1.2/24" || addr6 != c.addr6 || !reflect.DeepEqual(anycast, c.anycast) {
+			t.Fatalf("%s: got %s %q %v, want %q %v", c.addr, addr, addr6, anycast, c.addr6, c.anycast)
+		}
+	}
+}
@@ -24,6 +24,8 @@ var (
 
 // create tun device on windows
 func NewTunWire(name string, addr string) (wire.Wire, error) {
+	// ipv4 address, an optional ipv6 address and anycast addresses
+	addr, addr6, anycast := splitAddresses(addr)
 	// tun config, set
 	config := water.Config{
 		DeviceType: water.TUN,
@@ -49,13 +51,61 @@ func NewTunWire(name string, addr string) (wire.Wire, error) {
 		ifTun.Close()
 		return nil, err
 	}
-	return &TunWire{
+	w := &TunWire{
 		ifTun:   ifTun,
 		name:    name,
 		address: address,
 		network: *network,
 		gateway: gateway,
-	}, nil
+	}
+	// ipv6 is optional, keep running with ipv4 only if it fails
+	if addr6 != "" {
+		if err := w.setAddress6(addr6); err != nil {
+			logger.Printf("ipv6 disabled: %s", err)
+		}
+	}
+	w.setAnycast(anycast)
+	return w, nil
+}
+
+// add a single host address to the tunnel interface
+func (w *TunWire) addAddress(addr string) error {
+	address, network, err := net.ParseCIDR(addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	args := fmt.Sprintf("interface ipv4 add address \"%s\" %s %s", w.ifTun.Name(), address.String(), maskString(network.Mask))
+	if address.To4() == nil {
+		args = fmt.Sprintf("interface ipv6 add address \"%s\" %s", w.ifTun.Name(), addr)
+	}
+	if out, err := utils.RunCmd("netsh", strings.Split(args, " ")...); err != nil {
+		return errors.Wrap(err, string(out))
+	}
+	return nil
+}
+
+// set ipv6 address to the tunnel interface
+func (w *TunWire) setAddress6(addr string) error {
+	address, network, err := net.ParseCIDR(addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if address.To4() != nil {
+		return errors.Errorf("%s is not an ipv6 address", addr)
+	}
+	gateway, err := defaultGateway(addr)
+	if err != nil {
+		return err
+	}
+	args := fmt.Sprintf("interface ipv6 add address \"%s\" %s", w.ifTun.Name(), addr)
+	if out, err := utils.RunCmd("netsh", strings.Split(args, " ")...); err != nil {
+		return errors.Wrap(err, string(out))
+	}
+	w.address6 = address
+	w.network6 = *network
+	w.gateway6 = gateway
+	logger.Printf("set tunnel ipv6 address to %s", addr)
+	return nil
 }
 
 func (w *TunWire) ChangeAddress(addr string) error {
@@ -107,12 +157,12 @@ func setIPAddress(iface *water.Interface, addr string) error {
 		return errors.Wrap(err, string(out))
 	}
 	logger.Printf("set tunnel dnsservers to 8.8.8.8")
-	//  set mtu to 1200
-	args = fmt.Sprintf("interface ipv4 set subinterface \"%s\" mtu=1000 store=active", iface.Name())
+	//  set mtu
+	args = fmt.Sprintf("interface ipv4 set subinterface \"%s\" mtu=%d store=active", iface.Name(), tunMTU)
 	if out, err := utils.RunCmd("netsh", strings.Split(args, " ")...); err != nil {
 		return errors.Wrap(err, string(out))
 	}
-	logger.Printf("set tunnel mtu to 1000")
+	logger.Printf("set tunnel mtu to %d", tunMTU)
 	// to make windows use this dnsserver, we must set interface metric to a small value
 	args = fmt.Sprintf("interface ipv4 set interface \"%s\" metric=9", iface.Name())
 	if out, err := utils.RunCmd("netsh", strings.Split(args, " ")...); err != nil {
@@ -3,9 +3,9 @@ package wireguard
 import (
 	"fmt"
 	"github.com/nickjfree/goose/pkg/message"
+	"github.com/nickjfree/goose/pkg/utils"
 	"github.com/nickjfree/goose/pkg/wire"
 	"github.com/pkg/errors"
-	"github.com/songgao/water/waterutil"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
@@ -131,8 +131,8 @@ func (t *TunDevice) Encode(msg *message.Message) error {
 		if !ok {
 			return errors.Errorf("got invalid packet struct %s", msg.Payload)
 		}
-		if !waterutil.IsIPv4(packet.Data) {
-			logger.Printf("sent: not ipv4 packet len %d", len(packet.Data))
+		if utils.IPVersion(packet.Data) == 0 {
+			logger.Printf("sent: not ip packet len %d", len(packet.Data))
 			return nil
 		}
 		if err := t.writePacket(msg); err != nil {
@@ -161,13 +161,14 @@ func (t *TunDevice) readPacket(msg *message.Message) error {
 			if !ok {
 				return errors.Errorf(error_tun_closed, t.Endpoint())
 			}
-			if !waterutil.IsIPv4(buff) {
+			src, dst, ok := utils.PacketAddresses(buff)
+			if !ok {
 				continue
 			} else {
 				msg.Type = message.MessageTypePacket
 				msg.Payload = message.Packet{
-					Src:  waterutil.IPv4Source(buff),
-					Dst:  waterutil.IPv4Destination(buff),
+					Src:  src,
+					Dst:  dst,
 					TTL:  message.PacketTTL,
 					Data: buff,
 				}
@@ -203,8 +204,8 @@ func (t *TunDevice) writePacket(msg *message.Message) error {
 	if !ok {
 		return errors.Errorf("got invalid packet struct %s", msg.Payload)
 	}
-	if !waterutil.IsIPv4(packet.Data) {
-		logger.Printf("sent: not ipv4 packet len %d", len(packet.Data))
+	if utils.IPVersion(packet.Data) == 0 {
+		logger.Printf("sent: not ip packet len %d", len(packet.Data))
 		return nil
 	}
 	select {